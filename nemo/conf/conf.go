@@ -1,12 +1,17 @@
 package conf
 
 import (
-	"encoding/json"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/lircstar/nemo/sys/log"
 	"github.com/lircstar/nemo/sys/util"
 )
 
@@ -18,22 +23,77 @@ type SYS struct {
 	Monitor      string `json:"monitor"` // for bit operation. "1111" first bit : cpu second bit : mem third bit : block last bit : goroutine
 	SigClose     bool   `json:"sig_close"`
 
+	// time to drain agents gracefully on close signal, 0 close them at once.
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+
 	// log
 	LogLevel string `json:"log_level"` // "debug" "info" "warn" "error" "fatal"
 	LogFile  bool   `json:"log_file"`
 	LogFlags string `json:"log_flags"`
+
+	// log file rotation
+	LogMaxSize    int    `json:"log_max_size"`    // megabytes of one log file, 0 means no limit.
+	LogMaxBackups int    `json:"log_max_backups"` // count of old log files kept, 0 keeps all.
+	LogMaxAge     int    `json:"log_max_age"`     // days to keep old log files, 0 keeps all.
+	LogRotate     string `json:"log_rotate"`      // "daily" "hourly" or "" for no time rotation.
+
+	// admin http listener for metrics, pprof and inspection, "" to disable it. The
+	// requests must carry "Authorization: Bearer <admin_token>", the listener is only
+	// started on a loopback address if admin_token is empty.
+	AdminAddr  string `json:"admin_addr"`
+	AdminToken string `json:"admin_token" conf:"secret"`
+
+	// time between checks of the config file for changes, 0 reloads on SIGHUP only.
+	ConfWatch time.Duration `json:"conf_watch"`
 }
 
 type TCP struct {
-	Addr            string `json:"addr"`
-	InnerAddr       string `json:"inner_addr"`
-	MaxConnNum      int    `json:"max_conn_num"`
-	LenMsgLen       int    `json:"len_msg_len"`
-	MinMsgLen       int    `json:"min_msg_len"`
-	MaxMsgLen       int    `json:"max_msg_len"`
-	TimeOut         int    `json:"time_out"`
-	RoutineSafe     bool   `json:"routine_safe"`
-	PendingWriteNum int    `json:"pending_write_num"`
+	Addr            string        `json:"addr"`
+	InnerAddr       string        `json:"inner_addr"`
+	MaxConnNum      int           `json:"max_conn_num"`
+	LenMsgLen       int           `json:"len_msg_len"`
+	MinMsgLen       int           `json:"min_msg_len"`
+	MaxMsgLen       int           `json:"max_msg_len"`
+	TimeOut         time.Duration `json:"time_out"`
+	RoutineSafe     bool          `json:"routine_safe"`
+	PendingWriteNum int           `json:"pending_write_num"`
+
+	// the agents are pinged every ping_interval, 0 for no ping. An agent silent for
+	// time_out is closed, it is counted in whole seconds.
+	PingInterval time.Duration `json:"ping_interval"`
+
+	Limit Limit `json:"limit"`
+
+	// the messages of a tick of the main loop are written together at its end.
+	FlushOnTick bool `json:"flush_on_tick"`
+
+	// what a conn does when its write queue is over pending_write_num messages or
+	// max_pending_bytes bytes: "disconnect" (default) "block" "drop_newest"
+	// "drop_oldest" "priority". block waits up to block_timeout, then disconnects.
+	Backpressure    string        `json:"backpressure"`
+	BlockTimeout    time.Duration `json:"block_timeout"`
+	MaxPendingBytes int           `json:"max_pending_bytes"`
+
+	// tls, the server uses it when cert_file is set and requires client certificates
+	// signed by ca_file if that is set too. The client dials over tls when tls or any
+	// file is set, verifies the server by ca_file and sends cert_file.
+	TLS                bool   `json:"tls"`
+	CertFile           string `json:"cert_file" conf:"secret"`
+	KeyFile            string `json:"key_file" conf:"secret"`
+	CAFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	// codecs ("zstd" "snappy" "deflate") in the order of preference, negotiated on
+	// connect. Messages of at least compress_threshold bytes are compressed.
+	Compression       []string `json:"compression"`
+	CompressThreshold int      `json:"compress_threshold"`
+
+	// encrypted session, secure_key is the hex ed25519 seed signing the handshake of a
+	// server, secure_peer_key the hex ed25519 public key of the server a client accepts.
+	Secure        bool   `json:"secure"`
+	SecureKey     string `json:"secure_key" conf:"secret"`
+	SecurePeerKey string `json:"secure_peer_key"`
 
 	// Client
 	Reconnect       bool          `json:"reconnect"`
@@ -41,13 +101,37 @@ type TCP struct {
 }
 
 type UDP struct {
-	Addr        string `json:"addr"`
-	MaxConnNum  int    `json:"max_conn_num"`
-	LenMsgLen   int    `json:"len_msg_len"`
-	MaxMsgLen   int    `json:"max_msg_len"`
-	MinMsgLen   int    `json:"min_msg_len"`
-	TimeOut     int    `json:"time_out"`
-	RoutineSafe bool   `json:"routine_safe"`
+	Addr        string        `json:"addr"`
+	MaxConnNum  int           `json:"max_conn_num"`
+	LenMsgLen   int           `json:"len_msg_len"`
+	MaxMsgLen   int           `json:"max_msg_len"`
+	MinMsgLen   int           `json:"min_msg_len"`
+	TimeOut     time.Duration `json:"time_out"`
+	RoutineSafe bool          `json:"routine_safe"`
+
+	// the agents are pinged every ping_interval, 0 for no ping.
+	PingInterval time.Duration `json:"ping_interval"`
+
+	Limit Limit `json:"limit"`
+
+	// encrypted session, secure_key is the hex ed25519 seed signing the handshake of a
+	// server, secure_peer_key the hex ed25519 public key of the server a client accepts.
+	Secure        bool   `json:"secure"`
+	SecureKey     string `json:"secure_key" conf:"secret"`
+	SecurePeerKey string `json:"secure_peer_key"`
+
+	// reliable ordered messages, both ends need it. mtu is the max size of a datagram,
+	// window the count of segments in flight, no_congestion drops the congestion
+	// window for low latency.
+	Reliable     bool `json:"reliable"`
+	MTU          int  `json:"mtu"`
+	Window       int  `json:"window"`
+	NoCongestion bool `json:"no_congestion"`
+
+	// handshake makes the agents of a server by a cookie handshake and keeps them by
+	// session id, so spoofed datagrams make none and a client whose address changes
+	// keeps its session. Both ends need it.
+	Handshake bool `json:"handshake"`
 
 	// Client
 	Reconnect       bool
@@ -56,17 +140,60 @@ type UDP struct {
 
 type WSS struct {
 	Addr            string        `json:"addr"`
-	CertFile        string        `json:"cert_file"`
-	KeyFile         string        `json:"key_file"`
+	CertFile        string        `json:"cert_file" conf:"secret"`
+	KeyFile         string        `json:"key_file" conf:"secret"`
 	MaxConnNum      int           `json:"max_conn_num"`
 	MaxMsgLen       int           `json:"max_msg_len"`
 	HTTPTimeout     time.Duration `json:"http_timeout"`
 	PendingWriteNum int           `json:"pending_write_num"`
+	RoutineSafe     bool          `json:"routine_safe"`
+
+	// the agents are pinged by websocket ping frames every ping_interval, 0 for no
+	// ping. An agent silent for time_out is closed, 0 for never.
+	TimeOut      time.Duration `json:"time_out"`
+	PingInterval time.Duration `json:"ping_interval"`
+
+	Limit Limit `json:"limit"`
+
+	// permessage-deflate, messages of at least compress_threshold bytes are compressed.
+	Compression       bool `json:"compression"`
+	CompressThreshold int  `json:"compress_threshold"`
 
 	// Client
 	Reconnect bool
 }
 
+// Limit is the flood protection of the agents of a server, a limit of 0 is off.
+type Limit struct {
+	// each agent reads up to msg_rate messages and byte_rate bytes a second, and up to
+	// msg_burst messages and byte_burst bytes at once, the burst is the rate if 0.
+	MsgRate   float64 `json:"msg_rate"`
+	MsgBurst  int     `json:"msg_burst"`
+	ByteRate  float64 `json:"byte_rate"`
+	ByteBurst int     `json:"byte_burst"`
+
+	// what is done with a message over a limit: "drop" (default) "delay" "kick" "ban".
+	// ban kicks the agent and refuses its ip for ban_time.
+	Action  string        `json:"action"`
+	BanTime time.Duration `json:"ban_time"`
+
+	// the conns of an ip over max_conn_per_ip are refused.
+	MaxConnPerIP int `json:"max_conn_per_ip"`
+}
+
+// check the values of l, in the section name.
+func (l *Limit) check(name string, check func(ok bool, format string, v ...any)) {
+	check(l.MsgRate >= 0 && l.MsgBurst >= 0, "%s.limit: msg_rate and msg_burst must not be negative", name)
+	check(l.ByteRate >= 0 && l.ByteBurst >= 0, "%s.limit: byte_rate and byte_burst must not be negative", name)
+	switch l.Action {
+	case "", "drop", "delay", "kick", "ban":
+	default:
+		check(false, "%s.limit.action: unknown action %q", name, l.Action)
+	}
+	check(l.BanTime >= 0, "%s.limit.ban_time: must not be negative", name)
+	check(l.MaxConnPerIP >= 0, "%s.limit.max_conn_per_ip: must not be negative", name)
+}
+
 type Config struct {
 	Sys SYS `json:"sys"`
 	Tcp TCP `json:"tcp"`
@@ -74,78 +201,314 @@ type Config struct {
 	Wss WSS `json:"wss"`
 }
 
-var conf Config
+// conf is the current config, Set replaces it whole so the getters get a snapshot
+// which a reload doesn't change.
+var conf atomic.Pointer[Config]
+
+var (
+	mu       sync.Mutex
+	loadPath string
+	handlers = make(map[string][]handler)
+	lastId   uint64 // of the handlers.
+)
+
+// handler is a function given to OnChange.
+type handler struct {
+	id uint64
+	f  func()
+}
+
+// section names given to OnChange, they are the json keys of Config.
+const (
+	SectionSYS = "sys"
+	SectionTCP = "tcp"
+	SectionUDP = "udp"
+	SectionWSS = "wss"
+)
+
+// current get the current config, it must not be changed.
+func current() *Config {
+	if c := conf.Load(); c != nil {
+		return c
+	}
+	c := Default()
+	conf.CompareAndSwap(nil, &c)
+	return conf.Load()
+}
 
 func GetSYS() *SYS {
-	return &conf.Sys
+	return &current().Sys
 }
 
 func GetTCP() *TCP {
-	return &conf.Tcp
+	return &current().Tcp
 }
 
 func GetUDP() *UDP {
-	return &conf.Udp
+	return &current().Udp
 }
 
 func GetWSS() *WSS {
-	return &conf.Wss
+	return &current().Wss
 }
 
-//var CallBack func(k string, v map[string]any)
+// Default get the config with the default values.
+func Default() Config {
+	var c Config
+	c.Sys.Version = "1.0.0"
+	c.Sys.LenStackBuf = 4096
+	c.Sys.Monitor = "0"      // for bit operation. "1111" first bit : cpu second bit : mem third bit : block last bit : goroutine
+	c.Sys.SigClose = false   // close signal
+	c.Sys.LogLevel = "debug" // "debug" "info" "warn" "error" "fatal"
+	c.Sys.LogFile = false
+	c.Sys.LogMaxSize = 0
+	c.Sys.LogMaxBackups = 0
+	c.Sys.LogMaxAge = 0
+	c.Sys.LogRotate = ""
+	c.Sys.LittleEndian = false
+	c.Sys.ShutdownTimeout = 0
+	c.Sys.AdminAddr = ""
+	c.Sys.AdminToken = ""
+	c.Sys.ConfWatch = 0
 
-func init() {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		log.Fatalf("%v", err)
+	c.Tcp.Addr = "127.0.0.1:6000"
+	c.Tcp.LenMsgLen = 2
+	c.Tcp.MinMsgLen = 1
+	c.Tcp.MaxMsgLen = 4096
+	c.Tcp.MaxConnNum = 65535
+	c.Tcp.TimeOut = 20 * time.Second
+	c.Tcp.RoutineSafe = true
+	c.Tcp.PendingWriteNum = 100
+	c.Tcp.CompressThreshold = 1024
+	c.Tcp.BlockTimeout = time.Second
+	c.Tcp.Limit.BanTime = 10 * time.Minute
+
+	c.Tcp.Reconnect = false
+	c.Tcp.ConnectInterval = 3 * time.Second
+
+	c.Udp.Addr = "127.0.0.1:7000"
+	c.Udp.MaxConnNum = 65535
+	c.Udp.MinMsgLen = 1
+	c.Udp.MaxMsgLen = 4096
+	c.Udp.TimeOut = 10 * time.Second
+	c.Udp.RoutineSafe = true
+	c.Udp.Limit.BanTime = 10 * time.Minute
+
+	c.Udp.Reconnect = false
+	c.Udp.ConnectInterval = 3 * time.Second
+
+	c.Wss.Addr = "127.0.0.1:6000"
+	c.Wss.MaxConnNum = 65535
+	c.Wss.MaxMsgLen = 4096
+	c.Wss.PendingWriteNum = 100
+	c.Wss.HTTPTimeout = 30 * time.Second
+	c.Wss.RoutineSafe = true
+	c.Wss.CompressThreshold = 1024
+	c.Wss.TimeOut = 60 * time.Second
+	c.Wss.PingInterval = 20 * time.Second
+	c.Wss.Limit.BanTime = 10 * time.Minute
+
+	c.Wss.Reconnect = false
+	return c
+}
+
+// Validate check the values of c, all the problems are returned together.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, v ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, v...))
+		}
+	}
+
+	switch c.Sys.LogLevel {
+	case "debug", "info", "warn", "error", "fatal":
+	default:
+		check(false, "sys.log_level: unknown level %q", c.Sys.LogLevel)
+	}
+	switch c.Sys.LogRotate {
+	case "", "daily", "hourly":
+	default:
+		check(false, "sys.log_rotate: unknown rotation %q", c.Sys.LogRotate)
 	}
-	filename := filepath.Join(dir, "conf", util.GetProcessName()+".json")
-	data, err := os.ReadFile(filename)
+	if _, err := strconv.ParseInt(c.Sys.Monitor, 2, 32); err != nil {
+		check(false, "sys.monitor: %q is not a bit string", c.Sys.Monitor)
+	}
+	check(isTimeOut(c.Sys.ShutdownTimeout), "sys.shutdown_timeout: must be 0 or at least 1s")
+	check(c.Sys.LogMaxSize >= 0, "sys.log_max_size: must not be negative")
+	check(isTimeOut(c.Sys.ConfWatch), "sys.conf_watch: must be 0 or at least 1s")
+
+	check(c.Tcp.MaxConnNum >= 0, "tcp.max_conn_num: must not be negative")
+	check(c.Tcp.LenMsgLen == 1 || c.Tcp.LenMsgLen == 2 || c.Tcp.LenMsgLen == 4,
+		"tcp.len_msg_len: must be 1, 2 or 4, got %v", c.Tcp.LenMsgLen)
+	check(c.Tcp.MinMsgLen <= c.Tcp.MaxMsgLen, "tcp.min_msg_len: greater than max_msg_len")
+	check(isTimeOut(c.Tcp.TimeOut), "tcp.time_out: must be 0 or at least 1s")
+	check(c.Tcp.PendingWriteNum >= 0, "tcp.pending_write_num: must not be negative")
+	check(c.Tcp.PingInterval >= 0, "tcp.ping_interval: must not be negative")
+	c.Tcp.Limit.check("tcp", check)
+	switch c.Tcp.Backpressure {
+	case "", "disconnect", "block", "drop_newest", "drop_oldest", "priority":
+	default:
+		check(false, "tcp.backpressure: unknown policy %q", c.Tcp.Backpressure)
+	}
+	check(c.Tcp.BlockTimeout >= 0, "tcp.block_timeout: must not be negative")
+	check(c.Tcp.MaxPendingBytes >= 0, "tcp.max_pending_bytes: must not be negative")
+	check(c.Tcp.ConnectInterval >= 0, "tcp.connect_interval: must not be negative")
+	check((c.Tcp.CertFile == "") == (c.Tcp.KeyFile == ""), "tcp: cert_file and key_file must be set together")
+	for _, codec := range c.Tcp.Compression {
+		switch codec {
+		case "zstd", "snappy", "deflate":
+		default:
+			check(false, "tcp.compression: unknown codec %q", codec)
+		}
+	}
+	check(c.Tcp.CompressThreshold >= 0, "tcp.compress_threshold: must not be negative")
+	check(isHexKey(c.Tcp.SecureKey), "tcp.secure_key: must be 32 bytes in hex")
+	check(isHexKey(c.Tcp.SecurePeerKey), "tcp.secure_peer_key: must be 32 bytes in hex")
+
+	check(c.Udp.MaxConnNum >= 0, "udp.max_conn_num: must not be negative")
+	check(c.Udp.MinMsgLen <= c.Udp.MaxMsgLen, "udp.min_msg_len: greater than max_msg_len")
+	check(isTimeOut(c.Udp.TimeOut), "udp.time_out: must be 0 or at least 1s")
+	check(c.Udp.PingInterval >= 0, "udp.ping_interval: must not be negative")
+	c.Udp.Limit.check("udp", check)
+	check(c.Udp.ConnectInterval >= 0, "udp.connect_interval: must not be negative")
+	check(isHexKey(c.Udp.SecureKey), "udp.secure_key: must be 32 bytes in hex")
+	check(isHexKey(c.Udp.SecurePeerKey), "udp.secure_peer_key: must be 32 bytes in hex")
+	check(c.Udp.MTU == 0 || c.Udp.MTU >= 256 && c.Udp.MTU <= 65507, "udp.mtu: must be 0 or between 256 and 65507")
+	check(c.Udp.Window >= 0 && c.Udp.Window <= 65535, "udp.window: must be between 0 and 65535")
+
+	check(c.Wss.MaxConnNum >= 0, "wss.max_conn_num: must not be negative")
+	check(c.Wss.PendingWriteNum >= 0, "wss.pending_write_num: must not be negative")
+	check(isTimeOut(c.Wss.TimeOut), "wss.time_out: must be 0 or at least 1s")
+	check(c.Wss.PingInterval >= 0, "wss.ping_interval: must not be negative")
+	c.Wss.Limit.check("wss", check)
+	check(c.Wss.CompressThreshold >= 0, "wss.compress_threshold: must not be negative")
+	check((c.Wss.CertFile == "") == (c.Wss.KeyFile == ""), "wss: cert_file and key_file must be set together")
+
+	return errors.Join(errs...)
+}
+
+// isTimeOut tell whether d is 0 or at least a second, the values under it are most
+// likely seconds written with no unit, read as nanoseconds.
+func isTimeOut(d time.Duration) bool {
+	return d == 0 || d >= time.Second
+}
+
+// isHexKey tell whether s is empty or a key of 32 bytes in hex.
+func isHexKey(s string) bool {
+	if s == "" {
+		return true
+	}
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+//-------------------------------------------------------------------------------------
+// load.
+
+// Load read the config file path over the default values and apply it with the
+// overrides, the format is taken from the extension. The current config is kept if it
+// is not valid. Path is kept for Reload.
+func Load(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatalf("%v", err)
-	}
-
-	// Setting default value
-	conf.Sys.Version = "1.0.0"
-	conf.Sys.LenStackBuf = 4096
-	conf.Sys.Monitor = "0"      // for bit operation. "1111" first bit : cpu second bit : mem third bit : block last bit : goroutine
-	conf.Sys.SigClose = false   // close signal
-	conf.Sys.LogLevel = "debug" // "debug" "info" "warn" "error" "fatal"
-	conf.Sys.LogFile = false
-	conf.Sys.LittleEndian = false
-
-	conf.Tcp.Addr = "127.0.0.1:6000"
-	conf.Tcp.LenMsgLen = 2
-	conf.Tcp.MinMsgLen = 1
-	conf.Tcp.MaxMsgLen = 4096
-	conf.Tcp.MaxConnNum = 65535
-	conf.Tcp.TimeOut = 20
-	conf.Tcp.RoutineSafe = true
-	conf.Tcp.PendingWriteNum = 100
-
-	conf.Tcp.Reconnect = false
-	conf.Tcp.ConnectInterval = 3 * time.Second
-
-	conf.Udp.Addr = "127.0.0.1:7000"
-	conf.Udp.MaxConnNum = 65535
-	conf.Udp.MinMsgLen = 1
-	conf.Udp.MaxMsgLen = 4096
-	conf.Udp.TimeOut = 10
-	conf.Udp.RoutineSafe = true
-
-	conf.Udp.Reconnect = false
-	conf.Udp.ConnectInterval = 3 * time.Second
-
-	conf.Wss.Addr = "127.0.0.1:6000"
-	conf.Wss.MaxConnNum = 65535
-	conf.Wss.MaxMsgLen = 4096
-	conf.Wss.PendingWriteNum = 100
-	conf.Wss.HTTPTimeout = 30 * time.Second
-
-	conf.Wss.Reconnect = false
-
-	err = json.Unmarshal(data, &conf)
+		return err
+	}
+	if err = loadBytes(data, formatOf(path)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	mu.Lock()
+	loadPath = path
+	mu.Unlock()
+	return nil
+}
+
+// LoadBytes parse the json config over the default values and apply it with the
+// overrides, the current config is kept if it is not valid. The subscribers of the
+// changed sections are notified.
+func LoadBytes(data []byte) error {
+	return loadBytes(data, "json")
+}
+
+func loadBytes(data []byte, format string) error {
+	c := Default()
+	if err := decode(data, format, &c); err != nil {
+		return err
+	}
+	return Set(c)
+}
+
+// Set apply the overrides to c, validate it and apply it.
+func Set(c Config) error {
+	if err := applyOverrides(&c); err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	old := current()
+	conf.Store(&c)
+	var changed []func()
+	for _, s := range []struct {
+		name     string
+		old, new any
+	}{
+		{SectionSYS, old.Sys, c.Sys},
+		{SectionTCP, old.Tcp, c.Tcp},
+		{SectionUDP, old.Udp, c.Udp},
+		{SectionWSS, old.Wss, c.Wss},
+	} {
+		if !reflect.DeepEqual(s.old, s.new) {
+			for _, h := range handlers[s.name] {
+				changed = append(changed, h.f)
+			}
+		}
+	}
+	mu.Unlock()
+
+	for _, f := range changed {
+		f()
+	}
+	return nil
+}
+
+// Reload load the file given to Load again.
+func Reload() error {
+	path := Path()
+	if path == "" {
+		return errors.New("no config file loaded")
+	}
+	return Load(path)
+}
+
+// OnChange call f after a load changes section, see the Section constants, until
+// cancel is called.
+func OnChange(section string, f func()) (cancel func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	lastId++
+	id := lastId
+	handlers[section] = append(handlers[section], handler{id: id, f: f})
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		hs := handlers[section]
+		for i := range hs {
+			if hs[i].id == id {
+				handlers[section] = append(hs[:i:i], hs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// DefaultPath is conf/<process>.json beside the executable.
+func DefaultPath() string {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
-		log.Fatalf("%v", err)
+		return ""
 	}
+	return filepath.Join(dir, "conf", util.GetProcessName()+".json")
 }
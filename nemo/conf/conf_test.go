@@ -0,0 +1,237 @@
+package conf
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadBytes(t *testing.T) {
+	defer Set(Default())
+
+	if err := LoadBytes([]byte(`{"tcp": {"addr": "127.0.0.1:9000", "time_out": "5s"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if GetTCP().Addr != "127.0.0.1:9000" || GetTCP().TimeOut != 5*time.Second {
+		t.Fatalf("tcp not loaded: %+v", GetTCP())
+	}
+	// the others keep their default value.
+	if GetTCP().MaxMsgLen != 4096 || GetSYS().LogLevel != "debug" {
+		t.Fatal("default value lost")
+	}
+
+	err := LoadBytes([]byte(`{"sys": {"log_level": "loud"}, "tcp": {"len_msg_len": 3, "time_out": -1}}`))
+	if err == nil {
+		t.Fatal("invalid config loaded")
+	}
+	for _, want := range []string{"sys.log_level", "tcp.len_msg_len", "tcp.time_out"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q doesn't report %s", err, want)
+		}
+	}
+	// the current config is kept.
+	if GetTCP().TimeOut != 5*time.Second {
+		t.Fatal("invalid config applied")
+	}
+
+	// seconds with no unit are nanoseconds.
+	if err := LoadBytes([]byte(`{"tcp": {"time_out": 5}}`)); err == nil || !strings.Contains(err.Error(), "tcp.time_out") {
+		t.Fatalf("time out of 5ns loaded: %v", err)
+	}
+
+	if err := LoadBytes([]byte(`{"tcp": `)); err == nil {
+		t.Fatal("broken json loaded")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	defer Set(Default())
+
+	if err := LoadBytes([]byte(`{"udp": {"limit": {"msg_rate": 50, "action": "ban"}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if l := GetUDP().Limit; l.MsgRate != 50 || l.Action != "ban" || l.BanTime != 10*time.Minute {
+		t.Fatalf("limit not loaded: %+v", l)
+	}
+
+	err := LoadBytes([]byte(`{"tcp": {"limit": {"byte_rate": -1, "action": "shout"}}, "wss": {"limit": {"max_conn_per_ip": -2}}}`))
+	if err == nil {
+		t.Fatal("invalid limit loaded")
+	}
+	for _, want := range []string{"tcp.limit: byte_rate", "tcp.limit.action", "wss.limit.max_conn_per_ip"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q doesn't report %s", err, want)
+		}
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	defer Set(Default())
+
+	var tcp, udp int
+	cancelTCP := OnChange(SectionTCP, func() { tcp++ })
+	defer OnChange(SectionUDP, func() { udp++ })()
+
+	if err := LoadBytes([]byte(`{"tcp": {"max_conn_num": 10}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadBytes([]byte(`{"tcp": {"max_conn_num": 10}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if tcp != 1 || udp != 0 {
+		t.Fatalf("notified tcp %d udp %d times", tcp, udp)
+	}
+
+	cancelTCP()
+	if err := LoadBytes([]byte(`{"tcp": {"max_conn_num": 20}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if tcp != 1 {
+		t.Fatal("notified after cancel")
+	}
+}
+
+func TestReloadSnapshot(t *testing.T) {
+	defer Set(Default())
+
+	// the sections got before a reload keep their values, read with no lock.
+	tcp := GetTCP()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = GetTCP().MaxConnNum + GetWSS().PendingWriteNum
+		}
+	}()
+	for i := 1; i <= 10; i++ {
+		if err := LoadBytes([]byte(fmt.Sprintf(`{"tcp": {"max_conn_num": %d}}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if tcp.MaxConnNum == 10 || GetTCP().MaxConnNum != 10 {
+		t.Fatalf("snapshot %d, current %d", tcp.MaxConnNum, GetTCP().MaxConnNum)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	defer Set(Default())
+
+	path := filepath.Join(t.TempDir(), "test.json")
+	if err := os.WriteFile(path, []byte(`{"sys": {"log_level": "info"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan string, 1)
+	defer OnChange(SectionSYS, func() {
+		select {
+		case changed <- GetSYS().LogLevel:
+		default:
+		}
+	})()
+	stop := Watch(10 * time.Millisecond)
+	defer stop()
+
+	if err := os.WriteFile(path, []byte(`{"sys": {"log_level": "warn"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time moves on file systems with coarse time.
+	future := time.Now().Add(time.Second)
+	_ = os.Chtimes(path, future, future)
+
+	select {
+	case level := <-changed:
+		if level != "warn" {
+			t.Fatalf("level %v after reload", level)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("file change not reloaded")
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	defer Set(Default())
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"test.yaml": "tcp:\n  addr: 127.0.0.1:9001\n  time_out: 7s\n  ping_interval: 20s\n  limit:\n    ban_time: 5m\n",
+		"test.toml": "[tcp]\naddr = \"127.0.0.1:9002\"\ntime_out = \"7s\"\nping_interval = \"20s\"\n[tcp.limit]\nban_time = \"5m\"\n",
+		"test.json": `{"tcp": {"addr": "127.0.0.1:9003", "time_out": "7s", "ping_interval": "20s", "limit": {"ban_time": 300000000000}}}`,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Load(path); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if GetTCP().TimeOut != 7*time.Second || !strings.HasPrefix(GetTCP().Addr, "127.0.0.1:900") {
+			t.Fatalf("%s not loaded: %+v", name, GetTCP())
+		}
+		if GetTCP().PingInterval != 20*time.Second || GetTCP().Limit.BanTime != 5*time.Minute {
+			t.Fatalf("%s durations not loaded: %v %v", name, GetTCP().PingInterval, GetTCP().Limit.BanTime)
+		}
+	}
+
+	if err := LoadBytes([]byte(`{"tcp": {"ping_interval": "soon"}}`)); err == nil {
+		t.Fatal("invalid duration loaded")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	defer Set(Default())
+	defer clear(flagOverrides)
+
+	t.Setenv("NEMO_TCP_ADDR", "127.0.0.1:9100")
+	t.Setenv("NEMO_TCP_TIME_OUT", "9s")
+	if err := LoadBytes([]byte(`{"tcp": {"addr": "127.0.0.1:9000", "time_out": "5s"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if GetTCP().Addr != "127.0.0.1:9100" || GetTCP().TimeOut != 9*time.Second {
+		t.Fatalf("env not applied: %+v", GetTCP())
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	BindFlags(fs)
+	if err := fs.Parse([]string{"-tcp.addr", "127.0.0.1:9200"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadBytes([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if GetTCP().Addr != "127.0.0.1:9200" || GetTCP().TimeOut != 9*time.Second {
+		t.Fatalf("flag not applied: %+v", GetTCP())
+	}
+
+	t.Setenv("NEMO_TCP_TIME_OUT", "soon")
+	if err := LoadBytes([]byte(`{}`)); err == nil || !strings.Contains(err.Error(), "NEMO_TCP_TIME_OUT") {
+		t.Fatalf("invalid env accepted: %v", err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	defer Set(Default())
+
+	if err := LoadBytes([]byte(`{"wss": {"cert_file": "a.pem", "key_file": "a.key"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "a.pem") || strings.Contains(b.String(), "a.key") ||
+		!strings.Contains(b.String(), redacted) {
+		t.Fatalf("secret not redacted:\n%s", b.String())
+	}
+	if GetWSS().CertFile != "a.pem" {
+		t.Fatal("dump changed the config")
+	}
+}
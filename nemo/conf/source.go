@@ -0,0 +1,299 @@
+package conf
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// -------------------------------------------------------------------------------------
+// Config sources, from the lowest precedence to the highest:
+//
+//	default values < config file < environment variables < command line flags
+//
+// The file is json, yaml or toml by its extension, all of them use the json keys.
+// A field is overridden by the environment variable NEMO_<SECTION>_<KEY>, such as
+// NEMO_TCP_ADDR, or by the flag -<section>.<key>, such as -tcp.addr, once BindFlags is
+// called. The config file path is taken from the flag -conf, NEMO_CONF, or
+// conf/<process>.{json,yaml,yml,toml} beside the executable.
+
+const (
+	EnvPrefix = "NEMO_"
+	EnvConf   = "NEMO_CONF"
+)
+
+var (
+	flagPath      string
+	flagOverrides = make(map[string]string)
+)
+
+// decode data of format ("json", "yaml" or "toml") over c.
+func decode(data []byte, format string, c *Config) error {
+	var m map[string]any
+	var err error
+	switch format {
+	case "json", "":
+		err = json.Unmarshal(data, &m)
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, &m)
+	case "toml":
+		err = toml.Unmarshal(data, &m)
+	default:
+		return fmt.Errorf("unknown config format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	return remarshal(m, c)
+}
+
+// remarshal decode m by json so every format uses the json keys. A duration is "3s"
+// or nanoseconds, as in the overrides.
+func remarshal(m map[string]any, c *Config) error {
+	if err := parseDurations(m, reflect.TypeOf(*c), ""); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, c)
+}
+
+// parseDurations replace the duration strings of m, the values of the struct t, by
+// their nanoseconds. path is the key of m for the errors.
+func parseDurations(m map[string]any, t reflect.Type, path string) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := jsonKey(f)
+		v, ok := m[key]
+		if !ok {
+			continue
+		}
+		if path != "" {
+			key = path + "." + key
+		}
+		switch {
+		case f.Type == reflect.TypeOf(time.Duration(0)):
+			if s, ok := v.(string); ok {
+				d, err := time.ParseDuration(s)
+				if err != nil {
+					return fmt.Errorf("%s: invalid duration %q", key, s)
+				}
+				m[jsonKey(f)] = int64(d)
+			}
+		case f.Type.Kind() == reflect.Struct:
+			if sub, ok := v.(map[string]any); ok {
+				if err := parseDurations(sub, f.Type, key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func formatOf(path string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+}
+
+// FindPath get the config file path by the precedence of the sources, empty if there
+// is no file.
+func FindPath() string {
+	if flagPath != "" {
+		return flagPath
+	}
+	if path := os.Getenv(EnvConf); path != "" {
+		return path
+	}
+	base := strings.TrimSuffix(DefaultPath(), ".json")
+	for _, ext := range []string{".json", ".yaml", ".yml", ".toml"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return ""
+}
+
+// LoadDefault load the file of FindPath, or only the defaults and overrides if there
+// is none. Call it after the flags bound by BindFlags are parsed, the config is the
+// default one until a process loads it.
+func LoadDefault() error {
+	if path := FindPath(); path != "" {
+		return Load(path)
+	}
+	return Set(Default())
+}
+
+//-------------------------------------------------------------------------------------
+// overrides.
+
+// field is a config field reached by reflection.
+type field struct {
+	section string // json key of the section.
+	key     string // json key of the field.
+	value   reflect.Value
+	secret  bool
+}
+
+func (f field) env() string {
+	return EnvPrefix + strings.ToUpper(f.section+"_"+f.key)
+}
+
+func (f field) flag() string {
+	return f.section + "." + f.key
+}
+
+// fields of c, c must be addressable to set them.
+func fields(c *Config) []field {
+	var ret []field
+	cv := reflect.ValueOf(c).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		section := jsonKey(cv.Type().Field(i))
+		sv := cv.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			sf := sv.Type().Field(j)
+			ret = append(ret, field{
+				section: section,
+				key:     jsonKey(sf),
+				value:   sv.Field(j),
+				secret:  sf.Tag.Get("conf") == "secret",
+			})
+		}
+	}
+	return ret
+}
+
+func jsonKey(f reflect.StructField) string {
+	if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// applyOverrides set the fields of c from the environment, then from the flags.
+func applyOverrides(c *Config) error {
+	for _, f := range fields(c) {
+		if s, ok := os.LookupEnv(f.env()); ok {
+			if err := setField(f.value, s); err != nil {
+				return fmt.Errorf("%s: %w", f.env(), err)
+			}
+		}
+		if s, ok := flagOverrides[f.flag()]; ok {
+			if err := setField(f.value, s); err != nil {
+				return fmt.Errorf("-%s: %w", f.flag(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func setField(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		// "3s" or nanoseconds like the json value.
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q", s)
+			}
+			d = time.Duration(n)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		// comma separated strings.
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// overrideFlag records the value of a bound flag.
+type overrideFlag string
+
+func (f overrideFlag) String() string {
+	return flagOverrides[string(f)]
+}
+
+func (f overrideFlag) Set(s string) error {
+	flagOverrides[string(f)] = s
+	return nil
+}
+
+// BindFlags add -conf and a flag of every field to fs, flag.CommandLine if it is nil.
+// The flags are applied by the next load after fs is parsed.
+func BindFlags(fs *flag.FlagSet) {
+	if fs == nil {
+		fs = flag.CommandLine
+	}
+	fs.StringVar(&flagPath, "conf", "", "config file (json, yaml or toml)")
+
+	def := Default()
+	for _, f := range fields(&def) {
+		fs.Var(overrideFlag(f.flag()), f.flag(), fmt.Sprintf("%s (env %s, default %v)", f.flag(), f.env(), f.value.Interface()))
+	}
+}
+
+//-------------------------------------------------------------------------------------
+// dump.
+
+const redacted = "<redacted>"
+
+// Dump write the effective config as indented json, the secret fields are redacted.
+func Dump(w io.Writer) error {
+	c := *current()
+
+	for _, f := range fields(&c) {
+		if f.secret && f.value.Kind() == reflect.String && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(c)
+}
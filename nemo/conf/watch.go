@@ -0,0 +1,74 @@
+package conf
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// Watch reload the file given to Load when its modification time changes, it is
+// checked every interval. A file which fails to load is logged and the current config
+// is kept. Call stop to end watching.
+func Watch(interval time.Duration) (stop func()) {
+	var last time.Time
+	if fi, err := os.Stat(Path()); err == nil {
+		last = fi.ModTime()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				fi, err := os.Stat(Path())
+				if err != nil || fi.ModTime().Equal(last) {
+					continue
+				}
+				last = fi.ModTime()
+				reload("file changed")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// WatchSignal reload the file given to Load on SIGHUP. Call stop to end watching.
+func WatchSignal() (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				reload("SIGHUP")
+			case <-done:
+				signal.Stop(c)
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Path of the file given to Load, empty if none.
+func Path() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return loadPath
+}
+
+func reload(reason string) {
+	if err := Reload(); err != nil {
+		log.With("reason", reason).Errorf("reload config: %v", err)
+		return
+	}
+	log.With("reason", reason, "path", Path()).Info("config reloaded")
+}
@@ -1,6 +1,8 @@
 package nemo
 
 import (
+	"context"
+
 	"github.com/lircstar/nemo/nemo/network"
 	"github.com/lircstar/nemo/nemo/server"
 )
@@ -18,30 +20,42 @@ func StartWSServer() {
 	server.Start()
 }
 
+// CreateUDPServer start a udp server beside the default one, it shares the default
+// processor.
 func CreateUDPServer() server.Server {
-	udp := server.New(new(server.UdpServerWrapper))
+	udp := NewUDPServer()
+	udp.RegisterProcessor(server.GetProcessor())
 	udp.Start()
 	return udp
 }
 
+// NewTCPServer create a tcp server instance with its own processor and callbacks.
+func NewTCPServer() *server.Instance {
+	return server.NewInstance(new(server.TcpServerWrapper))
+}
+
+// NewWSServer create a websocket server instance with its own processor and callbacks.
+func NewWSServer() *server.Instance {
+	return server.NewInstance(new(server.WsServerWrapper))
+}
+
+// NewUDPServer create a udp server instance with its own processor and callbacks.
+func NewUDPServer() *server.Instance {
+	return server.NewInstance(new(server.UdpServerWrapper))
+}
+
 func Stop() {
 	server.Stop()
 }
 
+// Shutdown drain the default server gracefully, it returns when all agents are closed.
+func Shutdown(ctx context.Context) error {
+	return server.Shutdown(ctx)
+}
+
 //-------------------------------------------------------------------------------------
 // Client
 
 func Connect(addr string, style uint) network.Client {
-	var ret network.Client
-	if style == network.TYPE_CLIENT_TCP {
-		client := new(server.TcpClientWrapper)
-		ret = client.Connect(addr)
-	} else if style == network.TYPE_CLIENT_WEBSOCKET {
-		client := new(server.WsClientWrapper)
-		ret = client.Connect(addr)
-	} else if style == network.TYPE_CLIENT_UDP {
-		client := new(server.UdpClientWrapper)
-		ret = client.Connect(addr)
-	}
-	return ret
+	return server.DefaultInstance().Connect(addr, style)
 }
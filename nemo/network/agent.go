@@ -1,6 +1,9 @@
 package network
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 const (
 	TYPE_AGENT_TCP       = 1
@@ -19,11 +22,26 @@ type Agent interface {
 
 	OnConnect()
 	Run(data []byte)
+	OnDraining()
+	// OnBackpressure is called when the backpressure policy of the conn acts.
+	OnBackpressure()
+	// OnTimeout is called when the agent is closed for its peer being silent.
+	OnTimeout()
 	OnClose()
 
 	SendMessage(msg any) bool
+	// SendMessageOn send msg on the channel ch of a conn with channels.
+	SendMessageOn(ch Channel, msg any) bool
 	SendRawMessage(id uint16, msg []byte) bool
 
+	// Call send an rpc request and wait for the response.
+	Call(ctx context.Context, req any) (any, error)
+	// Reply answer the rpc request being routed.
+	Reply(resp any) bool
+
+	// RTT get the round trip times measured by the heartbeat.
+	RTT() RTTStats
+
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 
@@ -33,6 +51,11 @@ type Agent interface {
 	SetConnectionId(id uint64)
 	ConnectionId() uint64
 
+	// Authenticate mark the agent as logged in as identity.
+	Authenticate(identity any)
+	IsAuthenticated() bool
+	Identity() any
+
 	SetUserData(data any)
 	UserData() any
 }
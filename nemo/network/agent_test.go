@@ -0,0 +1,75 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// testAgent collects the messages read from its conn, or writes them back if echo is
+// set. A udp agent is run by each datagram instead. The methods not used by the
+// transports panic.
+type testAgent struct {
+	Agent
+	conn   Conn
+	echo   bool
+	msgs   chan []byte
+	closed chan struct{}
+
+	backpressure func()
+}
+
+func newTestAgent(conn Conn, echo bool) *testAgent {
+	return &testAgent{
+		conn:   conn,
+		echo:   echo,
+		msgs:   make(chan []byte, 64),
+		closed: make(chan struct{}),
+	}
+}
+
+func (a *testAgent) SetType(uint) {}
+func (a *testAgent) OnConnect()   {}
+func (a *testAgent) OnDraining()  {}
+func (a *testAgent) OnBackpressure() {
+	if a.backpressure != nil {
+		a.backpressure()
+	}
+}
+func (a *testAgent) OnClose() { close(a.closed) }
+
+func (a *testAgent) GetConn() Conn { return a.conn }
+func (a *testAgent) Close()        { a.conn.Close() }
+
+func (a *testAgent) Run(data []byte) {
+	if data != nil {
+		a.handle(data)
+		return
+	}
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.handle(data)
+	}
+}
+
+func (a *testAgent) handle(data []byte) {
+	if a.echo {
+		_ = a.conn.WriteMsg(data)
+		return
+	}
+	a.msgs <- append([]byte(nil), data...)
+}
+
+// recv wait for the next message of a.
+func (a *testAgent) recv(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case data := <-a.msgs:
+		return data
+	case <-time.After(3 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
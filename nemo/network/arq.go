@@ -0,0 +1,614 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------------------------------------
+// Reliable UDP.
+//
+// The ARQ layer makes the messages of a reliable channel of a UDP conn reliable, and
+// ordered or not, in the way of KCP. A message is split into segments fitting the MTU,
+// and every segment carries a header:
+//
+//	| cmd | frg | wnd | ts | sn | una | len | data |
+//	   1     1     2    4    4    4     2
+//
+// cmd is arqPush for data, or arqAck for the ack of the segment sn. frg counts the
+// segments of the message after this one, wnd is the free receive window of the sender,
+// ts the send time echoed by the ack for the rtt, and una the next sn the sender waits
+// for, so it acks every segment before it.
+//
+// A segment is sent again when its rto passes, or at once when arqFastResend segments
+// after it are acked. The segments in flight are limited by the send window, the
+// receive window of the peer and the congestion window. Several segments of a channel
+// share a datagram, sealed as a whole by the encrypted session if there is one.
+//
+// The segments of an unordered channel are read once their message is complete. The
+// segments before rcvNxt are read, so rcvNxt starts a message, and so does a segment
+// after one with frg 0.
+
+const (
+	arqPush = 1
+	arqAck  = 2
+
+	arqHeaderLen = 18
+
+	// arqFastResend is the count of acks of later segments sending a segment again.
+	arqFastResend = 2
+	// arqDeadLink is the count of sends of a segment before the peer is given up.
+	arqDeadLink = 20
+	// arqMaxFragments is the most segments of a message.
+	arqMaxFragments = 255
+
+	// rto bounds in ms.
+	arqInitRTO = 200
+	arqMinRTO  = 30
+	arqMaxRTO  = 60000
+	// arqTick is the clock granularity in ms the rto keeps above the smoothed rtt.
+	arqTick = 10
+)
+
+var (
+	errARQSegment = errors.New("reliable udp: bad segment")
+	errARQDead    = errors.New("reliable udp: peer lost")
+	errARQClosed  = errors.New("connection is closed")
+)
+
+// arqEpoch is the origin of the ms clock of the segments.
+var arqEpoch = time.Now()
+
+func arqNow() uint32 {
+	return uint32(time.Since(arqEpoch) / time.Millisecond)
+}
+
+// before tell whether the sn or ts a comes before b, with wrapping.
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// ARQConfig enables the channels of a UDP server or client, see channel.go, both ends
+// need it.
+type ARQConfig struct {
+	// MTU is the max size of a datagram, 1400 if it is 0.
+	MTU int
+	// Window is the count of segments in flight, and of segments the peer may send
+	// ahead of the ones read, 128 if it is 0.
+	Window int
+	// NoCongestion drops the congestion window, for low latency on known links.
+	NoCongestion bool
+}
+
+func (c *ARQConfig) mtu() int {
+	if c.MTU <= 0 {
+		return 1400
+	}
+	return c.MTU
+}
+
+func (c *ARQConfig) window() int {
+	if c.Window <= 0 {
+		return 128
+	}
+	return min(c.Window, 0xffff)
+}
+
+type arqSegment struct {
+	sn   uint32
+	frg  byte
+	data []byte // from the buffer pool.
+	read bool   // of an unordered channel, data is given to rcvMsgs.
+
+	resendAt uint32
+	rto      uint32
+	xmit     int // count of sends.
+	fastack  int // count of acks of later segments.
+}
+
+type arqAckItem struct {
+	sn uint32
+	ts uint32
+}
+
+// arq is the reliable layer of a channel, goroutine safe. Its goroutine sends the
+// datagrams by output, and calls dead once if the peer is lost.
+type arq struct {
+	mu        sync.Mutex
+	ch        Channel
+	unordered bool
+	size      int // of a datagram before sealing.
+	mss       int
+	window    int
+	nocwnd    bool
+	output    func([]byte)
+	dead      func()
+
+	sndUna uint32
+	sndNxt uint32
+	rcvNxt uint32
+
+	sndQueue []*arqSegment // waiting for the window.
+	sndBuf   []*arqSegment // in flight, by sn.
+	rcvBuf   []*arqSegment // received out of order, by sn.
+	rcvQueue []*arqSegment // received in order, not read yet.
+	rcvMsgs  [][]byte      // complete messages of an unordered channel, not read yet.
+	acks     []arqAckItem
+
+	rmtWnd   int
+	cwnd     int
+	ssthresh int
+	incr     int
+
+	srtt   int32
+	rttvar int32
+	rto    uint32
+
+	buf    []byte
+	lost   bool
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// newARQ start the reliable layer of the channel ch, overhead is the bytes sealing adds
+// to a datagram.
+func newARQ(config *ARQConfig, ch Channel, overhead int, output func([]byte), dead func()) *arq {
+	a := &arq{
+		ch:        ch,
+		unordered: ch.Delivery() == ReliableUnordered,
+		size:      config.mtu() - overhead,
+		window:    config.window(),
+		nocwnd:    config.NoCongestion,
+		output:    output,
+		dead:      dead,
+		cwnd:      4,
+		ssthresh:  config.window(),
+		rto:       arqInitRTO,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	a.mss = a.size - 1 - arqHeaderLen
+	a.rmtWnd = a.window
+	a.buf = make([]byte, 1, a.size)
+	a.buf[0] = byte(ch)
+	go a.run()
+	return a
+}
+
+func (a *arq) signal() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run flush the segments on every change and when an rto passes.
+func (a *arq) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		next, lost := a.flush(arqNow())
+		if lost {
+			a.dead()
+			return
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next >= 0 {
+			timer.Reset(time.Duration(next) * time.Millisecond)
+		}
+		select {
+		case <-a.wake:
+		case <-timer.C:
+		case <-a.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// send queue the message of args, they are copied.
+func (a *arq) send(args ...[]byte) error {
+	var total int
+	for _, arg := range args {
+		total += len(arg)
+	}
+	count := max((total+a.mss-1)/a.mss, 1)
+	if count > arqMaxFragments || count >= a.window {
+		return errors.New("message too long")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errARQClosed
+	}
+	if len(a.sndQueue)+count > 16*a.window {
+		return errors.New("reliable udp: send queue full")
+	}
+
+	var i, off int
+	for k := 0; k < count; k++ {
+		seg := &arqSegment{frg: byte(count - 1 - k), data: allocBuffer(min(a.mss, total-k*a.mss))}
+		for n := 0; n < len(seg.data); {
+			c := copy(seg.data[n:], args[i][off:])
+			n += c
+			if off += c; off == len(args[i]) {
+				i, off = i+1, 0
+			}
+		}
+		a.sndQueue = append(a.sndQueue, seg)
+	}
+	a.signal()
+	return nil
+}
+
+// recv get the next message received in order, nil if it is not complete yet. It is
+// owned by the caller, see ReleaseMsg.
+func (a *arq) recv() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.unordered && len(a.rcvMsgs) > 0 {
+		msg := a.rcvMsgs[0]
+		n := copy(a.rcvMsgs, a.rcvMsgs[1:])
+		a.rcvMsgs[n] = nil
+		a.rcvMsgs = a.rcvMsgs[:n]
+		a.moveReady()
+		return msg, nil
+	}
+	if len(a.rcvQueue) == 0 {
+		if a.lost {
+			return nil, errARQDead
+		}
+		if a.closed {
+			return nil, errARQClosed
+		}
+		return nil, nil
+	}
+	count := int(a.rcvQueue[0].frg) + 1
+	if len(a.rcvQueue) < count {
+		return nil, nil
+	}
+	msg := joinSegments(a.rcvQueue[:count])
+	a.rcvQueue = shiftSegments(a.rcvQueue, count)
+	a.moveReady()
+	return msg, nil
+}
+
+// joinSegments get the message of segs from the buffer pool, and release their data.
+func joinSegments(segs []*arqSegment) []byte {
+	var size int
+	for _, seg := range segs {
+		size += len(seg.data)
+	}
+	msg := allocBuffer(size)
+	n := 0
+	for _, seg := range segs {
+		n += copy(msg[n:], seg.data)
+		freeBuffer(seg.data)
+		seg.data = nil
+	}
+	return msg
+}
+
+// input handle a datagram of the peer, data is not kept.
+func (a *arq) input(data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+
+	now := arqNow()
+	una := a.sndUna
+	var maxAck uint32
+	acked := false
+	for len(data) >= arqHeaderLen {
+		cmd, frg := data[0], data[1]
+		wnd := binary.BigEndian.Uint16(data[2:])
+		ts := binary.BigEndian.Uint32(data[4:])
+		sn := binary.BigEndian.Uint32(data[8:])
+		segUna := binary.BigEndian.Uint32(data[12:])
+		n := int(binary.BigEndian.Uint16(data[16:]))
+		data = data[arqHeaderLen:]
+		if len(data) < n {
+			return errARQSegment
+		}
+
+		a.rmtWnd = int(wnd)
+		a.ackUntil(segUna)
+		switch cmd {
+		case arqAck:
+			if !before(now, ts) {
+				a.updateRTT(int32(now - ts))
+			}
+			a.ackSegment(sn)
+			if !acked || before(maxAck, sn) {
+				maxAck, acked = sn, true
+			}
+		case arqPush:
+			if before(sn, a.rcvNxt+uint32(a.window)) {
+				a.acks = append(a.acks, arqAckItem{sn: sn, ts: ts})
+				if !before(sn, a.rcvNxt) {
+					a.insert(sn, frg, data[:n])
+				}
+			}
+		default:
+			return errARQSegment
+		}
+		data = data[n:]
+	}
+
+	if acked {
+		for _, seg := range a.sndBuf {
+			if before(seg.sn, maxAck) {
+				seg.fastack++
+			}
+		}
+	}
+	// the congestion window grows by a segment for each one acked in slow start, and
+	// by a segment for each window acked after.
+	if n := int(a.sndUna - una); n > 0 && !a.nocwnd && a.cwnd < a.rmtWnd {
+		if a.cwnd < a.ssthresh {
+			a.cwnd = min(a.cwnd+n, a.ssthresh)
+		} else if a.incr += n; a.incr >= a.cwnd {
+			a.incr -= a.cwnd
+			a.cwnd++
+		}
+	}
+	a.moveReady()
+	a.signal()
+	return nil
+}
+
+// ackUntil remove the segments in flight before una.
+func (a *arq) ackUntil(una uint32) {
+	n := 0
+	for n < len(a.sndBuf) && before(a.sndBuf[n].sn, una) {
+		freeBuffer(a.sndBuf[n].data)
+		n++
+	}
+	a.sndBuf = shiftSegments(a.sndBuf, n)
+	a.updateUna()
+}
+
+// ackSegment remove the segment sn in flight.
+func (a *arq) ackSegment(sn uint32) {
+	for i, seg := range a.sndBuf {
+		if seg.sn == sn {
+			freeBuffer(seg.data)
+			copy(a.sndBuf[i:], a.sndBuf[i+1:])
+			a.sndBuf[len(a.sndBuf)-1] = nil
+			a.sndBuf = a.sndBuf[:len(a.sndBuf)-1]
+			break
+		}
+		if before(sn, seg.sn) {
+			break
+		}
+	}
+	a.updateUna()
+}
+
+func (a *arq) updateUna() {
+	if len(a.sndBuf) > 0 {
+		a.sndUna = a.sndBuf[0].sn
+	} else {
+		a.sndUna = a.sndNxt
+	}
+}
+
+// updateRTT update the rto by a rtt sample in ms, as RFC 6298 does.
+func (a *arq) updateRTT(rtt int32) {
+	if a.srtt == 0 {
+		a.srtt = max(rtt, 1)
+		a.rttvar = rtt / 2
+	} else {
+		delta := rtt - a.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		a.rttvar = (3*a.rttvar + delta) / 4
+		a.srtt = max((7*a.srtt+rtt)/8, 1)
+	}
+	rto := a.srtt + max(arqTick, 4*a.rttvar)
+	a.rto = uint32(min(max(rto, arqMinRTO), arqMaxRTO))
+}
+
+// insert the segment sn received out of order, a copy of data is kept.
+func (a *arq) insert(sn uint32, frg byte, data []byte) {
+	i := len(a.rcvBuf)
+	for i > 0 && !before(a.rcvBuf[i-1].sn, sn) {
+		if a.rcvBuf[i-1].sn == sn {
+			return
+		}
+		i--
+	}
+	seg := &arqSegment{sn: sn, frg: frg, data: allocBuffer(len(data))}
+	copy(seg.data, data)
+	a.rcvBuf = append(a.rcvBuf, nil)
+	copy(a.rcvBuf[i+1:], a.rcvBuf[i:])
+	a.rcvBuf[i] = seg
+}
+
+// moveReady move the segments received in order to the queue read by recv.
+func (a *arq) moveReady() {
+	if a.unordered {
+		a.moveComplete()
+		return
+	}
+	n := 0
+	for n < len(a.rcvBuf) && a.rcvBuf[n].sn == a.rcvNxt && len(a.rcvQueue) < a.window {
+		a.rcvQueue = append(a.rcvQueue, a.rcvBuf[n])
+		a.rcvNxt++
+		n++
+	}
+	a.rcvBuf = shiftSegments(a.rcvBuf, n)
+}
+
+// moveComplete move the complete messages of an unordered channel to rcvMsgs.
+func (a *arq) moveComplete() {
+	for i := 0; i < len(a.rcvBuf) && len(a.rcvMsgs) < a.window; i++ {
+		seg := a.rcvBuf[i]
+		start := seg.sn == a.rcvNxt || i > 0 && a.rcvBuf[i-1].sn == seg.sn-1 && a.rcvBuf[i-1].frg == 0
+		last := i + int(seg.frg)
+		if !start || seg.read || last >= len(a.rcvBuf) || a.rcvBuf[last].sn != seg.sn+uint32(seg.frg) {
+			continue
+		}
+		a.rcvMsgs = append(a.rcvMsgs, joinSegments(a.rcvBuf[i:last+1]))
+		for _, seg := range a.rcvBuf[i : last+1] {
+			seg.read = true
+		}
+		i = last
+	}
+
+	n := 0
+	for n < len(a.rcvBuf) && a.rcvBuf[n].sn == a.rcvNxt && a.rcvBuf[n].read {
+		a.rcvNxt++
+		n++
+	}
+	a.rcvBuf = shiftSegments(a.rcvBuf, n)
+}
+
+// pending get the count of segments or messages received, not read yet.
+func (a *arq) pending() int {
+	return len(a.rcvQueue) + len(a.rcvMsgs)
+}
+
+// flush send the acks, the new segments the windows allow and the ones to send again.
+// next is the ms until the next rto, -1 if there is none, and lost is true if the peer
+// is given up.
+func (a *arq) flush(now uint32) (next int32, lost bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return -1, false
+	}
+	return a.flushLocked(now), a.lost
+}
+
+func (a *arq) flushLocked(now uint32) int32 {
+	wnd := uint16(max(a.window-a.pending(), 0))
+	buf := a.buf[:1]
+	emit := func(cmd, frg byte, ts, sn uint32, data []byte) {
+		if len(buf)+arqHeaderLen+len(data) > a.size {
+			a.output(buf)
+			buf = buf[:1]
+		}
+		buf = append(buf, cmd, frg)
+		buf = binary.BigEndian.AppendUint16(buf, wnd)
+		buf = binary.BigEndian.AppendUint32(buf, ts)
+		buf = binary.BigEndian.AppendUint32(buf, sn)
+		buf = binary.BigEndian.AppendUint32(buf, a.rcvNxt)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+		buf = append(buf, data...)
+	}
+
+	for _, ack := range a.acks {
+		emit(arqAck, 0, ack.ts, ack.sn, nil)
+	}
+	a.acks = a.acks[:0]
+
+	// a peer with no window still gets a segment, so it tells when it has room again.
+	limit := min(a.window, max(a.rmtWnd, 1))
+	if !a.nocwnd {
+		limit = min(limit, a.cwnd)
+	}
+	n := 0
+	for n < len(a.sndQueue) && before(a.sndNxt, a.sndUna+uint32(limit)) {
+		seg := a.sndQueue[n]
+		seg.sn = a.sndNxt
+		a.sndNxt++
+		a.sndBuf = append(a.sndBuf, seg)
+		n++
+	}
+	a.sndQueue = shiftSegments(a.sndQueue, n)
+
+	var next int32 = -1
+	timeout, fast := false, false
+	for _, seg := range a.sndBuf {
+		send := false
+		switch {
+		case seg.xmit == 0:
+			send, seg.rto = true, a.rto
+		case !before(now, seg.resendAt):
+			send, timeout = true, true
+			seg.rto = min(seg.rto+seg.rto/2, arqMaxRTO)
+			metricRetransmits.Inc(transportUDP)
+		case seg.fastack >= arqFastResend:
+			send, fast = true, true
+			seg.fastack = 0
+			metricRetransmits.Inc(transportUDP)
+		}
+		if send {
+			seg.xmit++
+			seg.resendAt = now + seg.rto
+			emit(arqPush, seg.frg, now, seg.sn, seg.data)
+			if seg.xmit >= arqDeadLink {
+				a.lost = true
+			}
+		}
+		if wait := int32(seg.resendAt - now); next < 0 || wait < next {
+			next = max(wait, 0)
+		}
+	}
+	if len(buf) > 1 {
+		a.output(buf)
+	}
+	a.buf = buf[:1]
+
+	if !a.nocwnd {
+		if fast {
+			a.ssthresh = max(int(a.sndNxt-a.sndUna)/2, 2)
+			a.cwnd = a.ssthresh + arqFastResend
+			a.incr = 0
+		}
+		if timeout {
+			a.ssthresh = max(a.cwnd/2, 2)
+			a.cwnd = 1
+			a.incr = 0
+		}
+	}
+	return next
+}
+
+// close stop the layer once the segments waiting are sent a last time, the ones not
+// acked are given up.
+func (a *arq) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	if !a.lost {
+		a.flushLocked(arqNow())
+	}
+	a.closed = true
+	for _, segs := range [][]*arqSegment{a.sndQueue, a.sndBuf, a.rcvBuf, a.rcvQueue} {
+		for _, seg := range segs {
+			freeBuffer(seg.data)
+		}
+	}
+	for _, msg := range a.rcvMsgs {
+		freeBuffer(msg)
+	}
+	a.sndQueue, a.sndBuf, a.rcvBuf, a.rcvQueue, a.rcvMsgs = nil, nil, nil, nil, nil
+	close(a.done)
+}
+
+// shiftSegments remove the first n segments of s.
+func shiftSegments(s []*arqSegment, n int) []*arqSegment {
+	if n == 0 {
+		return s
+	}
+	m := copy(s, s[n:])
+	clear(s[m:])
+	return s[:m]
+}
@@ -0,0 +1,237 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyLink carries the datagrams of an arq to another one in process, it drops,
+// duplicates and delays them at random so they arrive out of order.
+type lossyLink struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	loss     float64
+	dup      float64
+	maxDelay time.Duration
+
+	to     atomic.Pointer[arq]
+	notify chan struct{}
+}
+
+func (l *lossyLink) output(data []byte) {
+	l.mu.Lock()
+	copies := 1
+	if l.rand.Float64() < l.loss {
+		copies = 0
+	} else if l.rand.Float64() < l.dup {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		if l.maxDelay > 0 {
+			delays[i] = time.Duration(l.rand.Int63n(int64(l.maxDelay)))
+		}
+	}
+	l.mu.Unlock()
+
+	pkt := bytes.Clone(data)
+	for _, delay := range delays {
+		time.AfterFunc(delay, func() {
+			// the channel byte is read by udpChannels.
+			_ = l.to.Load().input(pkt[1:])
+			select {
+			case l.notify <- struct{}{}:
+			default:
+			}
+		})
+	}
+}
+
+// newARQPair get two arqs of ch linked both ways by lossy links.
+func newARQPair(t *testing.T, config *ARQConfig, ch Channel, loss, dup float64, maxDelay time.Duration) (a, b *arq, recv func() []byte) {
+	ab := &lossyLink{rand: rand.New(rand.NewSource(1)), loss: loss, dup: dup, maxDelay: maxDelay, notify: make(chan struct{}, 1)}
+	ba := &lossyLink{rand: rand.New(rand.NewSource(2)), loss: loss, dup: dup, maxDelay: maxDelay, notify: make(chan struct{}, 1)}
+	a = newARQ(config, ch, 0, ab.output, func() { t.Error("a lost its peer") })
+	b = newARQ(config, ch, 0, ba.output, func() { t.Error("b lost its peer") })
+	ab.to.Store(b)
+	ba.to.Store(a)
+	t.Cleanup(a.close)
+	t.Cleanup(b.close)
+
+	// recv wait for the next message of b.
+	recv = func() []byte {
+		timeout := time.After(10 * time.Second)
+		for {
+			msg, err := b.recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != nil {
+				return msg
+			}
+			select {
+			case <-ab.notify:
+			case <-timeout:
+				t.Fatal("message not received")
+			}
+		}
+	}
+	return a, b, recv
+}
+
+// testMessage get the message i, up to 5 segments of an mtu of 512.
+func testMessage(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%04d", i)), 1+i*37%600)
+}
+
+func TestARQ(t *testing.T) {
+	cases := []struct {
+		name      string
+		loss, dup float64
+		delay     time.Duration
+		config    ARQConfig
+		ch        Channel
+	}{
+		{"clean", 0, 0, 0, ARQConfig{MTU: 512}, ChannelReliableOrdered},
+		{"lossy", 0.05, 0.05, 10 * time.Millisecond, ARQConfig{MTU: 512}, ChannelReliableOrdered},
+		{"lossy-nocwnd", 0.3, 0.05, 20 * time.Millisecond, ARQConfig{MTU: 512, NoCongestion: true}, ChannelReliableOrdered},
+		{"small-window", 0.05, 0, 10 * time.Millisecond, ARQConfig{MTU: 512, Window: 8}, ChannelReliableOrdered},
+		{"unordered", 0.3, 0.05, 20 * time.Millisecond, ARQConfig{MTU: 512, NoCongestion: true}, ChannelReliableUnordered},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, _, recv := newARQPair(t, &c.config, c.ch, c.loss, c.dup, c.delay)
+			const count = 200
+			go func() {
+				for i := 0; i < count; i++ {
+					// a message split over args crosses the segments.
+					msg := testMessage(i)
+					for a.send(msg[:len(msg)/3], msg[len(msg)/3:]) != nil {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}()
+			if c.ch == ChannelReliableUnordered {
+				got := make(map[string]bool)
+				for i := 0; i < count; i++ {
+					got[string(recv())] = true
+				}
+				for i := 0; i < count; i++ {
+					if !got[string(testMessage(i))] {
+						t.Fatalf("message %d not received", i)
+					}
+				}
+				return
+			}
+			for i := 0; i < count; i++ {
+				if got := recv(); !bytes.Equal(got, testMessage(i)) {
+					t.Fatalf("message %d: got %d bytes %.8q", i, len(got), got)
+				}
+			}
+		})
+	}
+}
+
+func TestARQTooLong(t *testing.T) {
+	a, _, _ := newARQPair(t, &ARQConfig{MTU: 512, Window: 4}, ChannelReliableOrdered, 0, 0, 0)
+	if err := a.send(make([]byte, 3*a.mss)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.send(make([]byte, 4*a.mss)); err == nil {
+		t.Fatal("message over the window sent")
+	}
+}
+
+func TestARQDeadLink(t *testing.T) {
+	dead := make(chan struct{})
+	a := newARQ(&ARQConfig{}, ChannelReliableOrdered, 0, func([]byte) {}, func() { close(dead) })
+	defer a.close()
+	if err := a.send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the segment is sent again at every rto, with no ack.
+	now := arqNow()
+	for i := 0; i < arqDeadLink; i++ {
+		if _, lost := a.flush(now); lost {
+			break
+		}
+		a.mu.Lock()
+		now = a.sndBuf[0].resendAt
+		a.mu.Unlock()
+	}
+	a.signal()
+	select {
+	case <-dead:
+	case <-time.After(3 * time.Second):
+		t.Fatal("peer not lost")
+	}
+	if _, err := a.recv(); err != errARQDead {
+		t.Fatalf("recv %v", err)
+	}
+}
+
+func TestReliableUDP(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		t.Run(fmt.Sprintf("secure=%v", secure), func(t *testing.T) {
+			var serverConfig, clientConfig *SecureConfig
+			if secure {
+				serverConfig, clientConfig = newTestSecure(t)
+			}
+			reliable := &ARQConfig{MTU: 512}
+			addr := freeUDPAddr(t)
+			server := &UDPServer{
+				MaxConnNum: 10,
+				MinMsgLen:  1,
+				MaxMsgLen:  4096,
+				Secure:     serverConfig,
+				Reliable:   reliable,
+				NewAgent: func(conn Conn) Agent {
+					return newTestAgent(conn, true)
+				},
+			}
+			server.Start(addr)
+			defer server.Close()
+
+			agents := make(chan *testAgent, 1)
+			client := &UDPClient{
+				Addr:      addr,
+				MinMsgLen: 1,
+				MaxMsgLen: 4096,
+				TimeOut:   60,
+				Secure:    clientConfig,
+				Reliable:  reliable,
+				NewAgent: func(conn Conn) Agent {
+					a := newTestAgent(conn, false)
+					agents <- a
+					return a
+				},
+			}
+			client.Start()
+			defer client.Close()
+
+			var a *testAgent
+			select {
+			case a = <-agents:
+			case <-time.After(3 * time.Second):
+				t.Fatal("client not connected")
+			}
+			const count = 50
+			for i := 0; i < count; i++ {
+				if err := a.conn.WriteMsg(testMessage(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < count; i++ {
+				if got := a.recv(t); !bytes.Equal(got, testMessage(i)) {
+					t.Fatalf("echo %d: got %d bytes", i, len(got))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------------------------------------
+// Backpressure.
+//
+// The messages of a conn wait for its writer in a queue limited to PendingWriteNum
+// messages and Backpressure.MaxPendingBytes bytes. A message over the limits is handled
+// by the policy, and the agent is told by OnBackpressure whenever the policy acts.
+
+type BackpressurePolicy int
+
+const (
+	// BackpressureDisconnect close the conn, the default.
+	BackpressureDisconnect BackpressurePolicy = iota
+	// BackpressureBlock wait for room up to BlockTimeout, then close the conn. The
+	// sender is blocked meanwhile.
+	BackpressureBlock
+	// BackpressureDropNewest drop the message sent.
+	BackpressureDropNewest
+	// BackpressureDropOldest drop the oldest messages queued to make room.
+	BackpressureDropOldest
+	// BackpressurePriority drop the oldest messages queued of the lowest priority class
+	// below the one of the message sent to make room, or the message sent if there are
+	// none.
+	BackpressurePriority
+)
+
+var backpressureNames = []string{"disconnect", "block", "drop_newest", "drop_oldest", "priority"}
+
+func (p BackpressurePolicy) String() string {
+	if p >= 0 && int(p) < len(backpressureNames) {
+		return backpressureNames[p]
+	}
+	return fmt.Sprintf("BackpressurePolicy(%d)", int(p))
+}
+
+// ParseBackpressurePolicy get the policy of name, "disconnect" for an empty one.
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	if name == "" {
+		return BackpressureDisconnect, nil
+	}
+	for i, n := range backpressureNames {
+		if n == name {
+			return BackpressurePolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backpressure policy %q", name)
+}
+
+// Backpressure is what a conn does with the messages over its write queue limits.
+type Backpressure struct {
+	Policy BackpressurePolicy
+	// BlockTimeout bounds the wait of BackpressureBlock.
+	BlockTimeout time.Duration
+	// MaxPendingBytes limits the bytes queued, 0 for no limit. A message larger than
+	// the limit is still queued if the queue is empty.
+	MaxPendingBytes int
+}
+
+// priority classes of the messages for BackpressurePriority, any int works.
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// PriorityWriter is a Conn writing messages of a priority class.
+type PriorityWriter interface {
+	WriteMsgPriority(prio int, args ...[]byte) error
+}
+
+//-------------------------------------------------------------------------------------
+// write queue.
+
+// pushResult tell what happened to a message pushed.
+type pushResult int
+
+const (
+	pushQueued   pushResult = iota
+	pushDropped             // a message was dropped to keep the limits.
+	pushOverflow            // the conn must be closed.
+)
+
+// writeQueue is the queue of the frames waiting for the writer of a conn.
+type writeQueue struct {
+	mu      sync.Mutex
+	frames  []frame
+	bytes   int
+	maxNum  int
+	closing bool // the conn closes once the frames queued are written.
+	closed  bool // the conn is destroyed, the frames queued are given up.
+
+	wake chan struct{} // signals the writer.
+	room chan struct{} // closed when the frames are taken, made by a blocked sender.
+}
+
+func (q *writeQueue) init(maxNum int) {
+	q.maxNum = maxNum
+	q.wake = make(chan struct{}, 1)
+}
+
+// reset the queue for a new conn.
+func (q *writeQueue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release()
+	q.closing = false
+	q.closed = false
+	select {
+	case <-q.wake:
+	default:
+	}
+}
+
+func (q *writeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
+
+func (q *writeQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// full tell whether size more bytes are over the limits, call it locked.
+func (q *writeQueue) full(size int, bp *Backpressure) bool {
+	if len(q.frames) == 0 {
+		return false
+	}
+	if len(q.frames) >= q.maxNum {
+		return true
+	}
+	return bp != nil && bp.MaxPendingBytes > 0 && q.bytes+size > bp.MaxPendingBytes
+}
+
+// push f by bp, the policy of a nil bp is BackpressureDisconnect. f is released if it
+// is not queued.
+func (q *writeQueue) push(f frame, bp *Backpressure) pushResult {
+	size := f.size()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closing || q.closed {
+		f.release()
+		return pushQueued
+	}
+
+	result := pushQueued
+	if q.full(size, bp) {
+		policy := BackpressureDisconnect
+		if bp != nil {
+			policy = bp.Policy
+		}
+		switch policy {
+		case BackpressureBlock:
+			if !q.block(size, bp) {
+				f.release()
+				return pushOverflow
+			}
+			if q.closed {
+				f.release()
+				return pushQueued
+			}
+		case BackpressureDropNewest:
+			f.release()
+			return pushDropped
+		case BackpressureDropOldest:
+			for q.full(size, bp) {
+				q.remove(0)
+			}
+			result = pushDropped
+		case BackpressurePriority:
+			for q.full(size, bp) {
+				i := q.lower(f.prio)
+				if i < 0 {
+					f.release()
+					return pushDropped
+				}
+				q.remove(i)
+			}
+			result = pushDropped
+		default:
+			f.release()
+			return pushOverflow
+		}
+	}
+
+	q.frames = append(q.frames, f)
+	q.bytes += size
+	q.signal()
+	return result
+}
+
+// block wait locked until there is room for size more bytes or the conn is destroyed,
+// false if BlockTimeout passes before.
+func (q *writeQueue) block(size int, bp *Backpressure) bool {
+	timer := time.NewTimer(bp.BlockTimeout)
+	defer timer.Stop()
+	for q.full(size, bp) && !q.closed {
+		if q.room == nil {
+			q.room = make(chan struct{})
+		}
+		room := q.room
+		q.mu.Unlock()
+		select {
+		case <-room:
+			q.mu.Lock()
+		case <-timer.C:
+			q.mu.Lock()
+			return !q.full(size, bp) || q.closed
+		}
+	}
+	return true
+}
+
+// lower get the index of the oldest frame of the lowest class below prio, -1 if none.
+func (q *writeQueue) lower(prio int) int {
+	index := -1
+	for i, f := range q.frames {
+		if f.prio < prio {
+			index, prio = i, f.prio
+		}
+	}
+	return index
+}
+
+// remove the frame i and release it.
+func (q *writeQueue) remove(i int) {
+	f := q.frames[i]
+	q.bytes -= f.size()
+	copy(q.frames[i:], q.frames[i+1:])
+	q.frames[len(q.frames)-1] = frame{}
+	q.frames = q.frames[:len(q.frames)-1]
+	f.release()
+}
+
+// wait until there is a frame to take or the conn closes.
+func (q *writeQueue) wait() {
+	for {
+		q.mu.Lock()
+		ready := len(q.frames) > 0 || q.closing || q.closed
+		q.mu.Unlock()
+		if ready {
+			return
+		}
+		<-q.wake
+	}
+}
+
+// take the frames queued, dst is the slice of the previous take given back. done is
+// true if the writer must stop after writing them.
+func (q *writeQueue) take(dst []frame) (frames []frame, done bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	frames, q.frames = q.frames, dst[:0]
+	q.bytes = 0
+	if q.room != nil {
+		close(q.room)
+		q.room = nil
+	}
+	if q.closed {
+		for i := range frames {
+			frames[i].release()
+		}
+		return frames[:0], true
+	}
+	return frames, q.closing
+}
+
+// close the conn once the frames queued are written.
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	q.closing = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// destroy give up the frames queued and stop the writer and the blocked senders.
+func (q *writeQueue) destroy() {
+	q.mu.Lock()
+	q.closed = true
+	q.release()
+	if q.room != nil {
+		close(q.room)
+		q.room = nil
+	}
+	q.mu.Unlock()
+	q.signal()
+}
+
+// release the frames queued, call it locked.
+func (q *writeQueue) release() {
+	for i := range q.frames {
+		q.frames[i].release()
+	}
+	clear(q.frames)
+	q.frames = q.frames[:0]
+	q.bytes = 0
+}
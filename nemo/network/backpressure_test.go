@@ -0,0 +1,119 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func testFrame(data string, prio int) frame {
+	return frame{head: []byte(data), prio: prio}
+}
+
+// queued get the heads of the frames of q.
+func queued(q *writeQueue) []string {
+	var heads []string
+	for _, f := range q.frames {
+		heads = append(heads, string(f.head))
+	}
+	return heads
+}
+
+func TestBackpressurePolicies(t *testing.T) {
+	cases := []struct {
+		policy BackpressurePolicy
+		pushes []frame
+		result pushResult
+		want   []string
+	}{
+		{BackpressureDisconnect, []frame{testFrame("a", 0), testFrame("b", 0), testFrame("c", 0)},
+			pushOverflow, []string{"a", "b"}},
+		{BackpressureDropNewest, []frame{testFrame("a", 0), testFrame("b", 0), testFrame("c", 0)},
+			pushDropped, []string{"a", "b"}},
+		{BackpressureDropOldest, []frame{testFrame("a", 0), testFrame("b", 0), testFrame("c", 0)},
+			pushDropped, []string{"b", "c"}},
+		{BackpressurePriority, []frame{testFrame("a", 0), testFrame("b", PriorityLow), testFrame("c", PriorityHigh)},
+			pushDropped, []string{"a", "c"}},
+		{BackpressurePriority, []frame{testFrame("a", 0), testFrame("b", 0), testFrame("c", PriorityLow)},
+			pushDropped, []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		var q writeQueue
+		q.init(2)
+		bp := &Backpressure{Policy: c.policy}
+		var result pushResult
+		for _, f := range c.pushes {
+			result = q.push(f, bp)
+		}
+		if got := queued(&q); result != c.result || len(got) != len(c.want) || got[0] != c.want[0] || got[1] != c.want[1] {
+			t.Fatalf("%v: result %v, queued %v", c.policy, result, got)
+		}
+	}
+}
+
+func TestBackpressureBytes(t *testing.T) {
+	var q writeQueue
+	q.init(10)
+	bp := &Backpressure{Policy: BackpressureDropNewest, MaxPendingBytes: 8}
+	// a message over the limit goes if the queue is empty.
+	if q.push(testFrame("0123456789", 0), bp) != pushQueued {
+		t.Fatal("large message dropped from an empty queue")
+	}
+	if q.push(testFrame("a", 0), bp) != pushDropped {
+		t.Fatal("bytes limit not kept")
+	}
+	q.take(nil)
+	for _, data := range []string{"0123", "4567"} {
+		if q.push(testFrame(data, 0), bp) != pushQueued {
+			t.Fatalf("%s dropped under the limit", data)
+		}
+	}
+	if q.push(testFrame("8", 0), bp) != pushDropped {
+		t.Fatal("bytes limit not kept")
+	}
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	var q writeQueue
+	q.init(1)
+	bp := &Backpressure{Policy: BackpressureBlock, BlockTimeout: time.Second}
+	q.push(testFrame("a", 0), bp)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.take(nil)
+	}()
+	if result := q.push(testFrame("b", 0), bp); result != pushQueued {
+		t.Fatalf("blocked push %v", result)
+	}
+
+	bp.BlockTimeout = 20 * time.Millisecond
+	if result := q.push(testFrame("c", 0), bp); result != pushOverflow {
+		t.Fatalf("push after the timeout %v", result)
+	}
+}
+
+func TestOnBackpressure(t *testing.T) {
+	conn, _ := tcpPipe(t, 1)
+	agent := newTestAgent(conn, false)
+	var calls int
+	agent.backpressure = func() {
+		calls++
+		// the messages of the hook don't call it again.
+		_ = conn.WriteMsg([]byte("again"))
+	}
+	conn.agent = agent
+
+	conn.SetBackpressure(&Backpressure{Policy: BackpressureDropNewest})
+	for i := 0; i < 3; i++ {
+		_ = conn.WriteMsg([]byte("msg"))
+	}
+	if calls != 2 || conn.IsClosed() {
+		t.Fatalf("%d calls, closed %v", calls, conn.IsClosed())
+	}
+
+	conn.SetBackpressure(nil)
+	_ = conn.WriteMsg([]byte("msg"))
+	if calls != 3 || !conn.IsClosed() {
+		t.Fatalf("%d calls, closed %v", calls, conn.IsClosed())
+	}
+}
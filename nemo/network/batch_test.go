@@ -0,0 +1,150 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// tcpPipe get a conn over loopback and the peer reading its messages.
+func tcpPipe(t testing.TB, pendingWriteNum int) (*TCPConn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = peer.Close()
+	})
+
+	conn := newBenchTCPConn(c)
+	conn.queue.init(pendingWriteNum)
+	return conn, peer
+}
+
+func TestWriteBatch(t *testing.T) {
+	conn, peer := tcpPipe(t, 16)
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := conn.WriteMsg([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	writes := metricWrites.Value(transportTCP)
+	conn.start()
+	data, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\x00\x03one\x00\x03two\x00\x05three"; string(data) != want {
+		t.Fatalf("wrote %q", data)
+	}
+	if n := metricWrites.Value(transportTCP) - writes; n != 1 {
+		t.Fatalf("%v writes for the queued messages", n)
+	}
+}
+
+func TestFlushOnTick(t *testing.T) {
+	conn, peer := tcpPipe(t, 16)
+	conn.flushTicker = NewFlushTicker()
+	conn.start()
+	defer conn.Close()
+
+	if err := conn.WriteMsg([]byte("tick")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	// well before maxTickDelay.
+	_ = peer.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, err := peer.Read(buf); err == nil {
+		t.Fatalf("%q written before the tick", buf[:n])
+	}
+
+	// the ticks of another ticker don't flush it.
+	NewFlushTicker().Tick()
+	_ = peer.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if n, err := peer.Read(buf); err == nil {
+		t.Fatalf("%q written by another tick", buf[:n])
+	}
+
+	conn.flushTicker.Tick()
+	_ = peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(peer, buf[:6]); err != nil || !bytes.Equal(buf[:6], []byte("\x00\x04tick")) {
+		t.Fatalf("read %q, %v", buf[:6], err)
+	}
+}
+
+// BenchmarkTCPWriteLoopback compare the writer writing every message by its own
+// syscall, "single" as it did before, with the writer gathering the queued messages.
+// writes/msg is the syscalls per message.
+func BenchmarkTCPWriteLoopback(b *testing.B) {
+	msg := make([]byte, 64)
+	modes := []struct {
+		name  string
+		start func(conn *TCPConn)
+	}{
+		{"single", func(conn *TCPConn) {
+			go func() {
+				var frames []frame
+				for {
+					conn.queue.wait()
+					var done bool
+					frames, done = conn.queue.take(frames)
+					for _, f := range frames {
+						conn.frames = append(conn.frames[:0], f)
+						if conn.send() != nil {
+							return
+						}
+					}
+					if done {
+						return
+					}
+				}
+			}()
+		}},
+		{"batch", (*TCPConn).start},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			conn, peer := tcpPipe(b, 1024)
+			total := int64(b.N) * int64(2+len(msg))
+			done := make(chan struct{})
+			go func() {
+				_, _ = io.CopyN(io.Discard, peer, total)
+				close(done)
+			}()
+
+			writes := metricWrites.Value(transportTCP)
+			b.SetBytes(int64(2 + len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			mode.start(conn)
+			for i := 0; i < b.N; i++ {
+				// a full queue closes the conn, wait for the writer instead.
+				for conn.queue.len() == conn.queue.maxNum {
+					runtime.Gosched()
+				}
+				if err := conn.WriteMsg(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-done
+			b.StopTimer()
+			b.ReportMetric((metricWrites.Value(transportTCP)-writes)/float64(b.N), "writes/msg")
+			conn.Close()
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"sync/atomic"
+
+	"github.com/lircstar/nemo/sys/pool"
+)
+
+// -------------------------------------------------------------------------------------
+// Message buffers.
+//
+// The messages read by Conn.ReadMsg, and the datagrams given to Agent.Run by a UDP
+// server, are allocated from the buffer pool. The reader owns such a message: it may
+// give it back by ReleaseMsg once it is done, and must not touch it after that, nor
+// release it twice. A message never released is collected by the gc as usual, so
+// releasing is an optimization only. Anything that keeps a message, or a part of it,
+// longer than its handling must copy it.
+//
+// The buffers written by Conn.WriteMsg are taken from the pool too and given back once
+// they are on the wire, the args of WriteMsg stay owned by the caller.
+
+var bufferPool atomic.Pointer[pool.Pool]
+
+func init() {
+	SetBufferPool(pool.NewSyncPool(64, 64*1024, 2))
+}
+
+// SetBufferPool set the pool of the message buffers, nil to allocate every buffer.
+// Call it before any server or client starts.
+func SetBufferPool(p pool.Pool) {
+	if p == nil {
+		p = new(pool.NoPool)
+	}
+	bufferPool.Store(&p)
+}
+
+func allocBuffer(size int) []byte {
+	return (*bufferPool.Load()).Alloc(size)
+}
+
+func freeBuffer(b []byte) {
+	if cap(b) > 0 {
+		(*bufferPool.Load()).Free(b)
+	}
+}
+
+// ReleaseMsg give back data, a message read by Conn.ReadMsg, to the buffer pool.
+func ReleaseMsg(data []byte) {
+	freeBuffer(data)
+}
@@ -0,0 +1,191 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/sys/pool"
+)
+
+func TestUDPServerBuffers(t *testing.T) {
+	addr := startSecureUDPServer(t, nil)
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	buf := make([]byte, 4096)
+	echo := func() string {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	// the first datagram makes the agent, the others are handled concurrently.
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := echo(); got != "hello" {
+		t.Fatalf("echo %q", got)
+	}
+
+	const count = 100
+	sent := make(map[string]bool)
+	for i := 0; i < count; i++ {
+		msg := fmt.Sprintf("message %03d %s", i, bytes.Repeat([]byte{byte('a' + i%26)}, i))
+		sent[msg] = true
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		got := echo()
+		if !sent[got] {
+			t.Fatalf("datagram corrupted: %q", got)
+		}
+		delete(sent, got)
+	}
+}
+
+func TestReleaseMsg(t *testing.T) {
+	defer SetBufferPool(pool.NewSyncPool(64, 64*1024, 2))
+	p := pool.NewAtomPool(64, 1024, 2, 1024)
+	SetBufferPool(p)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := newBenchTCPConn(a)
+	go func() {
+		_, _ = b.Write([]byte{0, 5, 'h', 'e', 'l', 'l', 'o'})
+	}()
+	data, err := conn.ReadMsg()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if cap(data) != 64 {
+		t.Fatalf("message not from the pool, cap %d", cap(data))
+	}
+	ReleaseMsg(data)
+	if again := allocBuffer(5); &again[:1][0] != &data[:1][0] {
+		t.Fatal("message not given back to the pool")
+	}
+}
+
+//-------------------------------------------------------------------------------------
+// benchmarks, run them with -benchmem: "nopool" allocates every buffer, as the parsers
+// did before the buffer pool.
+
+// loopConn reads a frame again and again and discards the writes.
+type loopConn struct {
+	net.Conn
+	frame []byte
+	off   int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	n := copy(b, c.frame[c.off:])
+	c.off = (c.off + n) % len(c.frame)
+	return n, nil
+}
+
+func (c *loopConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func newBenchTCPConn(conn net.Conn) *TCPConn {
+	p := newTcpMsgParser()
+	p.SetMsgLen(2, 1, 4096)
+	tcpConn := newTCPConn(1, p)
+	tcpConn.bindConn(conn)
+	return tcpConn
+}
+
+// benchPools run bench with each buffer pool.
+func benchPools(b *testing.B, bench func(b *testing.B)) {
+	defer SetBufferPool(pool.NewSyncPool(64, 64*1024, 2))
+	pools := []struct {
+		name string
+		pool pool.Pool
+	}{
+		{"nopool", nil},
+		{"sync", pool.NewSyncPool(64, 64*1024, 2)},
+		{"atom", pool.NewAtomPool(64, 64*1024, 2, 1024*1024)},
+	}
+	for _, p := range pools {
+		b.Run(p.name, func(b *testing.B) {
+			SetBufferPool(p.pool)
+			b.ReportAllocs()
+			bench(b)
+		})
+	}
+}
+
+func BenchmarkTCPRead(b *testing.B) {
+	benchPools(b, func(b *testing.B) {
+		frame := append([]byte{0x02, 0x00}, make([]byte, 512)...)
+		conn := newBenchTCPConn(&loopConn{frame: frame})
+		b.SetBytes(int64(len(frame)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			data, err := conn.ReadMsg()
+			if err != nil {
+				b.Fatal(err)
+			}
+			ReleaseMsg(data)
+		}
+	})
+}
+
+func BenchmarkTCPWrite(b *testing.B) {
+	benchPools(b, func(b *testing.B) {
+		conn := newBenchTCPConn(&loopConn{})
+		id, body := []byte{0, 1}, make([]byte, 510)
+		b.SetBytes(int64(2 + len(id) + len(body)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := conn.WriteMsg(id, body); err != nil {
+				b.Fatal(err)
+			}
+			conn.frames, _ = conn.queue.take(conn.frames)
+			if err := conn.send(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUDPWrite(b *testing.B) {
+	benchPools(b, func(b *testing.B) {
+		ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer ln.Close()
+		go func() { _, _ = io.Copy(io.Discard, ln) }()
+
+		c, err := net.DialUDP("udp", nil, ln.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer c.Close()
+		conn := newUDPConn(newUdpMsgParser())
+		conn.conn = c
+
+		id, body := []byte{0, 1}, make([]byte, 510)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := conn.WriteMsg(id, body); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// -------------------------------------------------------------------------------------
+// UDP channels.
+//
+// A reliable UDP conn carries its messages on channels, each one with its delivery and
+// its own sequence space. Every datagram starts with its channel:
+//
+//	| ch | arq segments |    ReliableUnordered, ReliableOrdered
+//	| ch | seq | message |   UnreliableSequenced
+//	| ch | message |         Unreliable
+//
+// A message of an unreliable channel must fit in a datagram. The conns without
+// channels deliver every message reliable and ordered, or unreliable for raw UDP.
+
+// Delivery is the guarantee of the messages of a channel.
+type Delivery byte
+
+const (
+	// Unreliable messages may be lost, duplicated or reordered.
+	Unreliable Delivery = iota
+	// UnreliableSequenced messages may be lost, a message older than the last one
+	// read is dropped.
+	UnreliableSequenced
+	// ReliableUnordered messages are never lost, they are read once complete.
+	ReliableUnordered
+	// ReliableOrdered messages are never lost and read in order.
+	ReliableOrdered
+)
+
+var deliveryNames = []string{"unreliable", "unreliable_sequenced", "reliable_unordered", "reliable_ordered"}
+
+func (d Delivery) String() string {
+	if int(d) < len(deliveryNames) {
+		return deliveryNames[d]
+	}
+	return fmt.Sprintf("Delivery(%d)", int(d))
+}
+
+// Channel is a delivery and an index, there are 64 channels of each delivery.
+type Channel byte
+
+const channelIndexBits = 6
+
+// MaxChannelIndex is the highest index of a channel.
+const MaxChannelIndex = 1<<channelIndexBits - 1
+
+// the channels of index 0, WriteMsg of a reliable UDP conn uses ChannelReliableOrdered.
+const (
+	ChannelUnreliable          = Channel(Unreliable) << channelIndexBits
+	ChannelUnreliableSequenced = Channel(UnreliableSequenced) << channelIndexBits
+	ChannelReliableUnordered   = Channel(ReliableUnordered) << channelIndexBits
+	ChannelReliableOrdered     = Channel(ReliableOrdered) << channelIndexBits
+)
+
+// NewChannel get the channel index of delivery d.
+func NewChannel(d Delivery, index int) Channel {
+	if d > ReliableOrdered || index < 0 || index > MaxChannelIndex {
+		log.Fatalf("invalid channel %v/%d", d, index)
+	}
+	return Channel(d)<<channelIndexBits | Channel(index)
+}
+
+func (ch Channel) Delivery() Delivery {
+	return Delivery(ch >> channelIndexBits)
+}
+
+func (ch Channel) Index() int {
+	return int(ch & MaxChannelIndex)
+}
+
+func (ch Channel) reliable() bool {
+	return ch.Delivery() >= ReliableUnordered
+}
+
+func (ch Channel) String() string {
+	return fmt.Sprintf("%v/%d", ch.Delivery(), ch.Index())
+}
+
+// ChannelWriter is a Conn writing messages on a channel.
+type ChannelWriter interface {
+	WriteMsgOn(ch Channel, args ...[]byte) error
+}
+
+//-------------------------------------------------------------------------------------
+// channels of a conn.
+
+// udpChannels are the channels of a reliable UDP conn, goroutine safe. The reliable
+// ones are made on their first message.
+type udpChannels struct {
+	config   *ARQConfig
+	overhead int // of sealing.
+	output   func([]byte)
+	dead     func()
+
+	mu      sync.Mutex
+	arqs    map[Channel]*arq
+	sendSeq [MaxChannelIndex + 1]uint32 // of the sequenced channels.
+	recvSeq [MaxChannelIndex + 1]uint32
+	closed  bool
+}
+
+func newUDPChannels(config *ARQConfig, overhead int, output func([]byte), dead func()) *udpChannels {
+	return &udpChannels{
+		config:   config,
+		overhead: overhead,
+		output:   output,
+		dead:     dead,
+		arqs:     make(map[Channel]*arq),
+	}
+}
+
+// arq get the reliable layer of ch.
+func (c *udpChannels) arq(ch Channel) (*arq, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errARQClosed
+	}
+	a := c.arqs[ch]
+	if a == nil {
+		a = newARQ(c.config, ch, c.overhead, c.output, c.dead)
+		c.arqs[ch] = a
+	}
+	return a, nil
+}
+
+// send the message of args on ch, they are copied.
+func (c *udpChannels) send(ch Channel, args ...[]byte) error {
+	if ch.reliable() {
+		a, err := c.arq(ch)
+		if err != nil {
+			return err
+		}
+		return a.send(args...)
+	}
+
+	head := 1
+	if ch.Delivery() == UnreliableSequenced {
+		head += 4
+	}
+	size := head
+	for _, arg := range args {
+		size += len(arg)
+	}
+	if size > c.config.mtu()-c.overhead {
+		return errors.New("message too long")
+	}
+
+	msg := allocBuffer(size)
+	defer freeBuffer(msg)
+	msg[0] = byte(ch)
+	if head > 1 {
+		c.mu.Lock()
+		c.sendSeq[ch.Index()]++
+		binary.BigEndian.PutUint32(msg[1:], c.sendSeq[ch.Index()])
+		c.mu.Unlock()
+	}
+	l := head
+	for _, arg := range args {
+		l += copy(msg[l:], arg)
+	}
+	c.output(msg)
+	return nil
+}
+
+// receive feed a datagram of the peer to its channel and append the messages it
+// completes to msgs. They are owned by the caller, see ReleaseMsg.
+func (c *udpChannels) receive(data []byte, msgs [][]byte) ([][]byte, error) {
+	if len(data) < 2 {
+		return msgs, errARQSegment
+	}
+	ch := Channel(data[0])
+	data = data[1:]
+
+	switch ch.Delivery() {
+	case Unreliable:
+	case UnreliableSequenced:
+		if len(data) < 5 {
+			return msgs, errARQSegment
+		}
+		seq := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		c.mu.Lock()
+		last := &c.recvSeq[ch.Index()]
+		late := *last != 0 && !before(*last, seq)
+		if !late {
+			*last = seq
+		}
+		c.mu.Unlock()
+		if late {
+			return msgs, nil
+		}
+	default:
+		a, err := c.arq(ch)
+		if err != nil {
+			return msgs, err
+		}
+		if err = a.input(data); err != nil {
+			return msgs, err
+		}
+		for {
+			msg, err := a.recv()
+			if err != nil || msg == nil {
+				return msgs, nil
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	msg := allocBuffer(len(data))
+	copy(msg, data)
+	return append(msgs, msg), nil
+}
+
+// close the channels, the reliable ones send what waits a last time.
+func (c *udpChannels) close() {
+	c.mu.Lock()
+	c.closed = true
+	arqs := c.arqs
+	c.arqs = nil
+	c.mu.Unlock()
+
+	for _, a := range arqs {
+		a.close()
+	}
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestChannel(t *testing.T) {
+	ch := NewChannel(UnreliableSequenced, 5)
+	if ch.Delivery() != UnreliableSequenced || ch.Index() != 5 || ch.String() != "unreliable_sequenced/5" {
+		t.Fatalf("channel %v", ch)
+	}
+	if ChannelReliableOrdered.Delivery() != ReliableOrdered || ChannelReliableOrdered.Index() != 0 {
+		t.Fatalf("channel %v", ChannelReliableOrdered)
+	}
+}
+
+func TestChannelSequenced(t *testing.T) {
+	var sent [][]byte
+	sender := newUDPChannels(&ARQConfig{}, 0, func(data []byte) {
+		sent = append(sent, bytes.Clone(data))
+	}, nil)
+	receiver := newUDPChannels(&ARQConfig{}, 0, nil, nil)
+
+	pos := NewChannel(UnreliableSequenced, 1)
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := sender.send(pos, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the channels have their own sequences.
+	if err := sender.send(ChannelUnreliableSequenced, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs [][]byte
+	for _, i := range []int{1, 0, 2, 3} {
+		var err error
+		if msgs, err = receiver.receive(sent[i], msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, string(msg))
+	}
+	if len(got) != 3 || got[0] != "2" || got[1] != "3" || got[2] != "other" {
+		t.Fatalf("received %q", got)
+	}
+
+	if err := sender.send(ChannelUnreliable, make([]byte, 1400)); err == nil {
+		t.Fatal("unreliable message over the mtu sent")
+	}
+}
+
+func TestUDPChannels(t *testing.T) {
+	agents := make(chan *testAgent, 1)
+	reliable := &ARQConfig{MTU: 512}
+	addr := freeUDPAddr(t)
+	server := &UDPServer{
+		MaxConnNum: 10,
+		MinMsgLen:  1,
+		MaxMsgLen:  4096,
+		Reliable:   reliable,
+		NewAgent: func(conn Conn) Agent {
+			a := newTestAgent(conn, false)
+			agents <- a
+			return a
+		},
+	}
+	server.Start(addr)
+	defer server.Close()
+
+	conns := make(chan Conn, 1)
+	client := &UDPClient{
+		Addr:      addr,
+		MinMsgLen: 1,
+		MaxMsgLen: 4096,
+		TimeOut:   60,
+		Reliable:  reliable,
+		NewAgent: func(conn Conn) Agent {
+			conns <- conn
+			return newTestAgent(conn, true)
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	var conn ChannelWriter
+	select {
+	case c := <-conns:
+		conn = c.(ChannelWriter)
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not connected")
+	}
+
+	sent := map[Channel]string{
+		ChannelUnreliable:                  "unreliable",
+		ChannelUnreliableSequenced:         "sequenced",
+		ChannelReliableUnordered:           "unordered",
+		ChannelReliableOrdered:             "ordered",
+		NewChannel(ReliableOrdered, 1):     string(testMessage(300)),
+		NewChannel(ReliableUnordered, 63):  string(testMessage(400)),
+		NewChannel(UnreliableSequenced, 2): "sequenced 2",
+	}
+	for ch, msg := range sent {
+		if err := conn.WriteMsgOn(ch, []byte(msg)); err != nil {
+			t.Fatalf("%v: %v", ch, err)
+		}
+	}
+
+	a := <-agents
+	got := make(map[string]bool)
+	for range sent {
+		got[string(a.recv(t))] = true
+	}
+	for ch, msg := range sent {
+		if !got[msg] {
+			t.Fatalf("message of %v not received", ch)
+		}
+	}
+}
+
+func TestRawUDPChannels(t *testing.T) {
+	conn := newUDPConn(newUdpMsgParser())
+	if err := conn.WriteMsgOn(ChannelReliableOrdered, []byte("hello")); err == nil {
+		t.Fatal("reliable channel written on a raw conn")
+	}
+}
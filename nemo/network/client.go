@@ -1,5 +1,13 @@
 package network
 
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 const (
 	TYPE_CLIENT_TCP       = 1001
 	TYPE_CLIENT_WEBSOCKET = 1002
@@ -9,6 +17,7 @@ const (
 type Client interface {
 	Start()
 	Send(msg any) bool
+	Call(ctx context.Context, req any) (any, error)
 	Close()
 
 	GetType() uint
@@ -16,3 +25,42 @@ type Client interface {
 	GetAgent() Agent
 	GetAddress() string
 }
+
+var ErrNotConnected = errors.New("not connected")
+
+// reconnectOption keeps AutoReconnect and ConnectInterval of a client once it starts,
+// so they can be changed while it runs.
+type reconnectOption struct {
+	auto     atomic.Bool
+	interval atomic.Int64
+}
+
+func (r *reconnectOption) set(auto bool, interval time.Duration) {
+	r.auto.Store(auto)
+	if interval > 0 {
+		r.interval.Store(int64(interval))
+	}
+}
+
+func (r *reconnectOption) wait() {
+	time.Sleep(time.Duration(r.interval.Load()))
+}
+
+// clientAgent keeps the agent of the conn of a client, set and cleared by the goroutine
+// connecting it while the others send through it.
+type clientAgent struct {
+	mu    sync.RWMutex
+	agent Agent
+}
+
+func (c *clientAgent) get() Agent {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.agent
+}
+
+func (c *clientAgent) set(agent Agent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.agent = agent
+}
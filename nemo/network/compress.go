@@ -0,0 +1,228 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// -------------------------------------------------------------------------------------
+// Compression of tcp messages.
+//
+// A compressed message has the highest bit of its length set, the bit is never used by
+// a plain message since SetMsgLen limits the length to the signed range. The codec is
+// negotiated by a hello message, the first message of a client:
+//
+//	| helloMagic | helloOffer | codec ids by preference |
+//
+// and the server answers before its next message with the codec chosen, 0 for none:
+//
+//	| helloMagic | helloAnswer | codec id |
+//
+// A peer sends compressed messages only after the negotiation, so the clients and the
+// servers without compression keep working with the others.
+
+const (
+	CodecDeflate = "deflate"
+	CodecSnappy  = "snappy"
+	CodecZstd    = "zstd"
+)
+
+const (
+	helloOffer  = 1
+	helloAnswer = 2
+)
+
+var helloMagic = []byte("\xffnemo-z")
+
+var codecIds = map[string]byte{
+	CodecDeflate: 1,
+	CodecSnappy:  2,
+	CodecZstd:    3,
+}
+
+var errTooLarge = errors.New("decompressed message too long")
+
+// codec compresses and decompresses whole messages, goroutine safe.
+type codec interface {
+	encode(src []byte) ([]byte, error)
+	// decode src, an error if the result is longer than max.
+	decode(src []byte, max int) ([]byte, error)
+}
+
+func newCodec(name string, max int) (codec, error) {
+	switch name {
+	case CodecDeflate:
+		return new(deflateCodec), nil
+	case CodecSnappy:
+		return snappyCodec{}, nil
+	case CodecZstd:
+		return newZstdCodec(max)
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// ValidCodec tell whether name is a supported codec.
+func ValidCodec(name string) bool {
+	_, ok := codecIds[name]
+	return ok
+}
+
+//-------------------------------------------------------------------------------------
+// codecs.
+
+type deflateCodec struct {
+	writers sync.Pool
+}
+
+func (c *deflateCodec) encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	} else {
+		w.Reset(&buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *deflateCodec) decode(src []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) encode(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCodec) decode(src []byte, max int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, errTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCodec(max int) (*zstdCodec, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max)))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCodec{enc: enc, dec: dec}, nil
+}
+
+func (c *zstdCodec) encode(src []byte) ([]byte, error) {
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCodec) decode(src []byte, max int) ([]byte, error) {
+	data, err := c.dec.DecodeAll(src, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
+
+//-------------------------------------------------------------------------------------
+// negotiation.
+
+// compression is the codecs a parser accepts, in the order of preference.
+type compression struct {
+	ids       []byte
+	codecs    map[byte]codec
+	threshold int
+}
+
+func newCompression(names []string, threshold, max int) (*compression, error) {
+	c := &compression{threshold: threshold, codecs: make(map[byte]codec)}
+	for _, name := range names {
+		cd, err := newCodec(name, max)
+		if err != nil {
+			return nil, err
+		}
+		id := codecIds[name]
+		c.ids = append(c.ids, id)
+		c.codecs[id] = cd
+	}
+	return c, nil
+}
+
+// hello get the hello message of kind with ids.
+func hello(kind byte, ids ...byte) []byte {
+	msg := make([]byte, 0, len(helloMagic)+1+len(ids))
+	msg = append(msg, helloMagic...)
+	msg = append(msg, kind)
+	return append(msg, ids...)
+}
+
+// parseHello get the kind and the codec ids of a hello message, ok is false if data is
+// not one.
+func parseHello(data []byte) (kind byte, ids []byte, ok bool) {
+	if !bytes.HasPrefix(data, helloMagic) || len(data) == len(helloMagic) {
+		return 0, nil, false
+	}
+	kind, ids = data[len(helloMagic)], data[len(helloMagic)+1:]
+	if kind != helloOffer && kind != helloAnswer {
+		return 0, nil, false
+	}
+	return kind, ids, true
+}
+
+// choose the first codec of ids accepted by c, 0 if none.
+func (c *compression) choose(ids []byte) byte {
+	if c == nil {
+		return 0
+	}
+	for _, id := range ids {
+		if _, ok := c.codecs[id]; ok {
+			return id
+		}
+	}
+	return 0
+}
+
+func (c *compression) codec(id byte) codec {
+	if c == nil {
+		return nil
+	}
+	return c.codecs[id]
+}
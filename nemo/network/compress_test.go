@@ -0,0 +1,202 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCodecs(t *testing.T) {
+	src := bytes.Repeat([]byte("inventory item "), 200)
+	for name := range codecIds {
+		cd, err := newCodec(name, len(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := cd.encode(src)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(data) >= len(src) {
+			t.Fatalf("%s: %d bytes not compressed", name, len(data))
+		}
+		got, err := cd.decode(data, len(src))
+		if err != nil || !bytes.Equal(got, src) {
+			t.Fatalf("%s: decoded %d bytes, %v", name, len(got), err)
+		}
+
+		// a message decompressing over the limit is refused.
+		small, _ := newCodec(name, len(src)/2)
+		if _, err = small.decode(data, len(src)/2); err == nil {
+			t.Fatalf("%s: decoded over the limit", name)
+		}
+	}
+}
+
+// startEchoServer start a plain echo server with the codecs.
+func startEchoServer(t *testing.T, codecs ...string) *TCPServer {
+	t.Helper()
+	server := &TCPServer{
+		Addr:              "127.0.0.1:0",
+		MaxConnNum:        10,
+		MaxMsgLen:         32 * 1024,
+		LenMsgLen:         2,
+		Compression:       codecs,
+		CompressThreshold: 64,
+		NewAgent: func(conn Conn) Agent {
+			return newTestAgent(conn, true)
+		},
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCompression(t *testing.T) {
+	big := bytes.Repeat([]byte("map snapshot "), 1000)
+	cases := []struct {
+		name   string
+		server []string
+		client []string
+		want   string
+	}{
+		{"client preference", []string{CodecZstd, CodecSnappy}, []string{CodecSnappy, CodecZstd}, CodecSnappy},
+		{"server subset", []string{CodecDeflate}, []string{CodecZstd, CodecDeflate}, CodecDeflate},
+		{"server without compression", nil, []string{CodecZstd}, ""},
+		{"client without compression", []string{CodecZstd}, nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := startEchoServer(t, c.server...)
+			a := startTestClient(t, &TCPClient{
+				Addr:              server.ln.Addr().String(),
+				MaxMsgLen:         32 * 1024,
+				Compression:       c.client,
+				CompressThreshold: 64,
+			})
+
+			for _, msg := range [][]byte{[]byte("small"), big} {
+				if err := a.conn.WriteMsg(msg); err != nil {
+					t.Fatal(err)
+				}
+				if data := a.recv(t); !bytes.Equal(data, msg) {
+					t.Fatalf("echo of %d bytes is %d bytes", len(msg), len(data))
+				}
+			}
+			if got := a.conn.(*TCPConn).codecId.Load(); got != uint32(codecIds[c.want]) {
+				t.Fatalf("codec %v negotiated, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// wireConn writes and reads frames of a 2 bytes length without a parser.
+type wireConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialWire(t *testing.T, server *TCPServer) *wireConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	return &wireConn{t: t, conn: conn}
+}
+
+func (w *wireConn) write(data []byte) {
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	if _, err := w.conn.Write(append(frame, data...)); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+// read a frame, compressed tells whether its flag is set.
+func (w *wireConn) read() (data []byte, compressed bool) {
+	var head [2]byte
+	if _, err := io.ReadFull(w.conn, head[:]); err != nil {
+		w.t.Fatal(err)
+	}
+	n := binary.BigEndian.Uint16(head[:])
+	data = make([]byte, n&0x7fff)
+	if _, err := io.ReadFull(w.conn, data); err != nil {
+		w.t.Fatal(err)
+	}
+	return data, n&0x8000 != 0
+}
+
+func TestCompressionWire(t *testing.T) {
+	server := startEchoServer(t, CodecSnappy)
+	big := bytes.Repeat([]byte("map snapshot "), 1000)
+	offer := hello(helloOffer, codecIds[CodecZstd], codecIds[CodecSnappy])
+
+	// a client offering snappy gets compressed messages after the answer.
+	w := dialWire(t, server)
+	w.write(offer)
+	if data, _ := w.read(); !bytes.Equal(data, hello(helloAnswer, codecIds[CodecSnappy])) {
+		t.Fatalf("answer %q", data)
+	}
+	w.write(big)
+	data, compressed := w.read()
+	if !compressed || len(data) >= len(big) {
+		t.Fatalf("echo of %d bytes not compressed", len(data))
+	}
+	if data, _ = (snappyCodec{}).decode(data, len(big)); !bytes.Equal(data, big) {
+		t.Fatal("echo not decoded")
+	}
+
+	// an old client without hello gets plain messages, and a hello later than the
+	// first message is a plain message.
+	w = dialWire(t, server)
+	w.write(big)
+	if data, compressed = w.read(); compressed || !bytes.Equal(data, big) {
+		t.Fatal("old client got a compressed echo")
+	}
+	w.write(offer)
+	if data, _ = w.read(); !bytes.Equal(data, offer) {
+		t.Fatal("late hello negotiated")
+	}
+}
+
+func TestWSCompression(t *testing.T) {
+	server := &WSServer{
+		Addr:              "127.0.0.1:0",
+		MaxConnNum:        10,
+		MaxMsgLen:         32 * 1024,
+		Compression:       true,
+		CompressThreshold: 64,
+		NewAgent: func(conn Conn) Agent {
+			return newTestAgent(conn, true)
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws://"+server.ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("extensions %q", ext)
+	}
+
+	big := bytes.Repeat([]byte("map snapshot "), 1000)
+	if err = conn.WriteMessage(websocket.TextMessage, big); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || !bytes.Equal(data, big) {
+		t.Fatalf("echo of %d bytes, %v", len(data), err)
+	}
+}
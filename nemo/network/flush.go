@@ -0,0 +1,54 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------------------------------------
+// Flush at tick.
+//
+// A conn flushing at tick holds the messages queued until the next tick of the
+// FlushTicker of its server, then writes all of them by one write, so a message
+// broadcast to many conns costs a single write per conn and tick. Each server instance
+// ticks its own FlushTicker from its main loop. A conn writes anyway after
+// maxTickDelay if no tick comes.
+
+const maxTickDelay = 100 * time.Millisecond
+
+// FlushTicker ticks the conns flushing at tick of the servers given it.
+type FlushTicker struct {
+	mu sync.Mutex
+	ch chan struct{} // closed by the next tick.
+}
+
+func NewFlushTicker() *FlushTicker {
+	return &FlushTicker{ch: make(chan struct{})}
+}
+
+// Tick let the conns flushing at t write the messages queued.
+func (t *FlushTicker) Tick() {
+	t.mu.Lock()
+	close(t.ch)
+	t.ch = make(chan struct{})
+	t.mu.Unlock()
+}
+
+// wait for the next tick, or for timer after maxTickDelay.
+func (t *FlushTicker) wait(timer *time.Timer) {
+	t.mu.Lock()
+	ch := t.ch
+	t.mu.Unlock()
+
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(maxTickDelay)
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+}
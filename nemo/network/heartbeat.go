@@ -0,0 +1,74 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------------------------------------
+// Heartbeat.
+//
+// The agents ping their peer and measure the round trip of the pong. A WebSocket conn
+// uses the ping frames of the protocol, see Pinger, the others carry the pings as
+// messages of the agent.
+
+// RTTStats are the round trip times measured by the heartbeat of an agent.
+type RTTStats struct {
+	// Last is the last sample.
+	Last time.Duration
+	// Smoothed is the mean of the samples, a recent one weighs 1/8 as in TCP.
+	Smoothed time.Duration
+	// Jitter is the mean deviation between successive samples, as in RFC 3550.
+	Jitter time.Duration
+	// Samples is the count of samples, the others are 0 until the first.
+	Samples int64
+}
+
+// RTTMeter collects the round trip times of a peer, goroutine safe.
+type RTTMeter struct {
+	mu    sync.Mutex
+	stats RTTStats
+}
+
+// Add the sample rtt.
+func (m *RTTMeter) Add(rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &m.stats
+	if s.Samples == 0 {
+		s.Smoothed = rtt
+	} else {
+		s.Smoothed += (rtt - s.Smoothed) / 8
+		d := rtt - s.Last
+		if d < 0 {
+			d = -d
+		}
+		s.Jitter += (d - s.Jitter) / 16
+	}
+	s.Last = rtt
+	s.Samples++
+}
+
+// Stats get the stats of the samples.
+func (m *RTTMeter) Stats() RTTStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// Reset forget the samples, for a meter used by another peer.
+func (m *RTTMeter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats = RTTStats{}
+}
+
+// Pinger is a Conn with the heartbeat of its protocol.
+type Pinger interface {
+	// Ping send a ping, its pong is measured by RTT.
+	Ping() error
+	RTT() RTTStats
+	// HeartbeatTime get the unix time of the last ping or pong of the peer, 0 if
+	// there is none.
+	HeartbeatTime() int64
+}
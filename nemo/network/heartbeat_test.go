@@ -0,0 +1,95 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRTTMeter(t *testing.T) {
+	var m RTTMeter
+	if s := m.Stats(); s.Samples != 0 || s.Smoothed != 0 {
+		t.Fatalf("stats %+v", s)
+	}
+	m.Add(80 * time.Millisecond)
+	if s := m.Stats(); s.Smoothed != 80*time.Millisecond || s.Jitter != 0 {
+		t.Fatalf("first sample %+v", s)
+	}
+	m.Add(160 * time.Millisecond)
+	s := m.Stats()
+	if s.Last != 160*time.Millisecond || s.Smoothed != 90*time.Millisecond || s.Jitter != 5*time.Millisecond || s.Samples != 2 {
+		t.Fatalf("second sample %+v", s)
+	}
+	m.Reset()
+	if s := m.Stats(); s.Samples != 0 {
+		t.Fatalf("reset %+v", s)
+	}
+}
+
+func TestWSPing(t *testing.T) {
+	conns := make(chan Conn, 1)
+	server := &WSServer{
+		Addr:       "127.0.0.1:0",
+		MaxConnNum: 10,
+		MaxMsgLen:  4096,
+		NewAgent: func(conn Conn) Agent {
+			conns <- conn
+			return newTestAgent(conn, true)
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pongs := make(chan struct{}, 1)
+	conn.SetPongHandler(func(string) error {
+		pongs <- struct{}{}
+		return nil
+	})
+	// the control frames are handled while reading.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var p Pinger
+	select {
+	case c := <-conns:
+		p = c.(Pinger)
+	case <-time.After(3 * time.Second):
+		t.Fatal("not connected")
+	}
+
+	// the client answers the ping of the server.
+	if err = p.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for p.RTT().Samples == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pong not measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.HeartbeatTime() == 0 {
+		t.Fatal("pong not seen")
+	}
+
+	// the server answers the ping of the client.
+	if err = conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pongs:
+	case <-time.After(3 * time.Second):
+		t.Fatal("ping not answered")
+	}
+}
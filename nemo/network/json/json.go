@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/lircstar/nemo/nemo/network"
 	"github.com/lircstar/nemo/sys/log"
-	"github.com/lircstar/nemo/sys/util"
 	"math"
 	"reflect"
 )
@@ -22,6 +21,14 @@ type MsgInfo struct {
 	msgRawHandler network.MsgHandler
 }
 
+// name of the message, empty for raw message.
+func (i *MsgInfo) name() string {
+	if i.msgType == nil {
+		return ""
+	}
+	return i.msgType.Elem().Name()
+}
+
 type MsgRaw struct {
 	msgID      uint16
 	msgRawData json.RawMessage
@@ -35,6 +42,8 @@ func NewProcessor() *Processor {
 }
 
 // Register
+// The id is the hash of the type name by network.HashMsgId, it is fatal when it
+// collides with another message, use RegisterWithID for such message.
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) Register(msg any) {
 	msgType := reflect.TypeOf(msg)
@@ -42,19 +51,38 @@ func (p *Processor) Register(msg any) {
 		log.Fatal("json message pointer required")
 	}
 
+	name := msgType.Elem().Name()
+	if name == "" {
+		log.Fatalf("unnamed json message %v ", msgType)
+	}
+	p.register(network.HashMsgId(name), msg)
+}
+
+// RegisterWithID
+// Register msg with an explicit id.
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) RegisterWithID(id uint16, msg any) {
+	p.register(id, msg)
+}
+
+func (p *Processor) register(msgId uint16, msg any) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		log.Fatal("json message pointer required")
+	}
+
 	if _, ok := p.msgID[msgType]; ok {
 		log.Fatalf("message %s is already registered", msgType)
 	}
 	if len(p.msgInfo) >= math.MaxUint16 {
-		log.Fatalf("too many protobuf messages (max = %v)", math.MaxUint16)
+		log.Fatalf("too many json messages (max = %v)", math.MaxUint16)
 	}
-
-	name := msgType.Elem().Name()
-	if name == "" {
-		log.Fatalf("unnamed json message %v ", name)
+	if msgId == network.MSG_ID_RPC {
+		log.Fatalf("message %s takes the rpc id %v", msgType, msgId)
+	}
+	if i, ok := p.msgInfo[msgId]; ok {
+		log.Fatalf("message %s id %v collides with %s", msgType, msgId, i.name())
 	}
-
-	msgId := util.StringHash(fmt.Sprintf("%v", name))
 
 	i := new(MsgInfo)
 	i.msgType = msgType
@@ -79,8 +107,11 @@ func (p *Processor) SetHandler(msg any, msgHandler network.MsgHandler) {
 // SetRawHandler
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) SetRawHandler(id uint16, msgRawHandler network.MsgHandler) {
-	if p.msgInfo[id] != nil {
-		log.Fatalf("message %d is already registered", id)
+	if id == network.MSG_ID_RPC {
+		log.Fatalf("message %d is reserved for rpc", id)
+	}
+	if i, ok := p.msgInfo[id]; ok {
+		log.Fatalf("message %d is already registered by %s", id, i.name())
 	}
 	p.msgInfo[id] = new(MsgInfo)
 	p.msgInfo[id].msgRawHandler = msgRawHandler
@@ -106,16 +137,11 @@ func (p *Processor) Route(agent network.Agent, msg any, userData any) error {
 		return errors.New("json message pointer required")
 	}
 
-	name := msgType.Elem().Name()
-	if name == "" {
-		return fmt.Errorf("unnamed json message %v ", name)
-	}
-	msgId := util.StringHash(fmt.Sprintf("%v", name))
-
-	i, ok := p.msgInfo[msgId]
+	msgId, ok := p.msgID[msgType]
 	if !ok {
-		return fmt.Errorf("message %v not registered", msgId)
+		return fmt.Errorf("message %s not registered", msgType)
 	}
+	i := p.msgInfo[msgId]
 	if i.msgHandler != nil {
 		i.msgHandler(agent, []any{msg, userData})
 	}
@@ -158,14 +184,9 @@ func (p *Processor) Marshal(msg any) ([][]byte, error) {
 	if msgType == nil || msgType.Kind() != reflect.Ptr {
 		return nil, errors.New("json message pointer required")
 	}
-	name := msgType.Elem().Name()
-	if name == "" {
-		return nil, fmt.Errorf("unnamed json message %v ", name)
-	}
-
-	msgId := util.StringHash(fmt.Sprintf("%v", name))
-	if _, ok := p.msgInfo[msgId]; !ok {
-		return nil, fmt.Errorf("message %v not registered", msgId)
+	msgId, ok := p.msgID[msgType]
+	if !ok {
+		return nil, fmt.Errorf("message %s not registered", msgType)
 	}
 
 	// data
@@ -178,10 +199,15 @@ func (p *Processor) Marshal(msg any) ([][]byte, error) {
 // Range goroutine safe
 func (p *Processor) Range(f func(id uint16, name string)) {
 	for id, i := range p.msgInfo {
-		f(id, i.msgType.Elem().Name())
+		f(id, i.name())
 	}
 }
 
 func (p *Processor) GetMsgId(msg any) uint16 {
 	return p.msgID[msg.(reflect.Type)]
 }
+
+// MsgId of the raw message.
+func (m MsgRaw) MsgId() uint16 {
+	return m.msgID
+}
@@ -0,0 +1,178 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/util"
+)
+
+// Rpcedq has a name hashing to network.MSG_ID_RPC.
+type Rpcedq struct{ N int }
+
+type Hello struct{ Name string }
+
+type Bye struct{ Name string }
+
+// fatal run f and get the message of the log.Fatal it calls, "" if it calls none.
+func fatal(f func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprint(r)
+		}
+	}()
+	f()
+	return ""
+}
+
+func TestRpcIdHash(t *testing.T) {
+	if util.StringHash("Rpcedq") != network.MSG_ID_RPC {
+		t.Fatal("Rpcedq doesn't hash to the rpc id")
+	}
+	p := NewProcessor()
+	p.Register(&Rpcedq{})
+	if id := p.GetMsgId(reflect.TypeOf(&Rpcedq{})); id != network.MSG_ID_RPC-1 || id != network.HashMsgId("Rpcedq") {
+		t.Fatalf("id %#x of a name hashing to the rpc id", id)
+	}
+	data, err := p.Marshal(&Rpcedq{N: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.Unmarshal(bytes.Join(data, nil))
+	if err != nil || msg.(*Rpcedq).N != 7 {
+		t.Fatalf("unmarshal %v, %v", msg, err)
+	}
+
+	if msg := fatal(func() { p.RegisterWithID(network.MSG_ID_RPC, &Hello{}) }); msg == "" {
+		t.Fatal("message registered with the rpc id")
+	}
+	if msg := fatal(func() { p.SetRawHandler(network.MSG_ID_RPC, nil) }); msg == "" {
+		t.Fatal("raw handler set for the rpc id")
+	}
+}
+
+func TestRegisterCollision(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		register func(p *Processor)
+		fatal    string // in the message of the log.Fatal, "" for none.
+	}{
+		{"hashed ids", func(p *Processor) {
+			p.Register(&Hello{})
+			p.Register(&Bye{})
+		}, ""},
+		{"explicit ids", func(p *Processor) {
+			p.RegisterWithID(7, &Hello{})
+			p.RegisterWithID(7, &Bye{})
+		}, "id 7 collides with Hello"},
+		{"explicit id on a hashed id", func(p *Processor) {
+			p.Register(&Hello{})
+			p.RegisterWithID(network.HashMsgId("Hello"), &Bye{})
+		}, "collides with Hello"},
+		{"hashed id on an explicit id", func(p *Processor) {
+			p.RegisterWithID(network.HashMsgId("Bye"), &Hello{})
+			p.Register(&Bye{})
+		}, "collides with Hello"},
+		{"registered twice", func(p *Processor) {
+			p.Register(&Hello{})
+			p.RegisterWithID(7, &Hello{})
+		}, "already registered"},
+		{"raw id taken", func(p *Processor) {
+			p.RegisterWithID(7, &Hello{})
+			p.SetRawHandler(7, nil)
+		}, "already registered by Hello"},
+	} {
+		msg := fatal(func() { tc.register(NewProcessor()) })
+		if tc.fatal == "" && msg != "" || !strings.Contains(msg, tc.fatal) {
+			t.Fatalf("%s: fatal %q, want %q", tc.name, msg, tc.fatal)
+		}
+	}
+}
+
+func TestRegisterWithID(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		id   uint16
+	}{
+		{"low id", 1},
+		{"high id", 0xFFFE},
+		{"hash of another name", network.HashMsgId("Bye")},
+	} {
+		p := NewProcessor()
+		p.RegisterWithID(tc.id, &Hello{})
+		if id := p.GetMsgId(reflect.TypeOf(&Hello{})); id != tc.id {
+			t.Fatalf("%s: id %v, want %v", tc.name, id, tc.id)
+		}
+		data, err := p.Marshal(&Hello{Name: "nemo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := p.Unmarshal(bytes.Join(data, nil))
+		if err != nil || msg.(*Hello).Name != "nemo" {
+			t.Fatalf("%s: unmarshal %v, %v", tc.name, msg, err)
+		}
+		// the hashed id is free.
+		if tc.id != network.HashMsgId("Hello") {
+			if _, err := p.Unmarshal([]byte(fmt.Sprintf(`{"%d":{}}`, network.HashMsgId("Hello")))); err == nil {
+				t.Fatalf("%s: hashed id of a message registered with an id", tc.name)
+			}
+		}
+	}
+}
+
+func TestMsgTable(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		register func(p *Processor)
+		want     []network.MsgEntry
+	}{
+		{"empty", func(p *Processor) {}, nil},
+		{"hashed ids", func(p *Processor) {
+			p.Register(&Hello{})
+			p.Register(&Bye{})
+		}, []network.MsgEntry{{Id: network.HashMsgId("Hello"), Name: "Hello"}, {Id: network.HashMsgId("Bye"), Name: "Bye"}}},
+		{"explicit and raw ids", func(p *Processor) {
+			p.RegisterWithID(9, &Hello{})
+			p.SetRawHandler(3, nil)
+		}, []network.MsgEntry{{Id: 3}, {Id: 9, Name: "Hello"}}},
+	} {
+		p := NewProcessor()
+		tc.register(p)
+		table := network.MsgTable(p)
+		want := append([]network.MsgEntry(nil), tc.want...)
+		sort.Slice(want, func(i, j int) bool { return want[i].Id < want[j].Id })
+		if len(table) != len(want) || len(want) > 0 && !reflect.DeepEqual(table, want) {
+			t.Fatalf("%s: table %v, want %v", tc.name, table, want)
+		}
+
+		var buf bytes.Buffer
+		if err := network.ExportMsgTable(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+		var exported []network.MsgEntry
+		if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(exported) != len(table) || len(table) > 0 && !reflect.DeepEqual(exported, table) {
+			t.Fatalf("%s: exported %v, table %v", tc.name, exported, table)
+		}
+
+		buf.Reset()
+		if err := network.DumpMsgTable(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+		var dump strings.Builder
+		for _, e := range table {
+			fmt.Fprintf(&dump, "%5d %s\n", e.Id, e.Name)
+		}
+		if buf.String() != dump.String() {
+			t.Fatalf("%s: dump %q, want %q", tc.name, buf.String(), dump.String())
+		}
+	}
+}
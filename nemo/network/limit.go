@@ -0,0 +1,140 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// -------------------------------------------------------------------------------------
+// Per-IP limits.
+//
+// A server with an IPLimiter refuses a new conn from a banned ip, or from an ip which
+// already has MaxConnPerIP conns. The UDP peers are counted by agent.
+
+// IPLimiter counts the conns of each ip and keeps the ban list, goroutine safe. It
+// can be shared by several servers. A nil limiter limits nothing.
+type IPLimiter struct {
+	mu    sync.Mutex
+	max   int
+	conns map[string]int
+	bans  map[string]time.Time // ip to the end of its ban.
+}
+
+// NewIPLimiter get a limiter of maxConnPerIP conns for each ip, 0 for no limit.
+func NewIPLimiter(maxConnPerIP int) *IPLimiter {
+	return &IPLimiter{
+		max:   maxConnPerIP,
+		conns: make(map[string]int),
+		bans:  make(map[string]time.Time),
+	}
+}
+
+// SetMaxConnPerIP change the max conns of an ip, the conns over it are kept.
+func (l *IPLimiter) SetMaxConnPerIP(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = n
+}
+
+// acquire count a new conn of ip, false if it is refused.
+func (l *IPLimiter) acquire(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bannedLocked(ip, time.Now()) {
+		return false
+	}
+	if l.max > 0 && l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// release a conn of ip counted by acquire.
+func (l *IPLimiter) release(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+	} else {
+		l.conns[ip]--
+	}
+}
+
+// Ban refuse the new conns of ip for d, the conns already open are kept.
+func (l *IPLimiter) Ban(ip string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans[ip] = time.Now().Add(d)
+}
+
+// Unban lift the ban of ip, false if it is not banned.
+func (l *IPLimiter) Unban(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ok := l.bannedLocked(ip, time.Now())
+	delete(l.bans, ip)
+	return ok
+}
+
+// Banned tell whether ip is banned.
+func (l *IPLimiter) Banned(ip string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bannedLocked(ip, time.Now())
+}
+
+// Bans get the banned ips and the end of their ban, the ended ones are dropped.
+func (l *IPLimiter) Bans() map[string]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bans := make(map[string]time.Time, len(l.bans))
+	for ip := range l.bans {
+		if l.bannedLocked(ip, now) {
+			bans[ip] = l.bans[ip]
+		}
+	}
+	return bans
+}
+
+func (l *IPLimiter) bannedLocked(ip string, now time.Time) bool {
+	end, ok := l.bans[ip]
+	if ok && !now.Before(end) {
+		delete(l.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// IPOf get the ip of addr.
+func IPOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	return hostIP(addr.String())
+}
+
+// hostIP get the ip of the address hostport, hostport itself if it has no port.
+func hostIP(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
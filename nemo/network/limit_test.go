@@ -0,0 +1,80 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPLimiter(t *testing.T) {
+	l := NewIPLimiter(2)
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatal("conns under the max refused")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Fatal("conn over the max accepted")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Fatal("conn of another ip refused")
+	}
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.1") {
+		t.Fatal("released conn not counted")
+	}
+
+	l.Ban("10.0.0.3", time.Hour)
+	l.Ban("10.0.0.4", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if !l.Banned("10.0.0.3") || l.acquire("10.0.0.3") {
+		t.Fatal("banned ip accepted")
+	}
+	if l.Banned("10.0.0.4") {
+		t.Fatal("ban not ended")
+	}
+	if bans := l.Bans(); len(bans) != 1 {
+		t.Fatalf("bans %v", bans)
+	}
+	if !l.Unban("10.0.0.3") || l.Unban("10.0.0.3") || !l.acquire("10.0.0.3") {
+		t.Fatal("unbanned ip refused")
+	}
+
+	var none *IPLimiter
+	if !none.acquire("10.0.0.1") || none.Banned("10.0.0.1") {
+		t.Fatal("nil limiter limits")
+	}
+	none.release("10.0.0.1")
+}
+
+func TestIPLimiterTCP(t *testing.T) {
+	server := &TCPServer{
+		Addr:       "127.0.0.1:0",
+		MaxConnNum: 10,
+		MaxMsgLen:  4096,
+		IPLimiter:  NewIPLimiter(1),
+		NewAgent: func(conn Conn) Agent {
+			return newTestAgent(conn, true)
+		},
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	addr := server.ln.Addr().String()
+
+	first := startTestClient(t, &TCPClient{Addr: addr, MaxMsgLen: 4096})
+	if err := first.conn.WriteMsg([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	first.recv(t)
+
+	// the second conn of the ip is closed by the server.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn over the max of its ip accepted")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("conn over the max of its ip not closed")
+	}
+}
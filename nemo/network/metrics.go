@@ -0,0 +1,42 @@
+package network
+
+import (
+	"github.com/lircstar/nemo/sys/metrics"
+)
+
+// transport label values.
+const (
+	transportTCP = "tcp"
+	transportWS  = "ws"
+	transportUDP = "udp"
+)
+
+var (
+	metricConns = metrics.NewGauge("nemo_connections",
+		"Connections currently open.", "transport")
+	metricAccepted = metrics.NewCounter("nemo_connections_accepted_total",
+		"Connections accepted.", "transport")
+	metricRejected = metrics.NewCounter("nemo_connections_rejected_total",
+		"Connections rejected because MaxConnNum is reached.", "transport")
+	metricChanFull = metrics.NewCounter("nemo_write_channel_full_total",
+		"Connections closed because their write channel is full.", "transport")
+	metricDropped = metrics.NewCounter("nemo_write_dropped_total",
+		"Messages dropped by the backpressure policy of their connection.", "transport")
+	metricWriteFill = metrics.NewHistogram("nemo_write_channel_fill_ratio",
+		"Fill ratio of the write channel when a message is queued.",
+		[]float64{0, .1, .25, .5, .75, .9, 1}, "transport")
+	metricWrites = metrics.NewCounter("nemo_write_calls_total",
+		"Writes of the write goroutines, each one a single vectored write.", "transport")
+	metricWriteBatch = metrics.NewHistogram("nemo_write_batch_messages",
+		"Messages written by a single write.",
+		[]float64{1, 2, 4, 8, 16, 32, 64, 128}, "transport")
+	metricRetransmits = metrics.NewCounter("nemo_retransmits_total",
+		"Segments sent again by the reliable udp layer.", "transport")
+)
+
+// observeWriteFill record the fill ratio of a write channel of n of c.
+func observeWriteFill(transport string, n, c int) {
+	if c > 0 {
+		metricWriteFill.Observe(float64(n)/float64(c), transport)
+	}
+}
@@ -0,0 +1,45 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MsgEntry is one row of the message id table of a processor, Name is empty for raw
+// messages.
+type MsgEntry struct {
+	Id   uint16 `json:"id"`
+	Name string `json:"name"`
+}
+
+// MsgTable get the message id table of p sorted by id.
+func MsgTable(p Processor) []MsgEntry {
+	var table []MsgEntry
+	p.Range(func(id uint16, name string) {
+		table = append(table, MsgEntry{id, name})
+	})
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Id < table[j].Id
+	})
+	return table
+}
+
+// DumpMsgTable write the message id table of p as text, one "id name" per line.
+func DumpMsgTable(w io.Writer, p Processor) error {
+	for _, e := range MsgTable(p) {
+		if _, err := fmt.Fprintf(w, "%5d %s\n", e.Id, e.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportMsgTable write the message id table of p as json so clients can stay in
+// sync with the server.
+func ExportMsgTable(w io.Writer, p Processor) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(MsgTable(p))
+}
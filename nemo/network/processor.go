@@ -1,7 +1,24 @@
 package network
 
+import "github.com/lircstar/nemo/sys/util"
+
 type MsgHandler func(Agent, []any)
 
+// MSG_ID_RPC marks the rpc and heartbeat frames, processors must not give it to any
+// message. A message name hashing to it takes MSG_ID_RPC-1, see HashMsgId, and
+// RegisterWithID of it is fatal.
+const MSG_ID_RPC uint16 = 0xFFFF
+
+// HashMsgId get the id of the messages registered by their name. The names hashing to
+// MSG_ID_RPC take MSG_ID_RPC-1, the clients hashing the names must do the same.
+func HashMsgId(name string) uint16 {
+	id := util.StringHash(name)
+	if id == MSG_ID_RPC {
+		id--
+	}
+	return id
+}
+
 type Processor interface {
 
 	// Route must goroutine safe
@@ -14,6 +31,9 @@ type Processor interface {
 	// Register register message into processor.
 	Register(msg any)
 
+	// RegisterWithID register message into processor with an explicit id.
+	RegisterWithID(id uint16, msg any)
+
 	// SetHandler set message handling function
 	SetHandler(msg any, msgHandler MsgHandler)
 
@@ -11,7 +11,6 @@ import (
 
 	"github.com/lircstar/nemo/nemo/network"
 	"github.com/lircstar/nemo/sys/log"
-	"github.com/lircstar/nemo/sys/util"
 )
 
 // -------------------------
@@ -19,16 +18,23 @@ import (
 // -------------------------
 type Processor struct {
 	littleEndian bool
+	fullNameID   bool
 	msgInfo      map[uint16]*MsgInfo
 	msgID        map[reflect.Type]uint16
 }
 
 type MsgInfo struct {
 	msgType       reflect.Type
+	msgName       string
 	msgHandler    network.MsgHandler
 	msgRawHandler network.MsgHandler
 }
 
+// name of the message, empty for raw message.
+func (i *MsgInfo) name() string {
+	return i.msgName
+}
+
 type MsgRaw struct {
 	msgID      uint16
 	msgRawData []byte
@@ -42,27 +48,74 @@ func NewProcessor() *Processor {
 	return p
 }
 
+// SetFullNameID hash the full protobuf name (package.Message) of the messages for their
+// id instead of their Go type name, so messages of the same name in two packages don't
+// collide. It changes the id of every message, the clients must hash the same name,
+// see network.MsgTable. Call it before Register.
+func (p *Processor) SetFullNameID(on bool) {
+	if len(p.msgID) > 0 {
+		log.Fatal("SetFullNameID must be called before Register")
+	}
+	p.fullNameID = on
+}
+
 // Register It's dangerous to call the method on routing or marshaling (unmarshaling)
+// The id is the hash by network.HashMsgId of the Go type name, or of the full protobuf
+// name with SetFullNameID. It is fatal when it collides with another message, use RegisterWithID
+// for such message.
 func (p *Processor) Register(msg any) {
+	name := p.nameOf(msg)
+	if name == "" {
+		log.Fatalf("unnamed protobuf message %v", reflect.TypeOf(msg))
+	}
+	p.register(network.HashMsgId(name), msg)
+}
+
+// nameOf get the name of msg hashed for its id.
+func (p *Processor) nameOf(msg any) string {
+	pm, ok := msg.(proto.Message)
+	if !ok {
+		log.Fatalf("message %s is not a protobuf message", reflect.TypeOf(msg))
+	}
+	if p.fullNameID {
+		return string(pm.ProtoReflect().Descriptor().FullName())
+	}
+	msgType := reflect.TypeOf(msg)
+	if msgType.Kind() != reflect.Ptr {
+		log.Fatalf("protobuf message pointer required")
+	}
+	return msgType.Elem().Name()
+}
+
+// RegisterWithID register msg with an explicit id, such as the value of a message id
+// enum shared with clients.
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) RegisterWithID(id uint16, msg any) {
+	p.register(id, msg)
+}
+
+func (p *Processor) register(id uint16, msg any) {
 	msgType := reflect.TypeOf(msg)
 	if msgType == nil || msgType.Kind() != reflect.Ptr {
 		log.Fatalf("protobuf message pointer required")
 	}
+	name := p.nameOf(msg)
 	if _, ok := p.msgID[msgType]; ok {
 		log.Fatalf("message %s is already registered", msgType)
 	}
 	if len(p.msgInfo) >= math.MaxUint16 {
 		log.Fatalf("too many protobuf messages (max = %v)", math.MaxUint16)
 	}
-
-	name := msgType.Elem().Name()
-	if name == "" {
-		log.Fatalf("unnamed json message %v ", name)
+	if id == network.MSG_ID_RPC {
+		log.Fatalf("message %s takes the rpc id %v", msgType, id)
+	}
+	if i, ok := p.msgInfo[id]; ok {
+		log.Fatalf("message %s id %v collides with %s", msgType, id, i.name())
 	}
 
-	id := util.StringHash(fmt.Sprintf("%v", name))
 	i := new(MsgInfo)
 	i.msgType = msgType
+	i.msgName = name
 	p.msgInfo[id] = i
 	p.msgID[msgType] = id
 }
@@ -81,8 +134,11 @@ func (p *Processor) SetHandler(msg any, msgHandler network.MsgHandler) {
 
 // SetRawHandler It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) SetRawHandler(id uint16, msgRawHandler network.MsgHandler) {
-	if p.msgInfo[id] != nil {
-		log.Fatalf("message %d is already registered", id)
+	if id == network.MSG_ID_RPC {
+		log.Fatalf("message %d is reserved for rpc", id)
+	}
+	if i, ok := p.msgInfo[id]; ok {
+		log.Fatalf("message %d is already registered by %s", id, i.name())
 	}
 	p.msgInfo[id] = new(MsgInfo)
 	p.msgInfo[id].msgRawHandler = msgRawHandler
@@ -169,10 +225,15 @@ func (p *Processor) Marshal(msg any) ([][]byte, error) {
 // Range goroutine safe
 func (p *Processor) Range(f func(id uint16, name string)) {
 	for id, i := range p.msgInfo {
-		f(id, i.msgType.Elem().Name())
+		f(id, i.name())
 	}
 }
 
 func (p *Processor) GetMsgId(msg any) uint16 {
 	return p.msgID[msg.(reflect.Type)]
 }
+
+// MsgId of the raw message.
+func (m MsgRaw) MsgId() uint16 {
+	return m.msgID
+}
@@ -37,12 +37,19 @@ func NewProcessor() *Processor {
 func (p *Processor) Register(msg any) {
 }
 
+// RegisterWithID It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) RegisterWithID(id uint16, msg any) {
+}
+
 // SetHandler It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) SetHandler(msg any, msgHandler network.MsgHandler) {
 	id, ok := msg.(uint16)
 	if !ok || id == 0 {
 		log.Fatalf("message %v not registered", msg)
 	}
+	if id == network.MSG_ID_RPC {
+		log.Fatalf("message %d is reserved for rpc", id)
+	}
 	if p.msgInfo[id] != nil {
 		log.Fatalf("message %d is already registered", id)
 	}
@@ -114,3 +121,7 @@ func (p *Processor) Range(f func(id uint16, name string)) {
 func (p *Processor) GetMsgId(msg any) uint16 {
 	return msg.(Message).Id
 }
+
+func (m Message) MsgId() uint16 {
+	return m.Id
+}
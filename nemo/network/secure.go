@@ -0,0 +1,269 @@
+package network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// -------------------------------------------------------------------------------------
+// Encrypted session.
+//
+// A client opens the session by the first message, then the server answers with its
+// key, signed if it has a private key:
+//
+//	| secureMagic | secureHello  | client x25519 key |
+//	| secureMagic | secureAnswer | server x25519 key | ed25519 signature |
+//
+// Both derive a key for each direction from the x25519 secret, and every later message
+// is sealed by ChaCha20-Poly1305:
+//
+//	| seq | ciphertext | tag |
+//
+// where seq is the nonce of the message, starting at 1 in each direction. A message
+// whose seq was already seen, or is older than the replay window, is refused.
+
+const (
+	secureHello  = 1
+	secureAnswer = 2
+
+	secureKeyLen   = 32
+	secureSeqLen   = 8
+	secureOverhead = secureSeqLen + chacha20poly1305.Overhead
+
+	// replayWindowLen is the count of seqs behind the newest one still accepted, so
+	// the datagrams reordered by the network are not lost.
+	replayWindowLen = 64
+)
+
+// secureHandshakeTimeout bounds the handshake of a session.
+const secureHandshakeTimeout = 10 * time.Second
+
+var secureMagic = []byte("\xffnemo-s")
+
+var (
+	errSecureHandshake = errors.New("secure handshake failed")
+	errSecureAuth      = errors.New("secure message not authentic")
+	errSecureReplay    = errors.New("secure message replayed")
+)
+
+// SecureConfig enables the encrypted session of a server or a client.
+type SecureConfig struct {
+	// PrivateKey signs the answer of a server, so the clients can authenticate it.
+	PrivateKey ed25519.PrivateKey
+	// PeerKey is the public key of the server a client accepts, any server if it is
+	// nil.
+	PeerKey ed25519.PublicKey
+}
+
+// NewSecureConfig get the config of hex keys, privateKey is the 32 bytes ed25519 seed
+// of a server and peerKey the 32 bytes ed25519 public key of the server a client
+// accepts. Both can be empty.
+func NewSecureConfig(privateKey, peerKey string) (*SecureConfig, error) {
+	c := new(SecureConfig)
+	if privateKey != "" {
+		seed, err := hex.DecodeString(privateKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("secure: private key must be a hex ed25519 seed")
+		}
+		c.PrivateKey = ed25519.NewKeyFromSeed(seed)
+	}
+	if peerKey != "" {
+		pub, err := hex.DecodeString(peerKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("secure: peer key must be a hex ed25519 public key")
+		}
+		c.PeerKey = pub
+	}
+	return c, nil
+}
+
+// clientHello get a new key of a client and its hello message.
+func (c *SecureConfig) clientHello() (*ecdh.PrivateKey, []byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := append(bytes.Clone(secureMagic), secureHello)
+	return key, append(msg, key.PublicKey().Bytes()...), nil
+}
+
+// isSecureHello tell whether data is the hello message of a client.
+func isSecureHello(data []byte) bool {
+	return len(data) == len(secureMagic)+1+secureKeyLen &&
+		bytes.HasPrefix(data, secureMagic) && data[len(secureMagic)] == secureHello
+}
+
+// serverAnswer open the session of a server by the hello of a client, and get the
+// answer to it.
+func (c *SecureConfig) serverAnswer(hello []byte) (*secureSession, []byte, error) {
+	if !isSecureHello(hello) {
+		return nil, nil, errSecureHandshake
+	}
+	clientPub, err := ecdh.X25519().NewPublicKey(hello[len(secureMagic)+1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := key.ECDH(clientPub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverPub := key.PublicKey().Bytes()
+	msg := append(bytes.Clone(secureMagic), secureAnswer)
+	msg = append(msg, serverPub...)
+	if c.PrivateKey != nil {
+		msg = append(msg, ed25519.Sign(c.PrivateKey, transcript(clientPub.Bytes(), serverPub))...)
+	}
+
+	s, err := newSecureSession(secret, clientPub.Bytes(), serverPub, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, msg, nil
+}
+
+// clientFinish open the session of a client by the answer of the server.
+func (c *SecureConfig) clientFinish(key *ecdh.PrivateKey, answer []byte) (*secureSession, error) {
+	head := len(secureMagic) + 1
+	if len(answer) < head+secureKeyLen || !bytes.HasPrefix(answer, secureMagic) || answer[head-1] != secureAnswer {
+		return nil, errSecureHandshake
+	}
+	serverPub := answer[head : head+secureKeyLen]
+	clientPub := key.PublicKey().Bytes()
+	if c.PeerKey != nil {
+		sig := answer[head+secureKeyLen:]
+		if !ed25519.Verify(c.PeerKey, transcript(clientPub, serverPub), sig) {
+			return nil, errors.New("secure handshake: server not authentic")
+		}
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(serverPub)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := key.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	return newSecureSession(secret, clientPub, serverPub, true)
+}
+
+// transcript get the handshake data signed by the server.
+func transcript(clientPub, serverPub []byte) []byte {
+	data := append([]byte("nemo-secure"), clientPub...)
+	return append(data, serverPub...)
+}
+
+//-------------------------------------------------------------------------------------
+// session.
+
+// secureSession seals and opens the messages of a connection, goroutine safe.
+type secureSession struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq atomic.Uint64
+	replay  replayWindow
+}
+
+func newSecureSession(secret, clientPub, serverPub []byte, client bool) (*secureSession, error) {
+	salt := append(bytes.Clone(clientPub), serverPub...)
+	kdf := hkdf.New(sha256.New, secret, salt, []byte("nemo-secure keys"))
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, err
+	}
+
+	// the first key is for the messages of the client, the second for the server.
+	c2s, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &secureSession{send: c2s, recv: s2c}, nil
+	}
+	return &secureSession{send: s2c, recv: c2s}, nil
+}
+
+// seal append the sealed plain to dst.
+func (s *secureSession) seal(dst, plain []byte) []byte {
+	seq := s.sendSeq.Add(1)
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+
+	dst = binary.BigEndian.AppendUint64(dst, seq)
+	return s.send.Seal(dst, nonce[:], plain, nil)
+}
+
+// open get the plain of a sealed message, decrypted in place at the start of data so
+// the buffer of data keeps holding it.
+func (s *secureSession) open(data []byte) ([]byte, error) {
+	if len(data) < secureOverhead {
+		return nil, errSecureAuth
+	}
+	seq := binary.BigEndian.Uint64(data)
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+
+	plain, err := s.recv.Open(data[secureSeqLen:secureSeqLen], nonce[:], data[secureSeqLen:], nil)
+	if err != nil {
+		return nil, errSecureAuth
+	}
+	// only authentic seqs move the window.
+	if !s.replay.accept(seq) {
+		return nil, errSecureReplay
+	}
+	return data[:copy(data, plain)], nil
+}
+
+// replayWindow remembers the newest seq and the seen ones behind it.
+type replayWindow struct {
+	mu     sync.Mutex
+	newest uint64
+	seen   uint64 // bit i is set if newest-i is seen.
+}
+
+func (w *replayWindow) accept(seq uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq == 0 {
+		return false
+	}
+	if seq > w.newest {
+		if shift := seq - w.newest; shift < replayWindowLen {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.newest = seq
+		return true
+	}
+	diff := w.newest - seq
+	if diff >= replayWindowLen || w.seen&(1<<diff) != 0 {
+		return false
+	}
+	w.seen |= 1 << diff
+	return true
+}
@@ -0,0 +1,281 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestSecure get the configs of a server with a new key and of its client.
+func newTestSecure(t *testing.T) (server, client *SecureConfig) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewSecureConfig(hex.EncodeToString(priv.Seed()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewSecureConfig("", hex.EncodeToString(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+// openTestSessions run the handshake between the configs.
+func openTestSessions(t *testing.T, server, client *SecureConfig) (s, c *secureSession, err error) {
+	t.Helper()
+	key, hello, err := client.clientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, answer, err := server.serverAnswer(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = client.clientFinish(key, answer)
+	return s, c, err
+}
+
+func TestSecureSession(t *testing.T) {
+	serverConfig, clientConfig := newTestSecure(t)
+	s, c, err := openTestSessions(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both directions.
+	for _, pair := range [][2]*secureSession{{c, s}, {s, c}} {
+		sealed := pair[0].seal(nil, []byte("move 1 2"))
+		if bytes.Contains(sealed, []byte("move")) {
+			t.Fatal("plain text on the wire")
+		}
+		plain, err := pair[1].open(sealed)
+		if err != nil || string(plain) != "move 1 2" {
+			t.Fatalf("open %q, %v", plain, err)
+		}
+	}
+
+	// tampered, replayed, reordered and too old messages.
+	m1 := c.seal(nil, []byte("one"))
+	m2 := c.seal(nil, []byte("two"))
+	tampered := bytes.Clone(m1)
+	tampered[len(tampered)-1] ^= 1
+	if _, err = s.open(tampered); !errors.Is(err, errSecureAuth) {
+		t.Fatalf("tampered message: %v", err)
+	}
+	if _, err = s.open(m2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.open(bytes.Clone(m1)); err != nil {
+		t.Fatalf("reordered message: %v", err)
+	}
+	if _, err = s.open(m1); !errors.Is(err, errSecureReplay) {
+		t.Fatalf("replayed message: %v", err)
+	}
+	old := c.seal(nil, []byte("old"))
+	for i := 0; i < replayWindowLen; i++ {
+		if _, err = s.open(c.seal(nil, []byte("new"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.open(old); !errors.Is(err, errSecureReplay) {
+		t.Fatalf("message older than the window: %v", err)
+	}
+}
+
+func TestSecurePeerKey(t *testing.T) {
+	serverConfig, _ := newTestSecure(t)
+	_, otherClient := newTestSecure(t)
+	if _, _, err := openTestSessions(t, serverConfig, otherClient); err == nil {
+		t.Fatal("server of another key accepted")
+	}
+	// without a peer key any server is accepted.
+	if _, _, err := openTestSessions(t, serverConfig, &SecureConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSecureConfig("abcd", ""); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
+
+func TestSecureTCP(t *testing.T) {
+	serverConfig, clientConfig := newTestSecure(t)
+	agents := make(chan *testAgent, 2)
+	server := &TCPServer{
+		Addr:              "127.0.0.1:0",
+		MaxConnNum:        10,
+		MaxMsgLen:         32 * 1024,
+		Secure:            serverConfig,
+		Compression:       []string{CodecSnappy},
+		CompressThreshold: 64,
+		NewAgent: func(conn Conn) Agent {
+			a := newTestAgent(conn, true)
+			agents <- a
+			return a
+		},
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	a := startTestClient(t, &TCPClient{
+		Addr:        server.ln.Addr().String(),
+		MaxMsgLen:   32 * 1024,
+		Secure:      clientConfig,
+		Compression: []string{CodecSnappy},
+	})
+	big := bytes.Repeat([]byte("inventory "), 1000)
+	for _, msg := range [][]byte{[]byte("hello"), big} {
+		if err := a.conn.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+		if data := a.recv(t); !bytes.Equal(data, msg) {
+			t.Fatalf("echo of %d bytes is %d bytes", len(msg), len(data))
+		}
+	}
+	if a.conn.(*TCPConn).codecId.Load() == 0 {
+		t.Fatal("compression not negotiated in the session")
+	}
+
+	<-agents
+
+	// a plain client is dropped, its agent is closed.
+	w := dialWire(t, server)
+	w.write([]byte("hello"))
+	if _, err := w.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("plain client answered")
+	}
+	select {
+	case <-(<-agents).closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("agent of a failed handshake not closed")
+	}
+}
+
+// freeUDPAddr get a local udp address nobody listens to.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func startSecureUDPServer(t *testing.T, config *SecureConfig) string {
+	t.Helper()
+	addr := freeUDPAddr(t)
+	server := &UDPServer{
+		MaxConnNum: 10,
+		MinMsgLen:  1,
+		MaxMsgLen:  4096,
+		Secure:     config,
+		NewAgent: func(conn Conn) Agent {
+			return newTestAgent(conn, true)
+		},
+	}
+	server.Start(addr)
+	t.Cleanup(server.Close)
+	return addr
+}
+
+func TestSecureUDP(t *testing.T) {
+	serverConfig, clientConfig := newTestSecure(t)
+	addr := startSecureUDPServer(t, serverConfig)
+
+	agents := make(chan *testAgent, 1)
+	client := &UDPClient{
+		Addr:      addr,
+		MinMsgLen: 1,
+		MaxMsgLen: 4096,
+		TimeOut:   60,
+		Secure:    clientConfig,
+		NewAgent: func(conn Conn) Agent {
+			a := newTestAgent(conn, false)
+			agents <- a
+			return a
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	var a *testAgent
+	select {
+	case a = <-agents:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not connected")
+	}
+	if err := a.conn.WriteMsg([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data := a.recv(t); string(data) != "hello" {
+		t.Fatalf("echo %q", data)
+	}
+}
+
+// TestSecureUDPWire check a lost answer and a replayed datagram on the wire.
+func TestSecureUDPWire(t *testing.T) {
+	serverConfig, clientConfig := newTestSecure(t)
+	addr := startSecureUDPServer(t, serverConfig)
+
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	read := func(timeout time.Duration) ([]byte, error) {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		return bytes.Clone(buf[:n]), err
+	}
+
+	// a plain datagram is not answered.
+	_, _ = conn.Write([]byte("hello"))
+	if _, err = read(200 * time.Millisecond); err == nil {
+		t.Fatal("plain datagram answered")
+	}
+
+	// the hello sent again gets the same answer.
+	key, hello, _ := clientConfig.clientHello()
+	_, _ = conn.Write(hello)
+	first, err := read(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write(hello)
+	second, err := read(time.Second)
+	if err != nil || !bytes.Equal(first, second) {
+		t.Fatalf("answer changed, %v", err)
+	}
+	session, err := clientConfig.clientFinish(key, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := session.seal(nil, []byte("hello"))
+	_, _ = conn.Write(sealed)
+	echo, err := read(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := session.open(echo); err != nil || string(plain) != "hello" {
+		t.Fatalf("echo %q, %v", plain, err)
+	}
+
+	// the replayed datagram is dropped.
+	_, _ = conn.Write(sealed)
+	if _, err = read(200 * time.Millisecond); err == nil {
+		t.Fatal("replayed datagram answered")
+	}
+}
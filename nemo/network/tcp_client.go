@@ -1,7 +1,9 @@
 package network
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/lircstar/nemo/sys/log"
@@ -12,11 +14,32 @@ type TCPClient struct {
 	ConnectInterval time.Duration
 	PendingWriteNum int
 	AutoReconnect   bool
-	agent           Agent
+	reconnect       reconnectOption
+	agent           clientAgent
 	NewAgent        func(Conn) Agent
 	conn            net.Conn
-	closeFlag       bool
-	connected       bool
+	closeFlag       atomic.Bool
+	connected       atomic.Bool
+
+	// tls, the client dials over tls if TLS is set or any file is. The server is
+	// verified by CAFile, or by the system pool if it is empty, and CertFile is sent
+	// to the servers requiring client certificates. The files are loaded again when
+	// they change.
+	TLS                bool
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	ServerName         string // host of Addr if it is empty.
+	InsecureSkipVerify bool
+	tlsFiles           *tlsFiles
+
+	// encrypted session opened on connect, nil for plain messages.
+	Secure *SecureConfig
+
+	// compression, the codecs accepted in the order of preference, messages of at
+	// least CompressThreshold bytes are compressed by the codec negotiated.
+	Compression       []string
+	CompressThreshold int
 
 	// msg parser
 	LenMsgLen    int
@@ -37,6 +60,7 @@ func (client *TCPClient) init() {
 		client.ConnectInterval = 3 * time.Second
 		log.Warnf("invalid ConnectInterval, reset to %v", client.ConnectInterval)
 	}
+	client.reconnect.set(client.AutoReconnect, client.ConnectInterval)
 
 	if client.PendingWriteNum <= 0 {
 		client.PendingWriteNum = 100
@@ -49,24 +73,36 @@ func (client *TCPClient) init() {
 		log.Fatal("client is running")
 	}
 
-	client.closeFlag = false
+	client.closeFlag.Store(false)
+
+	if client.TLS || client.CertFile != "" || client.KeyFile != "" || client.CAFile != "" {
+		files, err := newTLSFiles(client.CertFile, client.KeyFile, client.CAFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		client.tlsFiles = files
+	}
 
 	// msg parser
 	msgParser := newTcpMsgParser()
 	msgParser.SetMsgLen(client.LenMsgLen, client.MinMsgLen, client.MaxMsgLen)
 	msgParser.SetByteOrder(client.LittleEndian)
+	msgParser.SetSecure(client.Secure)
+	if err := msgParser.SetCompression(client.Compression, client.CompressThreshold); err != nil {
+		log.Fatalf("%v", err)
+	}
 	client.msgParser = msgParser
 }
 
 func (client *TCPClient) dial() net.Conn {
 	for {
-		conn, err := net.Dial("tcp", client.Addr)
-		if err == nil || client.closeFlag {
+		conn, err := dialTCP(client.Addr, client.tlsFiles, client.ServerName, client.InsecureSkipVerify)
+		if err == nil || client.closeFlag.Load() {
 			return conn
 		}
 
-		log.Errorf("connect to %v error: %v", client.Addr, err)
-		time.Sleep(client.ConnectInterval)
+		log.With("addr", client.Addr).Errorf("connect error: %v", err)
+		client.reconnect.wait()
 		continue
 	}
 }
@@ -79,7 +115,7 @@ reconnect:
 		return
 	}
 
-	if client.closeFlag {
+	if client.closeFlag.Load() {
 		err := conn.Close()
 		if err != nil {
 			return
@@ -90,34 +126,59 @@ reconnect:
 	tcpConn := newTCPConn(client.PendingWriteNum, client.msgParser)
 	tcpConn.bindConn(conn)
 	tcpConn.start()
-	client.connected = true
-	client.agent = client.NewAgent(tcpConn)
-	client.agent.SetType(TYPE_CLIENT_TCP)
-	client.agent.OnConnect()
-	client.agent.Run(nil)
-	client.connected = false
+	if err := client.msgParser.dial(tcpConn); err != nil {
+		log.With("addr", client.Addr).Errorf("handshake error: %v", err)
+		tcpConn.Close()
+		if client.reconnect.auto.Load() {
+			client.reconnect.wait()
+			goto reconnect
+		}
+		return
+	}
+	client.connected.Store(true)
+	agent := client.NewAgent(tcpConn)
+	agent.SetType(TYPE_CLIENT_TCP)
+	client.agent.set(agent)
+	agent.OnConnect()
+	agent.Run(nil)
+	client.connected.Store(false)
 
 	// cleanup
 	tcpConn.Close()
 	conn = nil
 	tcpConn = nil
-	client.agent.OnClose()
-	client.agent = nil
+	agent.OnClose()
+	client.agent.set(nil)
 
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
+	if client.reconnect.auto.Load() && !client.closeFlag.Load() {
+		client.reconnect.wait()
 		goto reconnect
 	}
 }
 
 func (client *TCPClient) Send(msg any) bool {
-	return client.agent.SendMessage(msg)
+	agent := client.agent.get()
+	if agent == nil {
+		return false
+	}
+	return agent.SendMessage(msg)
+}
+
+// Call send an rpc request to the server and wait for the response.
+func (client *TCPClient) Call(ctx context.Context, req any) (any, error) {
+	agent := client.agent.get()
+	if agent == nil {
+		return nil, ErrNotConnected
+	}
+	return agent.Call(ctx, req)
 }
 
+// Close stop reconnecting and close the conn of the client.
 func (client *TCPClient) Close() {
-	client.closeFlag = true
-	_ = client.conn.Close()
-	client.conn = nil
+	client.closeFlag.Store(true)
+	if agent := client.agent.get(); agent != nil {
+		agent.Close()
+	}
 }
 
 func (client *TCPClient) GetType() uint {
@@ -129,9 +190,15 @@ func (client *TCPClient) GetAddress() string {
 }
 
 func (client *TCPClient) GetConnected() bool {
-	return client.connected
+	return client.connected.Load()
 }
 
 func (client *TCPClient) GetAgent() Agent {
-	return client.agent
+	return client.agent.get()
+}
+
+// SetReconnect change AutoReconnect and ConnectInterval while the client runs.
+func (client *TCPClient) SetReconnect(auto bool, interval time.Duration) {
+	client.AutoReconnect = auto
+	client.reconnect.set(auto, interval)
 }
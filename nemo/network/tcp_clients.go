@@ -21,6 +21,26 @@ type TCPClients struct {
 	wg              sync.WaitGroup
 	closeFlag       atomic.Bool
 
+	// tls, the client dials over tls if TLS is set or any file is. The server is
+	// verified by CAFile, or by the system pool if it is empty, and CertFile is sent
+	// to the servers requiring client certificates. The files are loaded again when
+	// they change.
+	TLS                bool
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	ServerName         string // host of Addr if it is empty.
+	InsecureSkipVerify bool
+	tlsFiles           *tlsFiles
+
+	// encrypted session opened on connect, nil for plain messages.
+	Secure *SecureConfig
+
+	// compression, the codecs accepted in the order of preference, messages of at
+	// least CompressThreshold bytes are compressed by the codec negotiated.
+	Compression       []string
+	CompressThreshold int
+
 	// msg parser
 	LenMsgLen    int
 	MinMsgLen    int
@@ -61,21 +81,33 @@ func (client *TCPClients) init() {
 	client.conns = util.NewSafeMap(client.ConnNum)
 	client.closeFlag.Store(false)
 
+	if client.TLS || client.CertFile != "" || client.KeyFile != "" || client.CAFile != "" {
+		files, err := newTLSFiles(client.CertFile, client.KeyFile, client.CAFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		client.tlsFiles = files
+	}
+
 	// msg parser
 	msgParser := newTcpMsgParser()
 	msgParser.SetMsgLen(client.LenMsgLen, client.MinMsgLen, client.MaxMsgLen)
 	msgParser.SetByteOrder(client.LittleEndian)
+	msgParser.SetSecure(client.Secure)
+	if err := msgParser.SetCompression(client.Compression, client.CompressThreshold); err != nil {
+		log.Fatalf("%v", err)
+	}
 	client.msgParser = msgParser
 }
 
 func (client *TCPClients) dial() net.Conn {
 	for {
-		conn, err := net.Dial("tcp", client.Addr)
+		conn, err := dialTCP(client.Addr, client.tlsFiles, client.ServerName, client.InsecureSkipVerify)
 		if err == nil || client.closeFlag.Load() {
 			return conn
 		}
 
-		log.Errorf("connect to %v error: %v", client.Addr, err)
+		log.With("addr", client.Addr).Errorf("connect error: %v", err)
 		time.Sleep(client.ConnectInterval)
 		continue
 	}
@@ -101,6 +133,16 @@ reconnect:
 	tcpConn := newTCPConn(client.PendingWriteNum, client.msgParser)
 	tcpConn.bindConn(conn)
 	tcpConn.start()
+	if err := client.msgParser.dial(tcpConn); err != nil {
+		log.With("addr", client.Addr).Errorf("handshake error: %v", err)
+		tcpConn.Close()
+		client.conns.Delete(conn)
+		if client.AutoReconnect {
+			time.Sleep(client.ConnectInterval)
+			goto reconnect
+		}
+		return
+	}
 	agent := client.NewAgent(tcpConn)
 	agent.SetType(TYPE_CLIENT_TCP)
 	agent.OnConnect()
@@ -128,7 +170,7 @@ func (client *TCPClients) Close() {
 		conn := key.(net.Conn)
 		err := conn.Close()
 		if err != nil {
-			log.Errorf("close connection error: %v", err)
+			log.With("remote", conn.RemoteAddr()).Errorf("close connection error: %v", err)
 		}
 		return true
 	})
@@ -4,19 +4,58 @@ import (
 	"github.com/lircstar/nemo/sys/log"
 	"net"
 	"sync/atomic"
+	"time"
 )
 
+// frame is a message queued for writing, head and body are written by a single
+// vectored write. Both are owned by the conn and given back to the buffer pool once
+// written.
+type frame struct {
+	head []byte
+	body []byte
+	prio int // priority class.
+}
+
+func (f frame) size() int {
+	return len(f.head) + len(f.body)
+}
+
+func (f frame) release() {
+	freeBuffer(f.head)
+	freeBuffer(f.body)
+}
+
 type TCPConn struct {
 	//ConnOption
 	conn      net.Conn
-	writeChan chan []byte
+	queue     writeQueue
+	frames    []frame     // taken by the writer.
+	bufs      net.Buffers // of the frames being written, consumed by the write.
+	vec       [][]byte    // backing of bufs.
 	closeFlag atomic.Bool
 	msgParser *TcpMsgParser
+	agent     Agent
+
+	// the writer waits for a tick of flushTicker before writing, nil to write at once.
+	flushTicker *FlushTicker
+
+	// what to do with the messages over the limits of queue, see backpressure.go.
+	backpressure   atomic.Pointer[Backpressure]
+	inBackpressure atomic.Bool
+
+	lenBuf [4]byte // of the reader.
+
+	// compression, hello is the kind of hello message the reader waits for.
+	codecId atomic.Uint32
+	hello   byte
+
+	// encrypted session, set by the handshake before the agent runs.
+	secure *secureSession
 }
 
 func newTCPConn(pendingWriteNum int, msgParser *TcpMsgParser) *TCPConn {
 	tcpConn := new(TCPConn)
-	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
+	tcpConn.queue.init(pendingWriteNum)
 	tcpConn.msgParser = msgParser
 	//tcpConn.closeFlag.Store(false)
 	return tcpConn
@@ -24,13 +63,21 @@ func newTCPConn(pendingWriteNum int, msgParser *TcpMsgParser) *TCPConn {
 
 func (tcpConn *TCPConn) start() {
 	go func() {
-		for b := range tcpConn.writeChan {
-			if b == nil {
-				break
+		var tick *time.Timer
+		if tcpConn.flushTicker != nil {
+			tick = time.NewTimer(maxTickDelay)
+			defer tick.Stop()
+		}
+
+		for {
+			tcpConn.queue.wait()
+			if tick != nil {
+				tcpConn.flushTicker.wait(tick)
 			}
 
-			_, err := tcpConn.conn.Write(b)
-			if err != nil {
+			var done bool
+			tcpConn.frames, done = tcpConn.queue.take(tcpConn.frames)
+			if err := tcpConn.send(); err != nil || done {
 				break
 			}
 		}
@@ -40,8 +87,39 @@ func (tcpConn *TCPConn) start() {
 	}()
 }
 
+// send write the frames taken by one vectored write if the conn supports it, then
+// release them.
+func (tcpConn *TCPConn) send() error {
+	if len(tcpConn.frames) == 0 {
+		return nil
+	}
+	bufs := tcpConn.vec[:0]
+	for _, f := range tcpConn.frames {
+		bufs = append(bufs, f.head)
+		if f.body != nil {
+			bufs = append(bufs, f.body)
+		}
+	}
+	tcpConn.vec = bufs
+	tcpConn.bufs = bufs
+	metricWrites.Inc(transportTCP)
+	metricWriteBatch.Observe(float64(len(tcpConn.frames)), transportTCP)
+	_, err := tcpConn.bufs.WriteTo(tcpConn.conn)
+
+	for i, f := range tcpConn.frames {
+		f.release()
+		tcpConn.frames[i] = frame{}
+	}
+	clear(tcpConn.vec)
+	return err
+}
+
 func (tcpConn *TCPConn) bindConn(conn net.Conn) {
 	tcpConn.conn = conn
+	tcpConn.codecId.Store(0)
+	tcpConn.hello = 0
+	tcpConn.secure = nil
+	tcpConn.queue.reset()
 }
 
 func (tcpConn *TCPConn) doDestroy() {
@@ -50,10 +128,10 @@ func (tcpConn *TCPConn) doDestroy() {
 
 		tcpConn.closeFlag.Store(true)
 
-		_ = tcpConn.conn.(*net.TCPConn).SetLinger(0)
+		setLinger(tcpConn.conn, 0)
 		_ = tcpConn.conn.Close()
 
-		close(tcpConn.writeChan)
+		tcpConn.queue.destroy()
 	}
 }
 
@@ -61,33 +139,71 @@ func (tcpConn *TCPConn) Destroy() {
 	tcpConn.doDestroy()
 }
 
+// drain flush the pending writes before closing, writes after deadline are given up.
+func (tcpConn *TCPConn) drain(deadline time.Time) {
+	if !deadline.IsZero() {
+		_ = tcpConn.conn.SetWriteDeadline(deadline)
+	}
+	tcpConn.Close()
+}
+
+// forceClose close the connection at once, the pending writes are dropped.
+func (tcpConn *TCPConn) forceClose() {
+	setLinger(tcpConn.conn, 0)
+	_ = tcpConn.conn.Close()
+}
+
 func (tcpConn *TCPConn) Close() {
 	if tcpConn.closeFlag.Load() {
 		return
 	}
 
-	tcpConn.doWrite(nil)
+	tcpConn.queue.close()
 	tcpConn.closeFlag.Store(true)
 }
 
-func (tcpConn *TCPConn) doWrite(b []byte) {
-	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
-		log.Debug("close conn: channel full")
+// SetBackpressure set what to do with the messages over the limits of the write
+// queue, nil for BackpressureDisconnect.
+func (tcpConn *TCPConn) SetBackpressure(bp *Backpressure) {
+	tcpConn.backpressure.Store(bp)
+}
+
+func (tcpConn *TCPConn) doWrite(f frame) {
+	observeWriteFill(transportTCP, tcpConn.queue.len(), tcpConn.queue.maxNum)
+	switch tcpConn.queue.push(f, tcpConn.backpressure.Load()) {
+	case pushDropped:
+		metricDropped.Inc(transportTCP)
+		tcpConn.onBackpressure()
+	case pushOverflow:
+		metricChanFull.Inc(transportTCP)
+		log.With("remote", tcpConn.RemoteAddr()).Debug("close conn: channel full")
+		tcpConn.onBackpressure()
 		tcpConn.doDestroy()
-		return
 	}
+}
 
-	tcpConn.writeChan <- b
+// onBackpressure tell the agent, the messages it sends meanwhile don't tell it again.
+func (tcpConn *TCPConn) onBackpressure() {
+	if tcpConn.agent == nil || !tcpConn.inBackpressure.CompareAndSwap(false, true) {
+		return
+	}
+	defer tcpConn.inBackpressure.Store(false)
+	tcpConn.agent.OnBackpressure()
 }
 
-// b must not be modified by the others goroutines
+// Write queue b, it is owned by tcpConn after the call and given back to the buffer
+// pool once written.
 func (tcpConn *TCPConn) Write(b []byte) {
+	tcpConn.writeFrame(frame{head: b})
+}
+
+func (tcpConn *TCPConn) writeFrame(f frame) {
 
-	if tcpConn.closeFlag.Load() || b == nil {
+	if tcpConn.closeFlag.Load() || f.head == nil {
 		return
 	}
 
-	tcpConn.doWrite(b)
+	tcpConn.doWrite(f)
 }
 
 func (tcpConn *TCPConn) Read(b []byte) (int, error) {
@@ -113,3 +229,8 @@ func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
 func (tcpConn *TCPConn) WriteMsg(args ...[]byte) error {
 	return tcpConn.msgParser.Write(tcpConn, args...)
 }
+
+// WriteMsgPriority write a message of the priority class prio.
+func (tcpConn *TCPConn) WriteMsgPriority(prio int, args ...[]byte) error {
+	return tcpConn.msgParser.write(tcpConn, prio, args...)
+}
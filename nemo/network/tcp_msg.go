@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"math"
+	"time"
 )
 
 // --------------
@@ -15,6 +16,8 @@ type TcpMsgParser struct {
 	minMsgLen    int
 	maxMsgLen    int
 	littleEndian bool
+	compression  *compression
+	secure       *SecureConfig
 }
 
 func newTcpMsgParser() *TcpMsgParser {
@@ -61,16 +64,72 @@ func (p *TcpMsgParser) SetByteOrder(littleEndian bool) {
 	p.littleEndian = littleEndian
 }
 
-// goroutine safe
+// SetCompression accept the codecs in the order of preference, the messages of at least
+// threshold bytes are compressed once a codec is negotiated. Call it after SetMsgLen.
+func (p *TcpMsgParser) SetCompression(codecs []string, threshold int) error {
+	if len(codecs) == 0 {
+		p.compression = nil
+		return nil
+	}
+	c, err := newCompression(codecs, threshold, p.maxMsgLen)
+	if err != nil {
+		return err
+	}
+	p.compression = c
+	return nil
+}
+
+// SetSecure require the encrypted session of config, nil for plain messages. Call it
+// after SetMsgLen.
+func (p *TcpMsgParser) SetSecure(config *SecureConfig) {
+	p.secure = config
+	if config != nil {
+		// the sealed message must fit the length.
+		if max := p.flag() - 1 - secureOverhead; p.maxMsgLen > max {
+			p.maxMsgLen = max
+		}
+	}
+}
+
+// flag of a compressed message, the highest bit of its length.
+func (p *TcpMsgParser) flag() int {
+	return 1 << (8*p.lenMsgLen - 1)
+}
+
+// goroutine safe, the message returned is owned by the caller, see ReleaseMsg.
 func (p *TcpMsgParser) Read(conn *TCPConn) ([]byte, error) {
-	var b [4]byte
-	var bufMsgLen = b[:p.lenMsgLen] // SetReadDeadLine will execute anytime ... ?
+	for {
+		msgData, compressed, err := p.read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if compressed {
+			cd := p.compression.codec(byte(conn.codecId.Load()))
+			if cd == nil {
+				freeBuffer(msgData)
+				return nil, errors.New("compressed message not negotiated")
+			}
+			data, err := cd.decode(msgData, p.maxMsgLen)
+			freeBuffer(msgData)
+			return data, err
+		}
+		if conn.hello != 0 && p.negotiate(conn, msgData) {
+			freeBuffer(msgData)
+			continue
+		}
+		return msgData, nil
+	}
+}
+
+// read a message into a pooled buffer.
+func (p *TcpMsgParser) read(conn *TCPConn) ([]byte, bool, error) {
+	var bufMsgLen = conn.lenBuf[:p.lenMsgLen] // SetReadDeadLine will execute anytime ... ?
 	//if err := conn.conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
 	//	return nil, err
 	//}
 	// read len
 	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	//conn.conn.SetReadDeadline(time.Time{})
 
@@ -93,23 +152,46 @@ func (p *TcpMsgParser) Read(conn *TCPConn) ([]byte, error) {
 		}
 	}
 
+	compressed := msgLen&p.flag() != 0
+	msgLen &^= p.flag()
+
+	maxMsgLen := p.maxMsgLen
+	if conn.secure != nil {
+		maxMsgLen += secureOverhead
+	}
+
 	// check len
-	if msgLen > p.maxMsgLen {
-		return nil, errors.New("message too long")
+	if msgLen > maxMsgLen {
+		return nil, false, errors.New("message too long")
 	} else if msgLen < p.minMsgLen {
-		return nil, errors.New("message too short")
+		return nil, false, errors.New("message too short")
 	}
 	// data
-	msgData := make([]byte, msgLen)
+	msgData := allocBuffer(msgLen)
 	if _, err := io.ReadFull(conn, msgData); err != nil {
-		return nil, err
+		freeBuffer(msgData)
+		return nil, false, err
 	}
 
-	return msgData, nil
+	if conn.secure != nil {
+		plain, err := conn.secure.open(msgData)
+		if err != nil {
+			freeBuffer(msgData)
+			return nil, false, err
+		}
+		msgData = plain
+	}
+
+	return msgData, compressed, nil
 }
 
-// goroutine safe
+// goroutine safe, args are copied so the caller keeps them.
 func (p *TcpMsgParser) Write(conn *TCPConn, args ...[]byte) error {
+	return p.write(conn, PriorityNormal, args...)
+}
+
+// write a message of the priority class prio.
+func (p *TcpMsgParser) write(conn *TCPConn, prio int, args ...[]byte) error {
 	// get len
 	var msgLen int
 	for i := 0; i < len(args); i++ {
@@ -122,34 +204,166 @@ func (p *TcpMsgParser) Write(conn *TCPConn, args ...[]byte) error {
 	} else if msgLen < p.minMsgLen {
 		return errors.New("message too short")
 	}
-	msg := make([]byte, p.lenMsgLen+msgLen)
+
+	// | len | seq | data | tag |, the seq and the tag are there if it is sealed.
+	head := p.lenMsgLen
+	overhead := 0
+	if conn.secure != nil {
+		head += secureSeqLen
+		overhead = secureOverhead
+	}
+	msg := allocBuffer(p.lenMsgLen + msgLen + overhead)
+
+	// write data
+	l := head
+	for i := 0; i < len(args); i++ {
+		copy(msg[l:], args[i])
+		l += len(args[i])
+	}
+	data := msg[head:l]
+
+	// compress, the message is kept if it doesn't get shorter. A compressed body is
+	// written after the len by a scatter write, or sealed into msg.
+	var body []byte
+	msgHead := msgLen
+	cd := p.compression.codec(byte(conn.codecId.Load()))
+	if cd != nil && msgLen >= p.compression.threshold {
+		z, err := cd.encode(data)
+		if err == nil && len(z) < msgLen {
+			data = z
+			body = z
+			msgHead = len(z) | p.flag()
+		}
+	}
+
+	// seal into msg, in place if it is not compressed.
+	if conn.secure != nil {
+		sealed := conn.secure.seal(msg[:p.lenMsgLen], data)
+		msgHead = msgHead&p.flag() | (len(sealed) - p.lenMsgLen)
+		msg = sealed
+		body = nil
+	} else if body != nil {
+		msg = msg[:p.lenMsgLen]
+	} else {
+		msg = msg[:l]
+	}
 
 	// write len
 	switch p.lenMsgLen {
 	case 1:
-		msg[0] = byte(msgLen)
+		msg[0] = byte(msgHead)
 	case 2:
 		if p.littleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
+			binary.LittleEndian.PutUint16(msg, uint16(msgHead))
 		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
+			binary.BigEndian.PutUint16(msg, uint16(msgHead))
 		}
 	case 4:
 		if p.littleEndian {
-			binary.LittleEndian.PutUint32(msg, uint32(msgLen))
+			binary.LittleEndian.PutUint32(msg, uint32(msgHead))
 		} else {
-			binary.BigEndian.PutUint32(msg, uint32(msgLen))
+			binary.BigEndian.PutUint32(msg, uint32(msgHead))
 		}
 	}
 
-	// write data
-	l := p.lenMsgLen
-	for i := 0; i < len(args); i++ {
-		copy(msg[l:], args[i])
-		l += len(args[i])
+	conn.writeFrame(frame{head: msg, body: body, prio: prio})
+
+	return nil
+}
+
+// offer send the hello of a client with compression, it must be the first message.
+func (p *TcpMsgParser) offer(conn *TCPConn) {
+	if p.compression == nil {
+		return
+	}
+	conn.hello = helloAnswer
+	_ = p.Write(conn, hello(helloOffer, p.compression.ids...))
+}
+
+// negotiate handle msgData if it is the hello conn waits for. A server takes the first
+// message only, a client waits for the answer until it comes.
+func (p *TcpMsgParser) negotiate(conn *TCPConn, msgData []byte) bool {
+	expect := conn.hello
+	if expect == helloOffer {
+		conn.hello = 0
+	}
+	kind, ids, ok := parseHello(msgData)
+	if !ok || kind != expect {
+		return false
+	}
+
+	switch kind {
+	case helloOffer:
+		id := p.compression.choose(ids)
+		// answer before compressing anything.
+		if err := p.Write(conn, hello(helloAnswer, id)); err != nil {
+			return true
+		}
+		conn.codecId.Store(uint32(id))
+	case helloAnswer:
+		conn.hello = 0
+		if len(ids) == 1 && p.compression.codec(ids[0]) != nil {
+			conn.codecId.Store(uint32(ids[0]))
+		}
+	}
+	return true
+}
+
+// acceptSecure open the session of a server conn by the hello of the client, the
+// plain messages before it are refused.
+func (p *TcpMsgParser) acceptSecure(conn *TCPConn) error {
+	_ = conn.conn.SetReadDeadline(time.Now().Add(secureHandshakeTimeout))
+	defer conn.conn.SetReadDeadline(time.Time{})
+
+	hello, _, err := p.read(conn)
+	if err != nil {
+		return err
+	}
+	s, answer, err := p.secure.serverAnswer(hello)
+	freeBuffer(hello)
+	if err != nil {
+		return err
+	}
+	if err = p.Write(conn, answer); err != nil {
+		return err
+	}
+	conn.secure = s
+	return nil
+}
+
+// dial run the handshakes of a client conn, the encrypted session first then the
+// compression. The writer of conn must be started.
+func (p *TcpMsgParser) dial(conn *TCPConn) error {
+	if p.secure != nil {
+		if err := p.dialSecure(conn); err != nil {
+			return err
+		}
 	}
+	p.offer(conn)
+	return nil
+}
 
-	conn.Write(msg)
+// dialSecure open the session of a client conn.
+func (p *TcpMsgParser) dialSecure(conn *TCPConn) error {
+	_ = conn.conn.SetReadDeadline(time.Now().Add(secureHandshakeTimeout))
+	defer conn.conn.SetReadDeadline(time.Time{})
 
+	key, hello, err := p.secure.clientHello()
+	if err != nil {
+		return err
+	}
+	if err = p.Write(conn, hello); err != nil {
+		return err
+	}
+	answer, _, err := p.read(conn)
+	if err != nil {
+		return err
+	}
+	s, err := p.secure.clientFinish(key, answer)
+	freeBuffer(answer)
+	if err != nil {
+		return err
+	}
+	conn.secure = s
 	return nil
 }
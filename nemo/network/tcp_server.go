@@ -1,9 +1,12 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lircstar/nemo/sys/log"
@@ -17,10 +20,38 @@ type TCPServer struct {
 	NewAgent        func(Conn) Agent
 	ln              net.Listener
 	connPool        *pool.ObjectPool
+	maxConnNum      atomic.Int64
+
+	// tls, the connections are plain if CertFile is empty. The client certificates
+	// are required and verified by ClientCAFile if it is set. The files are loaded
+	// again when they change.
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	// encrypted session required from every client, nil for plain messages.
+	Secure *SecureConfig
+
+	// the messages queued are written at the next tick of FlushTicker, see flush.go.
+	// The server makes its own FlushTicker if it is nil.
+	FlushOnTick bool
+	FlushTicker *FlushTicker
+
+	// what the connections do with the messages over PendingWriteNum or
+	// Backpressure.MaxPendingBytes, the agents may change it.
+	Backpressure Backpressure
+
+	// refuses the conns over the limits of their ip, nil for no limit.
+	IPLimiter *IPLimiter
 
 	wgLn    sync.WaitGroup
 	wgConns sync.WaitGroup
 
+	// compression, the codecs accepted in the order of preference, messages of at
+	// least CompressThreshold bytes are compressed by the codec negotiated.
+	Compression       []string
+	CompressThreshold int
+
 	// msg parser
 	LenMsgLen    int
 	MinMsgLen    int
@@ -39,11 +70,14 @@ func (server *TCPServer) init() {
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
+	// the port chosen for port 0.
+	server.Addr = ln.Addr().String()
 
 	if server.MaxConnNum <= 0 {
 		server.MaxConnNum = 100
 		log.Warnf("invalid MaxConnNum, reset to %v", server.MaxConnNum)
 	}
+	server.maxConnNum.Store(int64(server.MaxConnNum))
 	if server.PendingWriteNum <= 0 {
 		server.PendingWriteNum = 100
 		log.Warnf("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
@@ -51,6 +85,20 @@ func (server *TCPServer) init() {
 	if server.NewAgent == nil {
 		log.Fatal("NewAgent must not be nil")
 	}
+	if server.FlushOnTick && server.FlushTicker == nil {
+		server.FlushTicker = NewFlushTicker()
+	}
+
+	if server.CertFile != "" || server.KeyFile != "" || server.ClientCAFile != "" {
+		if server.CertFile == "" {
+			log.Fatal("CertFile must not be empty for tls")
+		}
+		files, err := newTLSFiles(server.CertFile, server.KeyFile, server.ClientCAFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		ln = tls.NewListener(ln, files.serverConfig())
+	}
 
 	server.ln = ln
 
@@ -61,6 +109,10 @@ func (server *TCPServer) init() {
 	msgParser := newTcpMsgParser()
 	msgParser.SetMsgLen(server.LenMsgLen, server.MinMsgLen, server.MaxMsgLen)
 	msgParser.SetByteOrder(server.LittleEndian)
+	msgParser.SetSecure(server.Secure)
+	if err := msgParser.SetCompression(server.Compression, server.CompressThreshold); err != nil {
+		log.Fatalf("%v", err)
+	}
 	server.msgParser = msgParser
 }
 
@@ -76,6 +128,11 @@ func (server *TCPServer) newTCPConn(conn net.Conn) *TCPConn {
 	tcpConn.closeFlag.Store(false)
 	tcpConn.conn = nil
 	tcpConn.bindConn(conn)
+	tcpConn.hello = helloOffer
+	if server.FlushOnTick {
+		tcpConn.flushTicker = server.FlushTicker
+	}
+	tcpConn.SetBackpressure(&server.Backpressure)
 	return tcpConn
 }
 
@@ -111,19 +168,41 @@ func (server *TCPServer) run() {
 		}
 		tempDelay = 0
 
-		if server.connPool.UsedCount() >= server.MaxConnNum {
+		if int64(server.connPool.UsedCount()) >= server.maxConnNum.Load() {
+			metricRejected.Inc(transportTCP)
+			_ = conn.Close()
+			log.With("remote", conn.RemoteAddr()).Debug("too many connections")
+			continue
+		}
+		ip := IPOf(conn.RemoteAddr())
+		if !server.IPLimiter.acquire(ip) {
+			metricRejected.Inc(transportTCP)
 			_ = conn.Close()
-			log.Debug("too many connections")
+			log.With("remote", conn.RemoteAddr()).Debug("ip refused")
 			continue
 		}
 
 		server.wgConns.Add(1)
+		metricAccepted.Inc(transportTCP)
+		metricConns.Inc(transportTCP)
 
 		tcpConn := server.newTCPConn(conn)
 		tcpConn.start()
 		agent := server.NewAgent(tcpConn)
 		agent.SetType(TYPE_AGENT_TCP)
+		tcpConn.agent = agent
 		go func() {
+			defer server.IPLimiter.release(ip)
+			if err := server.handshake(tcpConn); err != nil {
+				log.With("remote", conn.RemoteAddr()).Debugf("handshake error: %v", err)
+				server.delTCPConn(tcpConn)
+				// the agent never connected goes back to its pool.
+				agent.OnClose()
+				metricConns.Dec(transportTCP)
+				server.wgConns.Done()
+				return
+			}
+
 			// routine
 			agent.OnConnect()
 			agent.Run(nil)
@@ -132,11 +211,23 @@ func (server *TCPServer) run() {
 			server.delTCPConn(tcpConn)
 			agent.OnClose()
 
+			metricConns.Dec(transportTCP)
 			server.wgConns.Done()
 		}()
 	}
 }
 
+// handshake run the tls handshake and open the encrypted session of an accepted conn.
+func (server *TCPServer) handshake(tcpConn *TCPConn) error {
+	if err := tlsHandshake(tcpConn.conn); err != nil {
+		return err
+	}
+	if server.Secure != nil {
+		return server.msgParser.acceptSecure(tcpConn)
+	}
+	return nil
+}
+
 func (server *TCPServer) Close() {
 	_ = server.ln.Close()
 	server.wgLn.Wait()
@@ -154,3 +245,53 @@ func (server *TCPServer) Close() {
 
 	server.connPool = nil
 }
+
+// Shutdown stop accepting and tell every agent by OnDraining, then flush the write
+// queue of each connection before closing it. It returns when all agents are closed.
+// Connections still alive when ctx is done are closed at once.
+func (server *TCPServer) Shutdown(ctx context.Context) error {
+	_ = server.ln.Close()
+	server.wgLn.Wait()
+
+	var conns []*TCPConn
+	server.connPool.UsedRange(func(i any) {
+		conns = append(conns, i.(*TCPConn))
+	})
+
+	for _, tcpConn := range conns {
+		if tcpConn.agent != nil {
+			tcpConn.agent.OnDraining()
+		}
+	}
+
+	deadline, _ := ctx.Deadline()
+	for _, tcpConn := range conns {
+		tcpConn.drain(deadline)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wgConns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, tcpConn := range conns {
+			tcpConn.forceClose()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// SetMaxConnNum change MaxConnNum while the server runs, connections over it are
+// kept.
+func (server *TCPServer) SetMaxConnNum(n int) {
+	if n > 0 {
+		server.MaxConnNum = n
+		server.maxConnNum.Store(int64(n))
+	}
+}
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// tlsHandshakeTimeout bounds the handshake of an accepted or dialed tls connection.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsCheckInterval is the least time between two checks of the files for changes.
+var tlsCheckInterval = time.Second
+
+// tlsFiles loads a key pair and a CA pool from pem files and loads them again once the
+// files change, so certificates are renewed without a restart. A file that fails to
+// load keeps the previous certificates in use.
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newTLSFiles(certFile, keyFile, caFile string) (*tlsFiles, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls: CertFile and KeyFile must be set together")
+	}
+	files := &tlsFiles{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, _, err := files.load(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// load get the current key pair and CA pool, nil if their files are not set.
+func (files *tlsFiles) load() (*tls.Certificate, *x509.CertPool, error) {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+
+	now := time.Now()
+	if files.cert != nil || files.pool != nil {
+		if now.Sub(files.checked) < tlsCheckInterval {
+			return files.cert, files.pool, nil
+		}
+	}
+	files.checked = now
+
+	var modTime time.Time
+	for _, name := range []string{files.certFile, files.keyFile, files.caFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return files.keep(err)
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if !modTime.After(files.modTime) {
+		return files.cert, files.pool, nil
+	}
+
+	var cert *tls.Certificate
+	if files.certFile != "" {
+		c, err := tls.LoadX509KeyPair(files.certFile, files.keyFile)
+		if err != nil {
+			return files.keep(err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if files.caFile != "" {
+		data, err := os.ReadFile(files.caFile)
+		if err != nil {
+			return files.keep(err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return files.keep(fmt.Errorf("tls: no certificate in %s", files.caFile))
+		}
+	}
+
+	if !files.modTime.IsZero() {
+		log.With("cert", files.certFile, "ca", files.caFile).Info("tls certificates reloaded")
+	}
+	files.modTime = modTime
+	files.cert = cert
+	files.pool = pool
+	return cert, pool, nil
+}
+
+// keep the loaded certificates on err, err is returned if there are none yet.
+func (files *tlsFiles) keep(err error) (*tls.Certificate, *x509.CertPool, error) {
+	if files.cert == nil && files.pool == nil {
+		return nil, nil, err
+	}
+	log.Errorf("tls reload error: %v", err)
+	return files.cert, files.pool, nil
+}
+
+// serverConfig get the tls config of a listener, the client certificates are required
+// and verified by the CA pool if there is one.
+func (files *tlsFiles) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool, err := files.load()
+			if err != nil {
+				return nil, err
+			}
+			cf := &tls.Config{MinVersion: tls.VersionTLS12}
+			if cert != nil {
+				cf.Certificates = []tls.Certificate{*cert}
+			}
+			if pool != nil {
+				cf.ClientCAs = pool
+				cf.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cf, nil
+		},
+	}
+}
+
+// clientConfig get the tls config of a dial, the server is verified by the CA pool, or
+// by the system pool if there is none. The key pair is sent for mutual tls.
+func (files *tlsFiles) clientConfig(serverName string, insecure bool) (*tls.Config, error) {
+	cert, pool, err := files.load()
+	if err != nil {
+		return nil, err
+	}
+	cf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		RootCAs:            pool,
+		InsecureSkipVerify: insecure,
+	}
+	if cert != nil {
+		cf.Certificates = []tls.Certificate{*cert}
+	}
+	return cf, nil
+}
+
+// dialTCP dial addr, over tls if files is not nil.
+func dialTCP(addr string, files *tlsFiles, serverName string, insecure bool) (net.Conn, error) {
+	if files == nil {
+		return net.Dial("tcp", addr)
+	}
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	cf, err := files.clientConfig(serverName, insecure)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: tlsHandshakeTimeout}, Config: cf}
+	return dialer.Dial("tcp", addr)
+}
+
+// tlsHandshake run the tls handshake of an accepted conn, nothing for a plain conn.
+func tlsHandshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	return tlsConn.HandshakeContext(ctx)
+}
+
+// setLinger set the linger of the tcp conn under conn.
+func setLinger(conn net.Conn, sec int) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(sec)
+	}
+}
@@ -0,0 +1,236 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs the certificates of a test.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nemo test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	ca.file = filepath.Join(ca.dir, "ca.pem")
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue write a certificate of name for 127.0.0.1 and its key, and get their files.
+func (ca *testCA) issue(t *testing.T, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(ca.dir, name+".pem")
+	keyFile = filepath.Join(ca.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSServer start an echo server requiring client certificates of ca.
+func startTLSServer(t *testing.T, ca *testCA, certFile, keyFile string) *TCPServer {
+	t.Helper()
+	server := &TCPServer{
+		Addr:         "127.0.0.1:0",
+		MaxConnNum:   10,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: ca.file,
+		NewAgent: func(conn Conn) Agent {
+			return newTestAgent(conn, true)
+		},
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startTestClient start a client with the tls files and wait for its agent.
+func startTestClient(t *testing.T, client *TCPClient) *testAgent {
+	t.Helper()
+	agents := make(chan *testAgent, 1)
+	client.NewAgent = func(conn Conn) Agent {
+		a := newTestAgent(conn, false)
+		agents <- a
+		return a
+	}
+	client.Start()
+
+	select {
+	case a := <-agents:
+		t.Cleanup(func() {
+			a.conn.Close()
+			<-a.closed
+		})
+		return a
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not connected")
+		return nil
+	}
+}
+
+// peerName dial server with the client certificate and get the name of the server.
+func peerName(t *testing.T, server *TCPServer, ca *testCA, certFile, keyFile string) string {
+	t.Helper()
+	conn, err := dialTCP(server.ln.Addr().String(), mustTLSFiles(t, certFile, keyFile, ca.file), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.(*tls.Conn).ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server")
+	clientCert, clientKey := ca.issue(t, "client")
+	server := startTLSServer(t, ca, serverCert, serverKey)
+
+	a := startTestClient(t, &TCPClient{
+		Addr:     server.ln.Addr().String(),
+		CertFile: clientCert,
+		KeyFile:  clientKey,
+		CAFile:   ca.file,
+	})
+	if err := a.conn.WriteMsg([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data := a.recv(t); string(data) != "hello" {
+		t.Fatalf("echo %q", data)
+	}
+}
+
+func TestTLSClientCertRequired(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server")
+	server := startTLSServer(t, ca, serverCert, serverKey)
+
+	conn, err := dialTCP(server.ln.Addr().String(), mustTLSFiles(t, "", "", ca.file), "", false)
+	if err == nil {
+		// with tls 1.3 the server rejects the client after the dial.
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err == nil {
+		t.Fatal("client without certificate accepted")
+	}
+
+	// a server signed by another ca is refused by the client.
+	other := newTestCA(t)
+	if _, err = dialTCP(server.ln.Addr().String(), mustTLSFiles(t, "", "", other.file), "", false); err == nil {
+		t.Fatal("unknown server accepted")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	defer func(d time.Duration) { tlsCheckInterval = d }(tlsCheckInterval)
+	tlsCheckInterval = 0
+
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "server")
+	clientCert, clientKey := ca.issue(t, "client")
+	server := startTLSServer(t, ca, serverCert, serverKey)
+
+	if name := peerName(t, server, ca, clientCert, clientKey); name != "server" {
+		t.Fatalf("server name %q", name)
+	}
+
+	// renew the certificate in place.
+	newCert, newKey := ca.issue(t, "renewed")
+	for src, dst := range map[string]string{newCert: serverCert, newKey: serverKey} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(dst, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		future := time.Now().Add(time.Minute)
+		_ = os.Chtimes(dst, future, future)
+	}
+	if name := peerName(t, server, ca, clientCert, clientKey); name != "renewed" {
+		t.Fatalf("server name %q after renewal", name)
+	}
+
+	// a broken file keeps the loaded certificate.
+	if err := os.WriteFile(serverCert, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(2 * time.Minute)
+	_ = os.Chtimes(serverCert, future, future)
+	if name := peerName(t, server, ca, clientCert, clientKey); name != "renewed" {
+		t.Fatalf("server name %q after broken renewal", name)
+	}
+}
+
+func mustTLSFiles(t *testing.T, certFile, keyFile, caFile string) *tlsFiles {
+	t.Helper()
+	files, err := newTLSFiles(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
@@ -1,7 +1,9 @@
 package network
 
 import (
+	"context"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/lircstar/nemo/sys/log"
@@ -11,13 +13,14 @@ type UDPClient struct {
 	Addr            string
 	ConnectInterval time.Duration
 	AutoReconnect   bool
-	running         bool
+	reconnect       reconnectOption
+	running         atomic.Bool
 
 	conn     net.Conn
 	agent    Agent
 	NewAgent func(Conn) Agent
 
-	idleTime int64
+	idleTime atomic.Int64
 	TimeOut  int
 
 	// msg
@@ -25,6 +28,14 @@ type UDPClient struct {
 	MaxMsgLen    int
 	LittleEndian bool
 	msgParser    *UdpMsgParser
+
+	// encrypted session opened on connect, nil for plain messages.
+	Secure *SecureConfig
+	// channels of reliable and unreliable messages, see channel.go, nil for raw
+	// datagrams.
+	Reliable *ARQConfig
+	// open a session by the handshake of udp_session.go, the server needs it too.
+	Handshake bool
 }
 
 func (client *UDPClient) Start() {
@@ -37,63 +48,96 @@ func (client *UDPClient) init() {
 		client.ConnectInterval = 3 * time.Second
 		log.Warnf("invalid ConnectInterval, reset to %v", client.ConnectInterval)
 	}
+	client.reconnect.set(client.AutoReconnect, client.ConnectInterval)
 
-	client.running = false
+	client.running.Store(false)
 
 	// msg parser
 	client.msgParser = newUdpMsgParser()
 	client.msgParser.SetMsgLen(client.MinMsgLen, client.MaxMsgLen)
 	client.msgParser.SetByteOrder(client.LittleEndian)
+	client.msgParser.SetSecure(client.Secure)
+	client.msgParser.SetReliable(client.Reliable)
+	client.msgParser.SetHandshake(client.Handshake)
 }
 
 func (client *UDPClient) doConnect(remoteAddr string) {
 	client.Addr = remoteAddr
 	addr, err := net.ResolveUDPAddr("udp", client.Addr)
 	if err != nil {
-		log.Errorf("Failed to resolve udp address. addr : %s;  %v", client.Addr, err.Error())
+		log.With("addr", client.Addr).Errorf("Failed to resolve udp address; %v", err)
 		return
 	}
 
 reconnect:
 	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
-		log.Errorf("Failed to dial udp")
-		time.Sleep(client.ConnectInterval)
+		log.With("addr", client.Addr).Errorf("Failed to dial udp; %v", err)
+		client.reconnect.wait()
 		return
 	}
 
 	udpConn := newUDPConn(client.msgParser)
 	udpConn.conn = conn
+	if client.Handshake || client.Secure != nil {
+		if client.Handshake {
+			err = client.msgParser.dialSession(udpConn)
+		} else {
+			err = client.msgParser.dialSecure(udpConn)
+		}
+		if err != nil {
+			log.With("addr", client.Addr).Errorf("udp handshake error: %v", err)
+			_ = conn.Close()
+			if client.reconnect.auto.Load() {
+				client.reconnect.wait()
+				goto reconnect
+			}
+			return
+		}
+	}
+	if client.Reliable != nil {
+		udpConn.startChannels(client.Reliable)
+	}
 	client.conn = conn
 	client.agent = client.NewAgent(udpConn)
 	client.agent.SetType(TYPE_CLIENT_UDP)
-	client.running = true
+	client.running.Store(true)
 	client.agent.OnConnect()
-	client.idleTime = time.Now().Unix()
+	client.idleTime.Store(time.Now().Unix())
 	go client.goRun()
 	client.recv(udpConn)
 
 	// cleanup
-	client.running = false
+	client.running.Store(false)
 	client.agent.OnClose()
 	if udpConn.IsClosed() {
-		if !client.AutoReconnect {
+		if !client.reconnect.auto.Load() {
 			return
 		}
 	} else {
 		client.Close()
 	}
 
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
+	if client.reconnect.auto.Load() {
+		client.reconnect.wait()
 		goto reconnect
 	}
 }
 
+// Call send an rpc request to the server and wait for the response.
+func (client *UDPClient) Call(ctx context.Context, req any) (any, error) {
+	agent := client.agent
+	if agent == nil {
+		return nil, ErrNotConnected
+	}
+	return agent.Call(ctx, req)
+}
+
 func (client *UDPClient) Close() {
 	if client.agent != nil {
-		client.conn.Close()
+		// the conn tells the server before the socket is closed.
 		client.agent.Close()
+		client.conn.Close()
 	}
 }
 
@@ -108,23 +152,23 @@ func (client *UDPClient) recv(conn *UDPConn) {
 	for !conn.IsClosed() {
 		data, err := conn.ReadMsg()
 		if err != nil {
-			log.Warnf("failed to udp read; err:%v", err.Error())
+			log.With("addr", client.Addr).Warnf("failed to udp read; err:%v", err)
 			break
 		}
 
 		n := len(data)
 		if n > 0 && n >= client.MinMsgLen {
 			client.agent.Run(data)
-			client.idleTime = time.Now().Unix()
+			client.idleTime.Store(time.Now().Unix())
 		}
 	}
 }
 
 func (client *UDPClient) goRun() {
-	for client.running {
+	for client.running.Load() {
 		select {
 		case <-time.After(time.Second * 10):
-			if time.Now().Unix()-client.idleTime > int64(client.TimeOut) {
+			if time.Now().Unix()-client.idleTime.Load() > int64(client.TimeOut) {
 				client.Close()
 			}
 		}
@@ -146,3 +190,9 @@ func (client *UDPClient) GetConnected() bool {
 func (client *UDPClient) GetAgent() Agent {
 	return client.agent
 }
+
+// SetReconnect change AutoReconnect and ConnectInterval while the client runs.
+func (client *UDPClient) SetReconnect(auto bool, interval time.Duration) {
+	client.AutoReconnect = auto
+	client.reconnect.set(auto, interval)
+}
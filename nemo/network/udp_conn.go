@@ -1,21 +1,47 @@
 package network
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
+
+	"github.com/lircstar/nemo/sys/log"
 )
 
 type UDPConn struct {
-	conn   *net.UDPConn
-	remote *net.UDPAddr
+	conn *net.UDPConn
+	// remote is the peer of a server conn, it changes when a session migrates. nil for
+	// a client, whose socket is connected.
+	remote atomic.Pointer[net.UDPAddr]
 
 	closeFlag atomic.Bool
-	key       *connTrackKey
+	key       any    // of the agent in the server, a connTrackKey or a session id.
+	limitIP   string // counted by the IPLimiter of the server.
 	agent     Agent
 
+	// session of the handshake, see udp_session.go, 0 if there is none. A server keeps
+	// its accept to send it again if it is lost.
+	sid           uint64
+	sessionAccept []byte
+
 	msgParser *UdpMsgParser
 
 	timeEvent chan Conn
+
+	// encrypted session, a server keeps the hello of the client and its answer to send
+	// it again if the answer is lost.
+	secure       atomic.Pointer[secureSession]
+	secureMu     sync.Mutex
+	secureHello  []byte
+	secureAnswer []byte
+
+	// channels of a reliable conn, nil for raw datagrams. msgs are the messages the
+	// last datagram completes, a server runs them one at a time under recvMu.
+	channels *udpChannels
+	recvMu   sync.Mutex
+	msgs     [][]byte
 }
 
 func newUDPConn(msgParser *UdpMsgParser) *UDPConn {
@@ -33,11 +59,89 @@ func (conn *UDPConn) ReadMsg() ([]byte, error) {
 func (conn *UDPConn) WriteMsg(args ...[]byte) error {
 	return conn.msgParser.Write(conn, args...)
 }
+
+// WriteMsgOn write a message on ch, a raw conn has the unreliable channels only.
+func (conn *UDPConn) WriteMsgOn(ch Channel, args ...[]byte) error {
+	if conn.channels == nil && ch.Delivery() != Unreliable {
+		return fmt.Errorf("udp: channel %v needs a reliable conn", ch)
+	}
+	return conn.msgParser.write(conn, ch, args...)
+}
+
+// startChannels start the channels of config on conn.
+func (conn *UDPConn) startChannels(config *ARQConfig) {
+	overhead := conn.sessionHead()
+	if conn.msgParser.secure != nil {
+		overhead += secureOverhead
+	}
+	conn.channels = newUDPChannels(config, overhead, conn.output, conn.lost)
+}
+
+// output write a datagram of the channels, after the session head and sealed if conn
+// has an encrypted session.
+func (conn *UDPConn) output(data []byte) {
+	head := conn.sessionHead()
+	s := conn.secure.Load()
+	if head > 0 || s != nil {
+		msg := allocBuffer(head + len(data) + secureOverhead)
+		defer freeBuffer(msg)
+		if s != nil {
+			data = s.seal(msg[:head], data)
+		} else {
+			data = append(msg[:head], data...)
+		}
+		conn.putSessionHead(data)
+	}
+	_ = conn.writeTo(data)
+}
+
+// lost close conn when a reliable channel gives up the peer, the socket of a client
+// too so its read returns.
+func (conn *UDPConn) lost() {
+	log.With("remote", conn.RemoteAddr()).Debug("close conn: peer lost")
+	conn.Close()
+	if conn.remote.Load() == nil {
+		_ = conn.conn.Close()
+	}
+}
+
+// receive feed the datagram data to the channels, then run the messages it completes.
+func (conn *UDPConn) receive(agent Agent, data []byte) {
+	conn.recvMu.Lock()
+	defer conn.recvMu.Unlock()
+	msgs, err := conn.channels.receive(data, conn.msgs[:0])
+	if err != nil {
+		log.With("remote", conn.RemoteAddr()).Debugf("drop datagram: %v", err)
+	}
+	for i, msg := range msgs {
+		msgs[i] = nil
+		agent.Run(msg)
+	}
+	conn.msgs = msgs[:0]
+}
+
+// writeTo write the datagram data to the peer.
+func (conn *UDPConn) writeTo(data []byte) error {
+	if conn.closeFlag.Load() || conn.conn == nil {
+		return errors.New("connection is closed")
+	}
+	var err error
+	if remote := conn.remote.Load(); remote == nil {
+		_, err = conn.conn.Write(data)
+	} else {
+		_, err = conn.conn.WriteToUDP(data, remote)
+	}
+	return err
+}
+
 func (conn *UDPConn) LocalAddr() net.Addr {
 	return conn.conn.LocalAddr()
 }
 func (conn *UDPConn) RemoteAddr() net.Addr {
-	return conn.remote
+	if remote := conn.remote.Load(); remote != nil {
+		return remote
+	}
+	return conn.conn.RemoteAddr()
 }
 
 func (conn *UDPConn) IsClosed() bool {
@@ -45,10 +149,24 @@ func (conn *UDPConn) IsClosed() bool {
 }
 
 func (conn *UDPConn) Close() {
+	conn.close(true)
+}
+
+// close conn, the peer is told the session is over if notify.
+func (conn *UDPConn) close(notify bool) {
+	// the reliable channels send what waits before the conn is closed.
+	if conn.channels != nil {
+		conn.channels.close()
+	}
+	if notify && conn.sid != 0 && !conn.closeFlag.Load() {
+		conn.sendClose()
+	}
+	if !conn.closeFlag.CompareAndSwap(false, true) {
+		return
+	}
 	if conn.timeEvent != nil {
 		conn.timeEvent <- conn
 	}
-	conn.closeFlag.Store(true)
 }
 
 func (conn *UDPConn) Destroy() {
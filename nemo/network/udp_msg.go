@@ -2,8 +2,16 @@ package network
 
 import (
 	"errors"
+	"net"
+	"time"
+
+	"github.com/lircstar/nemo/sys/log"
 )
 
+// secureRetryInterval is the time a client waits for the answer before sending its
+// hello again.
+const secureRetryInterval = 500 * time.Millisecond
+
 // --------------
 // | len | data |
 // --------------
@@ -11,6 +19,9 @@ type UdpMsgParser struct {
 	minMsgLen    int
 	maxMsgLen    int
 	littleEndian bool
+	secure       *SecureConfig
+	reliable     *ARQConfig
+	handshake    bool
 }
 
 func newUdpMsgParser() *UdpMsgParser {
@@ -38,22 +49,101 @@ func (p *UdpMsgParser) SetByteOrder(littleEndian bool) {
 	p.littleEndian = littleEndian
 }
 
-// goroutine safe
-func (p *UdpMsgParser) Read(conn *UDPConn) ([]byte, error) {
-	if conn.closeFlag.Load() || conn.conn == nil {
-		return nil, errors.New("connection is closed")
+// SetSecure require the encrypted session of config, nil for plain messages.
+func (p *UdpMsgParser) SetSecure(config *SecureConfig) {
+	p.secure = config
+}
+
+// SetReliable make the messages reliable and ordered by config, nil for raw datagrams.
+func (p *UdpMsgParser) SetReliable(config *ARQConfig) {
+	p.reliable = config
+}
+
+// SetHandshake make the conns open a session by the handshake of udp_session.go.
+func (p *UdpMsgParser) SetHandshake(handshake bool) {
+	p.handshake = handshake
+}
+
+// maxLen get the max length of a datagram.
+func (p *UdpMsgParser) maxLen() int {
+	if p.reliable != nil {
+		return p.reliable.mtu()
 	}
-	msgData := make([]byte, p.maxMsgLen)
-	n, err := conn.conn.Read(msgData)
-	if err != nil {
-		return nil, err
+	n := p.maxMsgLen
+	if p.secure != nil {
+		n += secureOverhead
+	}
+	if p.handshake {
+		n += sessionHeadLen
 	}
+	return n
+}
 
-	return msgData[:n], nil
+// goroutine safe, the message returned is owned by the caller, see ReleaseMsg.
+func (p *UdpMsgParser) Read(conn *UDPConn) ([]byte, error) {
+	for {
+		if conn.closeFlag.Load() || conn.conn == nil {
+			return nil, errors.New("connection is closed")
+		}
+		if len(conn.msgs) > 0 {
+			msg := conn.msgs[0]
+			n := copy(conn.msgs, conn.msgs[1:])
+			conn.msgs[n] = nil
+			conn.msgs = conn.msgs[:n]
+			return msg, nil
+		}
+		msgData := allocBuffer(p.maxLen())
+		n, err := conn.conn.Read(msgData)
+		if err != nil {
+			freeBuffer(msgData)
+			return nil, err
+		}
+
+		plain := msgData[:n]
+		if conn.sid != 0 {
+			var kind byte
+			if kind, plain = conn.sessionPayload(plain); plain == nil {
+				freeBuffer(msgData)
+				continue
+			}
+			if kind == sessionClose {
+				authentic := conn.closeAuthentic(plain)
+				freeBuffer(msgData)
+				if !authentic {
+					continue
+				}
+				conn.close(false)
+				_ = conn.conn.Close()
+				return nil, errSessionClosed
+			}
+		}
+		// forged or replayed datagrams are dropped, the session goes on.
+		if s := conn.secure.Load(); s != nil {
+			if plain, err = s.open(plain); err != nil {
+				freeBuffer(msgData)
+				log.With("remote", conn.conn.RemoteAddr()).Debugf("drop datagram: %v", err)
+				continue
+			}
+		}
+		if conn.channels == nil {
+			return plain, nil
+		}
+		conn.msgs, err = conn.channels.receive(plain, conn.msgs)
+		freeBuffer(msgData)
+		if err != nil {
+			log.With("remote", conn.conn.RemoteAddr()).Debugf("drop datagram: %v", err)
+		}
+	}
 }
 
-// goroutine safe
+// goroutine safe, args are copied so the caller keeps them. A reliable conn writes
+// on ChannelReliableOrdered.
 func (p *UdpMsgParser) Write(conn *UDPConn, args ...[]byte) error {
+	return p.write(conn, ChannelReliableOrdered, args...)
+}
+
+// write a message on ch, a raw conn writes a datagram whatever ch is.
+func (p *UdpMsgParser) write(conn *UDPConn, ch Channel, args ...[]byte) error {
 	// get len
 	var msgLen int
 	for i := 0; i < len(args); i++ {
@@ -66,30 +156,67 @@ func (p *UdpMsgParser) Write(conn *UDPConn, args ...[]byte) error {
 	} else if msgLen < p.minMsgLen {
 		return errors.New("message too short")
 	}
+	if conn.channels != nil {
+		return conn.channels.send(ch, args...)
+	}
 
-	msg := make([]byte, msgLen)
+	// | session | seq | data | tag |, the session head is there if conn has a session,
+	// the seq and the tag if it is sealed.
+	s := conn.secure.Load()
+	pre := conn.sessionHead()
+	head, overhead := pre, pre
+	if s != nil {
+		head, overhead = head+secureSeqLen, overhead+secureOverhead
+	}
+	msg := allocBuffer(msgLen + overhead)
+	defer freeBuffer(msg)
 
 	// write data
-	l := 0
+	l := head
 	for i := 0; i < len(args); i++ {
 		copy(msg[l:], args[i])
 		l += len(args[i])
 	}
 
-	if conn.closeFlag.Load() || conn.conn == nil {
-		return errors.New("connection is closed")
+	// seal in place.
+	data := msg[:l]
+	if s != nil {
+		data = s.seal(msg[:pre], msg[head:l])
 	}
-	var err error
-	if conn.remote == nil {
-		_, err = conn.conn.Write(msg)
+	conn.putSessionHead(data)
 
-	} else {
-		_, err = conn.conn.WriteToUDP(msg, conn.remote)
-	}
+	return conn.writeTo(data)
+}
 
+// dialSecure open the session of a client conn, the hello is sent again until the
+// answer comes.
+func (p *UdpMsgParser) dialSecure(conn *UDPConn) error {
+	key, hello, err := p.secure.clientHello()
 	if err != nil {
 		return err
 	}
-
-	return nil
+	defer conn.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, p.maxLen())
+	deadline := time.Now().Add(secureHandshakeTimeout)
+	for time.Now().Before(deadline) {
+		if _, err = conn.conn.Write(hello); err != nil {
+			return err
+		}
+		_ = conn.conn.SetReadDeadline(time.Now().Add(secureRetryInterval))
+		n, err := conn.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		// anything else than the answer is late from an old session.
+		if s, err := p.secure.clientFinish(key, buf[:n]); err == nil {
+			conn.secure.Store(s)
+			return nil
+		}
+	}
+	return errSecureHandshake
 }
@@ -1,11 +1,15 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"github.com/lircstar/nemo/sys/log"
 	"github.com/lircstar/nemo/sys/pool"
 	"github.com/lircstar/nemo/sys/util"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,8 +20,12 @@ type UDPServer struct {
 	ln         *net.UDPConn
 	agents     *util.SafeMap
 	connPool   *pool.ObjectPool
+	maxConnNum atomic.Int64
 
-	wgLn sync.WaitGroup
+	wgLn     sync.WaitGroup
+	wgAgents sync.WaitGroup
+	// the datagrams are handled at once, the agent of a new peer is made under it.
+	newMu sync.Mutex
 
 	// msg
 	MinMsgLen int
@@ -26,14 +34,30 @@ type UDPServer struct {
 	LittleEndian bool
 	msgParser    *UdpMsgParser
 
+	// encrypted session required from every peer, nil for plain messages.
+	Secure *SecureConfig
+	// channels of reliable and unreliable messages, see channel.go, nil for raw
+	// datagrams.
+	Reliable *ARQConfig
+	// make the agents by the handshake of udp_session.go and key them by session id
+	// instead of address, the clients need it too.
+	Handshake bool
+	cookies   *sessionCookies
+
+	// refuses the peers over the limits of their ip, nil for no limit.
+	IPLimiter *IPLimiter
+
 	timeEvent chan Conn
+	closeChan chan struct{}
 	running   bool // is server running?
+	draining  atomic.Bool
 }
 
 func (server *UDPServer) Start(addr string) {
 	server.Addr = addr
 	server.init()
-	go server.run()
+	// listen before returning, the peers are served by the goroutines of run.
+	server.run()
 }
 
 func (server *UDPServer) init() {
@@ -44,6 +68,7 @@ func (server *UDPServer) init() {
 		server.MaxConnNum = 100
 		log.Warnf("invalid UDP Server MaxConnNum, reset to %v", server.MaxConnNum)
 	}
+	server.maxConnNum.Store(int64(server.MaxConnNum))
 
 	server.agents = util.NewSafeMap(server.MaxConnNum)
 
@@ -54,9 +79,17 @@ func (server *UDPServer) init() {
 	msgParser := newUdpMsgParser()
 	msgParser.SetMsgLen(server.MinMsgLen, server.MaxMsgLen)
 	msgParser.SetByteOrder(server.LittleEndian)
+	msgParser.SetSecure(server.Secure)
+	msgParser.SetReliable(server.Reliable)
+	msgParser.SetHandshake(server.Handshake)
 	server.msgParser = msgParser
 
+	if server.Handshake {
+		server.cookies = newSessionCookies()
+	}
+
 	server.timeEvent = make(chan Conn, 1024)
+	server.closeChan = make(chan struct{})
 }
 
 func (server *UDPServer) run() {
@@ -65,7 +98,7 @@ func (server *UDPServer) run() {
 
 	addr, err := net.ResolveUDPAddr("udp", server.Addr)
 	if err != nil {
-		log.Errorf("udp address error %s; %v", server.Addr, err.Error())
+		log.With("addr", server.Addr).Errorf("udp address error; %v", err)
 		return
 	}
 	//addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9981}
@@ -75,12 +108,14 @@ func (server *UDPServer) run() {
 		log.Errorf("udp listen error; %v", err.Error())
 		return
 	}
+	// the port chosen for port 0.
+	server.Addr = server.ln.LocalAddr().String()
 
 	if server.agents.Len() >= server.MaxConnNum {
 		log.Debug("udp server too many connections")
 	}
 
-	log.Infof("# UDP server started. %s", server.Addr)
+	log.With("addr", server.Addr).Info("# UDP server started.")
 
 	go server.accept()
 	server.running = true
@@ -88,21 +123,31 @@ func (server *UDPServer) run() {
 }
 
 func (server *UDPServer) accept() {
-	recvBuff := make([]byte, server.MaxMsgLen)
 	for {
+		// every datagram has its own buffer, it is handled by a goroutine while the
+		// next one is read. The buffer is owned by the agent running it.
+		recvBuff := allocBuffer(server.msgParser.maxLen())
 		n, remoteAddr, err := server.ln.ReadFromUDP(recvBuff)
 		if err != nil {
+			freeBuffer(recvBuff)
 			log.Warnf("failed to udp read; err:%v", err.Error())
 			break
 		}
 
 		if n > 0 && n >= server.MinMsgLen {
 			go func() { // adjust go function to improve speed.
-				agent := server.getAgent(remoteAddr)
-				if agent != nil {
-					agent.Run(recvBuff[:n])
+				agent, data := server.getAgent(remoteAddr, recvBuff[:n])
+				if agent == nil || data == nil {
+					freeBuffer(recvBuff)
+				} else if conn := agent.GetConn().(*UDPConn); conn.channels != nil {
+					conn.receive(agent, data)
+					freeBuffer(recvBuff)
+				} else {
+					agent.Run(data)
 				}
 			}()
+		} else {
+			freeBuffer(recvBuff)
 		}
 	}
 
@@ -122,28 +167,235 @@ func (server *UDPServer) createConn() *UDPConn {
 	return conn.(*UDPConn)
 }
 
-func (server *UDPServer) getAgent(addr *net.UDPAddr) Agent {
-	key := newConnTrackKey(addr)
-	tmp, ok := server.agents.Load(*key)
-	var agent Agent
+// getAgent get the agent of addr, a new one for a new peer, and the message of data to
+// run, nil if there is none.
+func (server *UDPServer) getAgent(addr *net.UDPAddr, data []byte) (Agent, []byte) {
+	if server.Handshake {
+		return server.getSession(addr, data)
+	}
+	key := *newConnTrackKey(addr)
+	if tmp, ok := server.agents.Load(key); ok {
+		return server.peerMsg(tmp.(Agent), data)
+	}
+	return server.newPeer(addr, key, data)
+}
+
+// peerMsg get the message of data from the peer of agent.
+func (server *UDPServer) peerMsg(agent Agent, data []byte) (Agent, []byte) {
+	if server.Secure != nil {
+		return agent, server.openSecure(agent.GetConn().(*UDPConn), data)
+	}
+	return agent, data
+}
+
+// newPeer make the agent of the peer at addr. Of the datagrams of a new peer handled
+// at once, the first makes the agent and the others are run by it.
+func (server *UDPServer) newPeer(addr *net.UDPAddr, key connTrackKey, data []byte) (Agent, []byte) {
+	server.newMu.Lock()
+	defer server.newMu.Unlock()
+	if tmp, ok := server.agents.Load(key); ok {
+		return server.peerMsg(tmp.(Agent), data)
+	}
+
+	if server.refuse(addr) {
+		return nil, nil
+	}
+	// a secure peer starts by its hello.
+	var session *secureSession
+	var answer []byte
+	if server.Secure != nil {
+		var err error
+		if session, answer, err = server.Secure.serverAnswer(data); err != nil {
+			server.IPLimiter.release(addr.IP.String())
+			log.With("remote", addr).Debugf("drop datagram: %v", err)
+			return nil, nil
+		}
+	}
+
+	conn := server.newConn(addr, key, 0, session)
+	if session != nil {
+		conn.secureHello = bytes.Clone(data)
+		conn.secureAnswer = answer
+		_, _ = server.ln.WriteToUDP(answer, addr)
+	}
+	agent := server.startAgent(conn)
+	if session != nil {
+		return agent, nil
+	}
+	return agent, data
+}
+
+// getSession is getAgent with the handshake, the agent of a session is made by its
+// open.
+func (server *UDPServer) getSession(addr *net.UDPAddr, data []byte) (Agent, []byte) {
+	switch data[0] {
+	case sessionConnect:
+		if len(data) >= sessionConnectLen && !server.draining.Load() {
+			_, _ = server.ln.WriteToUDP(server.cookies.answer(addr, time.Now()), addr)
+		}
+		return nil, nil
+	case sessionOpen:
+		server.openSession(addr, data[1:])
+		return nil, nil
+	}
+
+	sid := sessionIDOf(data)
+	if sid == 0 {
+		return nil, nil
+	}
+	tmp, ok := server.agents.Load(sid)
 	if !ok {
-		conn := server.createConn()
-		conn.timeEvent = server.timeEvent
-		conn.closeFlag.Store(false)
-		conn.conn = server.ln
-		conn.remote = addr
-		conn.key = key
-		agent = server.NewAgent(conn)
-		agent.SetType(TYPE_AGENT_UDP)
-		conn.agent = agent
-		server.agents.Store(*key, agent)
-		agent.OnConnect()
-	} else {
-		agent = tmp.(Agent)
+		// the client of a session gone learns it at once.
+		if data[0] == sessionData {
+			msg := make([]byte, sessionHeadLen)
+			msg[0] = sessionClose
+			binary.BigEndian.PutUint64(msg[1:], sid)
+			_, _ = server.ln.WriteToUDP(msg, addr)
+		}
+		return nil, nil
+	}
+	agent := tmp.(Agent)
+	conn := agent.GetConn().(*UDPConn)
+	kind, payload := conn.sessionPayload(data)
+	if kind == sessionClose {
+		if conn.closeAuthentic(payload) {
+			conn.close(false)
+		}
+		return nil, nil
+	}
+	if s := conn.secure.Load(); s != nil {
+		var err error
+		if payload, err = s.open(payload); err != nil {
+			log.With("remote", addr).Debugf("drop datagram: %v", err)
+			return nil, nil
+		}
+	}
+	if remote := conn.remote.Load(); !remote.IP.Equal(addr.IP) || remote.Port != addr.Port {
+		log.With("remote", addr).Debugf("session migrated from %v", remote)
+		conn.remote.Store(addr)
+	}
+	return agent, payload
+}
+
+// openSession make the agent of the session of a live cookie, the accept of a session
+// already made is sent again.
+func (server *UDPServer) openSession(addr *net.UDPAddr, data []byte) {
+	if len(data) < cookieLen || !server.cookies.verify(addr, data[:cookieLen], time.Now()) {
+		log.With("remote", addr).Debug("drop datagram: invalid session cookie")
+		return
+	}
+	sid := server.cookies.sessionID(data[:cookieLen])
+	server.newMu.Lock()
+	defer server.newMu.Unlock()
+	if tmp, ok := server.agents.Load(sid); ok {
+		conn := tmp.(Agent).GetConn().(*UDPConn)
+		_, _ = server.ln.WriteToUDP(conn.sessionAccept, addr)
+		return
+	}
+	if server.refuse(addr) {
+		return
+	}
+
+	accept := make([]byte, sessionHeadLen)
+	accept[0] = sessionAccept
+	binary.BigEndian.PutUint64(accept[1:], sid)
+	var session *secureSession
+	if server.Secure != nil {
+		var answer []byte
+		var err error
+		if session, answer, err = server.Secure.serverAnswer(data[cookieLen:]); err != nil {
+			server.IPLimiter.release(addr.IP.String())
+			log.With("remote", addr).Debugf("drop datagram: %v", err)
+			return
+		}
+		accept = append(accept, answer...)
+	}
+
+	conn := server.newConn(addr, sid, sid, session)
+	conn.sessionAccept = accept
+	_, _ = server.ln.WriteToUDP(accept, addr)
+	server.startAgent(conn)
+}
+
+// refuse tell whether a new peer at addr is refused, while draining, when there are
+// too many or by the IPLimiter. A peer not refused is counted by the IPLimiter until
+// its conn is freed.
+func (server *UDPServer) refuse(addr *net.UDPAddr) bool {
+	if server.draining.Load() {
+		return true
+	}
+	if int64(server.agents.Len()) >= server.maxConnNum.Load() {
+		metricRejected.Inc(transportUDP)
+		log.With("remote", addr).Debug("too many connections")
+		return true
+	}
+	if !server.IPLimiter.acquire(addr.IP.String()) {
+		metricRejected.Inc(transportUDP)
+		log.With("remote", addr).Debug("ip refused")
+		return true
 	}
+	return false
+}
+
+// newConn get a conn of the pool for the peer at addr, its agent is stored by key.
+func (server *UDPServer) newConn(addr *net.UDPAddr, key any, sid uint64, session *secureSession) *UDPConn {
+	conn := server.createConn()
+	conn.timeEvent = server.timeEvent
+	conn.closeFlag.Store(false)
+	conn.conn = server.ln
+	conn.remote.Store(addr)
+	conn.limitIP = addr.IP.String()
+	conn.key = key
+	conn.sid = sid
+	conn.sessionAccept = nil
+	conn.secure.Store(session)
+	conn.channels = nil
+	if server.Reliable != nil {
+		conn.startChannels(server.Reliable)
+	}
+	return conn
+}
+
+// startAgent make the agent of conn and connect it.
+func (server *UDPServer) startAgent(conn *UDPConn) Agent {
+	agent := server.NewAgent(conn)
+	agent.SetType(TYPE_AGENT_UDP)
+	conn.agent = agent
+	server.wgAgents.Add(1)
+	metricAccepted.Inc(transportUDP)
+	metricConns.Inc(transportUDP)
+	server.agents.Store(conn.key, agent)
+	agent.OnConnect()
 	return agent
 }
 
+// openSecure get the plain of data from the peer of conn, nil if it is a hello or not
+// authentic. A hello seen is answered again, a new one opens a new session.
+func (server *UDPServer) openSecure(conn *UDPConn, data []byte) []byte {
+	if isSecureHello(data) {
+		conn.secureMu.Lock()
+		defer conn.secureMu.Unlock()
+		if !bytes.Equal(data, conn.secureHello) {
+			session, answer, err := server.Secure.serverAnswer(data)
+			if err != nil {
+				return nil
+			}
+			conn.secure.Store(session)
+			conn.secureHello = bytes.Clone(data)
+			conn.secureAnswer = answer
+		}
+		_, _ = server.ln.WriteToUDP(conn.secureAnswer, conn.remote.Load())
+		return nil
+	}
+
+	plain, err := conn.secure.Load().open(data)
+	if err != nil {
+		log.With("remote", conn.RemoteAddr()).Debugf("drop datagram: %v", err)
+		return nil
+	}
+	return plain
+}
+
 func (server *UDPServer) delConn(conn *UDPConn) {
 	if conn != nil {
 		if server.connPool != nil {
@@ -156,18 +408,7 @@ func (server *UDPServer) Close() {
 	_ = server.ln.Close()
 	server.wgLn.Wait()
 
-	server.running = false
-	// connection pool
-	server.connPool.Range(func(i any) {
-		if i != nil {
-			conn := i.(*UDPConn).conn
-			if conn != nil {
-				_ = conn.Close()
-			}
-		}
-	})
-	server.connPool = nil
-
+	// the agents closed are removed by goRun.
 	server.agents.Range(func(key any, agent any) bool {
 		if agent != nil {
 			agent := agent.(Agent)
@@ -175,23 +416,74 @@ func (server *UDPServer) Close() {
 		}
 		return true
 	})
+	server.wgAgents.Wait()
 
-	server.agents = nil
+	server.running = false
+	close(server.closeChan)
 }
 
 func (server *UDPServer) goRun() {
 
-	for server.running {
+	for {
 		select {
 		case conn := <-server.timeEvent:
 			udpConn := conn.(*UDPConn)
-			server.delConn(udpConn)
-
-			if udpConn.agent != nil {
+			agent := udpConn.agent
+			if agent != nil {
 				server.agents.Delete(udpConn.key)
-				udpConn.agent.OnClose()
+				server.IPLimiter.release(udpConn.limitIP)
+				agent.OnClose()
+				metricConns.Dec(transportUDP)
 			}
-		case <-time.After(time.Second * 60):
+			// freed last, a new peer may take it from the pool, and then Shutdown
+			// may return.
+			server.delConn(udpConn)
+			if agent != nil {
+				server.wgAgents.Done()
+			}
+		case <-server.closeChan:
+			return
 		}
 	}
 }
+
+// Shutdown stop taking new peers and tell every agent by OnDraining before closing
+// it. It returns when all agents are closed or ctx is done, the socket is kept open
+// until then for the last messages.
+func (server *UDPServer) Shutdown(ctx context.Context) error {
+	server.draining.Store(true)
+
+	var agents []Agent
+	server.agents.Range(func(key any, agent any) bool {
+		agents = append(agents, agent.(Agent))
+		return true
+	})
+
+	for _, agent := range agents {
+		agent.OnDraining()
+	}
+	for _, agent := range agents {
+		agent.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wgAgents.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetMaxConnNum change MaxConnNum while the server runs, peers over it are kept.
+func (server *UDPServer) SetMaxConnNum(n int) {
+	if n > 0 {
+		server.MaxConnNum = n
+		server.maxConnNum.Store(int64(n))
+	}
+}
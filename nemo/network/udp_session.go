@@ -0,0 +1,242 @@
+package network
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// -------------------------------------------------------------------------------------
+// UDP sessions.
+//
+// With the handshake a server makes no agent before the client proves it reads the
+// datagrams sent to its address, and keys its agents by a session id instead of the
+// address, so a client whose address changes keeps its session:
+//
+//	| sessionConnect | padding |                    client, padded to sessionConnectLen
+//	| sessionCookie | ts | mac |                    server, nothing is kept
+//	| sessionOpen | ts | mac | secure hello |       client, the cookie sent back
+//	| sessionAccept | session id | secure answer |  server, the agent is made
+//
+// The cookie is the mac of the address of the client and a time by a secret of the
+// server, it is valid for sessionCookieLifetime. The session id is derived from the
+// cookie, so the open sent again gets the same accept. Every later datagram carries
+// the session id, and the peers tell the end of the session:
+//
+//	| sessionData | session id | message |
+//	| sessionClose | session id | sealed nothing |
+//
+// The server takes the address of the last datagram of a session as the address of
+// its client. A secure one first checks that the datagram is authentic, a plain one
+// trusts anyone knowing the session id. A plain close is refused by a secure peer, so
+// the close a server sends for a session it does not know is heard by plain clients
+// only.
+
+const (
+	sessionConnect = 1
+	sessionCookie  = 2
+	sessionOpen    = 3
+	sessionAccept  = 4
+	sessionData    = 5
+	sessionClose   = 6
+
+	sessionIDLen   = 8
+	sessionHeadLen = 1 + sessionIDLen
+	cookieMacLen   = 16
+	cookieLen      = 4 + cookieMacLen
+
+	// sessionConnectLen is the min size of a connect, the cookie answering it is not
+	// bigger so a spoofed connect is not amplified.
+	sessionConnectLen = 64
+
+	sessionCookieLifetime = 10 * time.Second
+	sessionRetryInterval  = 500 * time.Millisecond
+)
+
+var (
+	errSessionHandshake = errors.New("udp session handshake failed")
+	errSessionClosed    = errors.New("udp session closed by peer")
+)
+
+// sessionCookies makes and checks the cookies of a server.
+type sessionCookies struct {
+	secret [32]byte
+}
+
+func newSessionCookies() *sessionCookies {
+	c := new(sessionCookies)
+	if _, err := rand.Read(c.secret[:]); err != nil {
+		log.Fatalf("udp session secret: %v", err)
+	}
+	return c
+}
+
+// mac get the mac of addr at ts.
+func (c *sessionCookies) mac(addr *net.UDPAddr, ts uint32) []byte {
+	h := hmac.New(sha256.New, c.secret[:])
+	var b [4 + net.IPv6len + 2]byte
+	binary.BigEndian.PutUint32(b[:], ts)
+	copy(b[4:], addr.IP.To16())
+	binary.BigEndian.PutUint16(b[4+net.IPv6len:], uint16(addr.Port))
+	h.Write(b[:])
+	return h.Sum(nil)[:cookieMacLen]
+}
+
+// answer get the cookie datagram answering a connect from addr.
+func (c *sessionCookies) answer(addr *net.UDPAddr, now time.Time) []byte {
+	msg := make([]byte, 1+4, 1+cookieLen)
+	msg[0] = sessionCookie
+	ts := uint32(now.Unix())
+	binary.BigEndian.PutUint32(msg[1:], ts)
+	return append(msg, c.mac(addr, ts)...)
+}
+
+// verify tell whether cookie is a live one of addr.
+func (c *sessionCookies) verify(addr *net.UDPAddr, cookie []byte, now time.Time) bool {
+	if len(cookie) != cookieLen {
+		return false
+	}
+	ts := binary.BigEndian.Uint32(cookie)
+	age := now.Unix() - int64(ts)
+	if age < -1 || age > int64(sessionCookieLifetime/time.Second) {
+		return false
+	}
+	return hmac.Equal(cookie[4:], c.mac(addr, ts))
+}
+
+// sessionID get the session id of cookie, never 0.
+func (c *sessionCookies) sessionID(cookie []byte) uint64 {
+	h := hmac.New(sha256.New, c.secret[:])
+	h.Write([]byte("session"))
+	h.Write(cookie)
+	if id := binary.BigEndian.Uint64(h.Sum(nil)); id != 0 {
+		return id
+	}
+	return 1
+}
+
+// sessionIDOf get the session id of a datagram, 0 if it has none.
+func sessionIDOf(data []byte) uint64 {
+	if len(data) < sessionHeadLen || (data[0] != sessionData && data[0] != sessionClose) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data[1:])
+}
+
+//-------------------------------------------------------------------------------------
+// session of a conn.
+
+// sessionHead get the length of the session head of the datagrams of conn.
+func (conn *UDPConn) sessionHead() int {
+	if conn.sid == 0 {
+		return 0
+	}
+	return sessionHeadLen
+}
+
+// putSessionHead write the data head of the session of conn at the start of b.
+func (conn *UDPConn) putSessionHead(b []byte) {
+	if conn.sid != 0 {
+		b[0] = sessionData
+		binary.BigEndian.PutUint64(b[1:], conn.sid)
+	}
+}
+
+// sessionPayload get the kind of a datagram of the session of conn and its payload,
+// moved to the start of data so the buffer of data keeps holding it. The payload is
+// nil if data is not of the session.
+func (conn *UDPConn) sessionPayload(data []byte) (byte, []byte) {
+	if sessionIDOf(data) != conn.sid {
+		return 0, nil
+	}
+	kind := data[0]
+	return kind, data[:copy(data, data[sessionHeadLen:])]
+}
+
+// closeAuthentic tell whether the payload of a close is from the peer of conn.
+func (conn *UDPConn) closeAuthentic(payload []byte) bool {
+	s := conn.secure.Load()
+	if s == nil {
+		return true
+	}
+	_, err := s.open(payload)
+	return err == nil
+}
+
+// sendClose tell the peer the session is over.
+func (conn *UDPConn) sendClose() {
+	msg := allocBuffer(sessionHeadLen + secureOverhead)
+	defer freeBuffer(msg)
+	data := msg[:sessionHeadLen]
+	if s := conn.secure.Load(); s != nil {
+		data = s.seal(data, nil)
+	}
+	data[0] = sessionClose
+	binary.BigEndian.PutUint64(data[1:], conn.sid)
+	_ = conn.writeTo(data)
+}
+
+//-------------------------------------------------------------------------------------
+// handshake of a client.
+
+// dialSession open the session of a client conn, and its encrypted session if the
+// parser is secure. The connect, then the open, are sent again until they are
+// answered.
+func (p *UdpMsgParser) dialSession(conn *UDPConn) error {
+	var key *ecdh.PrivateKey
+	var hello []byte
+	if p.secure != nil {
+		var err error
+		if key, hello, err = p.secure.clientHello(); err != nil {
+			return err
+		}
+	}
+	defer conn.conn.SetReadDeadline(time.Time{})
+
+	msg := make([]byte, sessionConnectLen)
+	msg[0] = sessionConnect
+	opening := false
+	buf := make([]byte, p.maxLen())
+	deadline := time.Now().Add(sessionCookieLifetime)
+	for time.Now().Before(deadline) {
+		if _, err := conn.conn.Write(msg); err != nil {
+			return err
+		}
+		_ = conn.conn.SetReadDeadline(time.Now().Add(sessionRetryInterval))
+		n, err := conn.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		// anything else is late from an old session.
+		data := buf[:n]
+		switch {
+		case !opening && n == 1+cookieLen && data[0] == sessionCookie:
+			msg = append([]byte{sessionOpen}, data[1:]...)
+			msg = append(msg, hello...)
+			opening = true
+		case opening && n >= sessionHeadLen && data[0] == sessionAccept:
+			if p.secure != nil {
+				s, err := p.secure.clientFinish(key, data[sessionHeadLen:])
+				if err != nil {
+					continue
+				}
+				conn.secure.Store(s)
+			}
+			conn.sid = binary.BigEndian.Uint64(data[1:])
+			return nil
+		}
+	}
+	return errSessionHandshake
+}
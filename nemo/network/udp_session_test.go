@@ -0,0 +1,321 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rawUDP is a socket talking to a server on the wire.
+type rawUDP struct {
+	t    *testing.T
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func dialRawUDP(t *testing.T, addr string) *rawUDP {
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &rawUDP{t: t, conn: conn, buf: make([]byte, 4096)}
+}
+
+func (c *rawUDP) write(parts ...[]byte) {
+	if _, err := c.conn.Write(bytes.Join(parts, nil)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read get the next datagram, nil if none comes in timeout.
+func (c *rawUDP) read(timeout time.Duration) []byte {
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := c.conn.Read(c.buf)
+	if err != nil {
+		return nil
+	}
+	return bytes.Clone(c.buf[:n])
+}
+
+func sessionHeadOf(kind byte, sid uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{kind}, sid)
+}
+
+func TestSessionHandshake(t *testing.T) {
+	agents := make(chan *testAgent, 2)
+	addr := freeUDPAddr(t)
+	server := &UDPServer{
+		MaxConnNum: 10,
+		MinMsgLen:  1,
+		MaxMsgLen:  4096,
+		Handshake:  true,
+		NewAgent: func(conn Conn) Agent {
+			a := newTestAgent(conn, true)
+			agents <- a
+			return a
+		},
+	}
+	server.Start(addr)
+	defer server.Close()
+	c := dialRawUDP(t, addr)
+
+	// the datagrams of no session make no agent.
+	c.write([]byte("hello"))
+	c.write(sessionHeadOf(sessionData, 42), []byte("hello"))
+	if got := c.read(time.Second); !bytes.Equal(got, sessionHeadOf(sessionClose, 42)) {
+		t.Fatalf("unknown session answered %q", got)
+	}
+	c.write([]byte{sessionConnect})
+	if got := c.read(200 * time.Millisecond); got != nil {
+		t.Fatal("short connect answered")
+	}
+
+	connect := make([]byte, sessionConnectLen)
+	connect[0] = sessionConnect
+	c.write(connect)
+	cookie := c.read(time.Second)
+	if len(cookie) != 1+cookieLen || cookie[0] != sessionCookie {
+		t.Fatalf("cookie %q", cookie)
+	}
+	if server.agents.Len() != 0 {
+		t.Fatal("agent made by a connect")
+	}
+
+	// the cookie of another address is refused.
+	other := dialRawUDP(t, addr)
+	other.write([]byte{sessionOpen}, cookie[1:])
+	if got := other.read(200 * time.Millisecond); got != nil {
+		t.Fatalf("cookie of another address accepted: %q", got)
+	}
+	forged := bytes.Clone(cookie)
+	forged[len(forged)-1] ^= 1
+	c.write([]byte{sessionOpen}, forged[1:])
+	if got := c.read(200 * time.Millisecond); got != nil {
+		t.Fatalf("forged cookie accepted: %q", got)
+	}
+
+	c.write([]byte{sessionOpen}, cookie[1:])
+	accept := c.read(time.Second)
+	if len(accept) != sessionHeadLen || accept[0] != sessionAccept {
+		t.Fatalf("accept %q", accept)
+	}
+	sid := binary.BigEndian.Uint64(accept[1:])
+	a := <-agents
+
+	// a lost accept is sent again, with no new agent.
+	c.write([]byte{sessionOpen}, cookie[1:])
+	if got := c.read(time.Second); !bytes.Equal(got, accept) {
+		t.Fatalf("accept changed: %q", got)
+	}
+	if server.agents.Len() != 1 {
+		t.Fatalf("%d agents", server.agents.Len())
+	}
+
+	head := sessionHeadOf(sessionData, sid)
+	c.write(head, []byte("hello"))
+	if got := c.read(time.Second); !bytes.Equal(got, append(head, "hello"...)) {
+		t.Fatalf("echo %q", got)
+	}
+
+	// the session follows its client to a new address.
+	other.write(head, []byte("moved"))
+	if got := other.read(time.Second); !bytes.Equal(got, append(head, "moved"...)) {
+		t.Fatalf("echo after migration %q", got)
+	}
+	if server.agents.Len() != 1 {
+		t.Fatalf("%d agents after migration", server.agents.Len())
+	}
+
+	other.write(sessionHeadOf(sessionClose, sid))
+	select {
+	case <-a.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("agent not closed by the close of its client")
+	}
+}
+
+func TestSessionUDP(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		for _, reliable := range []*ARQConfig{nil, {MTU: 512}} {
+			t.Run(fmt.Sprintf("secure=%v/reliable=%v", secure, reliable != nil), func(t *testing.T) {
+				var serverConfig, clientConfig *SecureConfig
+				if secure {
+					serverConfig, clientConfig = newTestSecure(t)
+				}
+				serverAgents := make(chan *testAgent, 1)
+				addr := freeUDPAddr(t)
+				server := &UDPServer{
+					MaxConnNum: 10,
+					MinMsgLen:  1,
+					MaxMsgLen:  4096,
+					Secure:     serverConfig,
+					Reliable:   reliable,
+					Handshake:  true,
+					NewAgent: func(conn Conn) Agent {
+						a := newTestAgent(conn, true)
+						serverAgents <- a
+						return a
+					},
+				}
+				server.Start(addr)
+				defer server.Close()
+
+				agents := make(chan *testAgent, 1)
+				client := &UDPClient{
+					Addr:      addr,
+					MinMsgLen: 1,
+					MaxMsgLen: 4096,
+					TimeOut:   60,
+					Secure:    clientConfig,
+					Reliable:  reliable,
+					Handshake: true,
+					NewAgent: func(conn Conn) Agent {
+						a := newTestAgent(conn, false)
+						agents <- a
+						return a
+					},
+				}
+				client.Start()
+
+				var a *testAgent
+				select {
+				case a = <-agents:
+				case <-time.After(3 * time.Second):
+					t.Fatal("client not connected")
+				}
+				for i := 0; i < 10; i++ {
+					if err := a.conn.WriteMsg(testMessage(i)); err != nil {
+						t.Fatal(err)
+					}
+					if got := a.recv(t); !bytes.Equal(got, testMessage(i)) {
+						t.Fatalf("echo %d: got %d bytes", i, len(got))
+					}
+				}
+
+				// the server hears the client leave.
+				serverAgent := <-serverAgents
+				client.Close()
+				select {
+				case <-serverAgent.closed:
+				case <-time.After(3 * time.Second):
+					t.Fatal("server agent not closed")
+				}
+			})
+		}
+	}
+}
+
+func TestSessionServerClose(t *testing.T) {
+	addr := freeUDPAddr(t)
+	server := &UDPServer{
+		MaxConnNum: 10,
+		MinMsgLen:  1,
+		MaxMsgLen:  4096,
+		Handshake:  true,
+		NewAgent: func(conn Conn) Agent {
+			return newTestAgent(conn, true)
+		},
+	}
+	server.Start(addr)
+	defer server.Close()
+
+	agents := make(chan *testAgent, 1)
+	client := &UDPClient{
+		Addr:      addr,
+		MinMsgLen: 1,
+		MaxMsgLen: 4096,
+		TimeOut:   60,
+		Handshake: true,
+		NewAgent: func(conn Conn) Agent {
+			a := newTestAgent(conn, false)
+			agents <- a
+			return a
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	var a *testAgent
+	select {
+	case a = <-agents:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not connected")
+	}
+	// the agent is closed once it is stored, as its conn knows it.
+	var serverAgent Agent
+	for serverAgent == nil {
+		server.agents.Range(func(key any, agent any) bool {
+			serverAgent = agent.(Agent)
+			return false
+		})
+		time.Sleep(10 * time.Millisecond)
+	}
+	serverAgent.Close()
+	select {
+	case <-a.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not closed by the server")
+	}
+}
+
+func TestUDPNewPeerBurst(t *testing.T) {
+	for _, handshake := range []bool{false, true} {
+		t.Run(fmt.Sprintf("handshake=%v", handshake), func(t *testing.T) {
+			var made atomic.Int32
+			addr := freeUDPAddr(t)
+			server := &UDPServer{
+				MaxConnNum: 100,
+				MinMsgLen:  1,
+				MaxMsgLen:  4096,
+				Handshake:  handshake,
+				NewAgent: func(conn Conn) Agent {
+					made.Add(1)
+					// widen the window of the datagrams handled at once.
+					time.Sleep(10 * time.Millisecond)
+					return newTestAgent(conn, true)
+				},
+			}
+			server.Start(addr)
+			c := dialRawUDP(t, addr)
+
+			// the first datagrams of a peer are handled at once.
+			msg := []byte("hello")
+			if handshake {
+				connect := make([]byte, sessionConnectLen)
+				connect[0] = sessionConnect
+				c.write(connect)
+				cookie := c.read(time.Second)
+				msg = append([]byte{sessionOpen}, cookie[1:]...)
+			}
+			const burst = 50
+			for i := 0; i < burst; i++ {
+				c.write(msg)
+			}
+			for i := 0; i < burst; i++ {
+				if c.read(time.Second) == nil {
+					t.Fatalf("%d answers", i)
+				}
+			}
+			if n := made.Load(); n != 1 || server.agents.Len() != 1 {
+				t.Fatalf("%d agents made, %d stored", n, server.agents.Len())
+			}
+
+			closed := make(chan struct{})
+			go func() {
+				server.Close()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(3 * time.Second):
+				t.Fatal("server not closed")
+			}
+		})
+	}
+}
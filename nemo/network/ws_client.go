@@ -1,8 +1,10 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"sync/atomic"
 	"time"
 
 	"github.com/lircstar/nemo/sys/log"
@@ -16,12 +18,17 @@ type WSClient struct {
 	LittleEndian     bool
 	HandshakeTimeout time.Duration
 	AutoReconnect    bool
-	agent            Agent
+	reconnect        reconnectOption
+	agent            clientAgent
 	NewAgent         func(Conn) Agent
 	dialer           websocket.Dialer
 	conn             *websocket.Conn
-	closeFlag        bool
-	connected        bool
+	closeFlag        atomic.Bool
+	connected        atomic.Bool
+
+	// permessage-deflate, messages of at least CompressThreshold bytes are compressed.
+	Compression       bool
+	CompressThreshold int
 }
 
 func (client *WSClient) Start() {
@@ -35,6 +42,7 @@ func (client *WSClient) init() {
 		client.ConnectInterval = 3 * time.Second
 		log.Infof("invalid ConnectInterval, reset to %v", client.ConnectInterval)
 	}
+	client.reconnect.set(client.AutoReconnect, client.ConnectInterval)
 	if client.PendingWriteNum <= 0 {
 		client.PendingWriteNum = 100
 		log.Infof("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
@@ -54,23 +62,24 @@ func (client *WSClient) init() {
 		log.Fatal("client is running")
 	}
 
-	client.closeFlag = false
+	client.closeFlag.Store(false)
 
 	client.dialer = websocket.Dialer{
-		HandshakeTimeout: client.HandshakeTimeout,
+		HandshakeTimeout:  client.HandshakeTimeout,
+		EnableCompression: client.Compression,
 	}
 }
 
 func (client *WSClient) dial() *websocket.Conn {
 	for {
 		conn, _, err := client.dialer.Dial(client.Addr, nil)
-		if err == nil || client.closeFlag {
+		if err == nil || client.closeFlag.Load() {
 			fmt.Printf("connect to %v success\n", client.Addr)
 			return conn
 		}
 
-		log.Errorf("connect to %v error: %v", client.Addr, err)
-		time.Sleep(client.ConnectInterval)
+		log.With("addr", client.Addr).Errorf("connect error: %v", err)
+		client.reconnect.wait()
 		continue
 	}
 }
@@ -84,7 +93,7 @@ reconnect:
 	}
 	conn.SetReadLimit(int64(client.MaxMsgLen))
 
-	if client.closeFlag {
+	if client.closeFlag.Load() {
 		err := conn.Close()
 		if err != nil {
 			return
@@ -94,34 +103,52 @@ reconnect:
 
 	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen)
 	wsConn.conn = conn
+	wsConn.compressThreshold = client.CompressThreshold
 	wsConn.start()
-	client.agent = client.NewAgent(wsConn)
-	client.agent.SetType(TYPE_CLIENT_WEBSOCKET)
-	client.agent.OnConnect()
-	client.agent.Run(nil)
-	client.connected = false
+	client.connected.Store(true)
+	agent := client.NewAgent(wsConn)
+	agent.SetType(TYPE_CLIENT_WEBSOCKET)
+	client.agent.set(agent)
+	agent.OnConnect()
+	agent.Run(nil)
+	client.connected.Store(false)
 
 	// cleanup
 	wsConn.Close()
 	conn = nil
 	wsConn = nil
-	client.agent.OnClose()
-	client.agent = nil
+	agent.OnClose()
+	client.agent.set(nil)
 
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
+	if client.reconnect.auto.Load() && !client.closeFlag.Load() {
+		client.reconnect.wait()
 		goto reconnect
 	}
 }
 
 func (client *WSClient) Send(msg any) bool {
-	return client.agent.SendMessage(msg)
+	agent := client.agent.get()
+	if agent == nil {
+		return false
+	}
+	return agent.SendMessage(msg)
+}
+
+// Call send an rpc request to the server and wait for the response.
+func (client *WSClient) Call(ctx context.Context, req any) (any, error) {
+	agent := client.agent.get()
+	if agent == nil {
+		return nil, ErrNotConnected
+	}
+	return agent.Call(ctx, req)
 }
 
+// Close stop reconnecting and close the conn of the client.
 func (client *WSClient) Close() {
-	client.closeFlag = true
-	_ = client.conn.Close()
-	client.conn = nil
+	client.closeFlag.Store(true)
+	if agent := client.agent.get(); agent != nil {
+		agent.Close()
+	}
 }
 
 func (client *WSClient) GetType() uint {
@@ -133,9 +160,15 @@ func (client *WSClient) GetAddress() string {
 }
 
 func (client *WSClient) GetConnected() bool {
-	return client.connected
+	return client.connected.Load()
 }
 
 func (client *WSClient) GetAgent() Agent {
-	return client.agent
+	return client.agent.get()
+}
+
+// SetReconnect change AutoReconnect and ConnectInterval while the client runs.
+func (client *WSClient) SetReconnect(auto bool, interval time.Duration) {
+	client.AutoReconnect = auto
+	client.reconnect.set(auto, interval)
 }
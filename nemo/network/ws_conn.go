@@ -1,11 +1,13 @@
 package network
 
 import (
+	"encoding/binary"
 	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/lircstar/nemo/sys/log"
 	"net"
 	"sync/atomic"
+	"time"
 )
 
 type WebsocketConnSet map[*websocket.Conn]struct{}
@@ -16,7 +18,16 @@ type WSConn struct {
 	conn      *websocket.Conn
 	writeChan chan []byte
 	maxMsgLen int
-	closeFlag atomic.Bool
+	// messages of at least compressThreshold bytes are compressed if permessage-deflate
+	// is negotiated.
+	compressThreshold int
+	closeFlag         atomic.Bool
+	draining          atomic.Bool
+	agent             Agent
+
+	// heartbeat by ping frames, the pings carry their time.
+	rtt           RTTMeter
+	heartbeatTime atomic.Int64
 }
 
 func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen int) *WSConn {
@@ -28,25 +39,73 @@ func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen int) *WSConn
 }
 
 func (wsConn *WSConn) start() {
+	wsConn.rtt.Reset()
+	wsConn.heartbeatTime.Store(0)
+	wsConn.conn.SetPingHandler(wsConn.onPing)
+	wsConn.conn.SetPongHandler(wsConn.onPong)
 	go func() {
 		for b := range wsConn.writeChan {
 			if b == nil {
 				break
 			}
 
+			wsConn.conn.EnableWriteCompression(len(b) >= wsConn.compressThreshold)
 			err := wsConn.conn.WriteMessage(websocket.TextMessage, b)
 			if err != nil {
 				break
 			}
 		}
 
+		if wsConn.draining.Load() {
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+			_ = wsConn.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		}
 		_ = wsConn.conn.Close()
 		wsConn.closeFlag.Store(true)
 	}()
 }
 
+// Ping send a ping frame.
+func (wsConn *WSConn) Ping() error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(time.Now().UnixNano()))
+	return wsConn.conn.WriteControl(websocket.PingMessage, b[:], time.Now().Add(time.Second))
+}
+
+func (wsConn *WSConn) RTT() RTTStats {
+	return wsConn.rtt.Stats()
+}
+
+func (wsConn *WSConn) HeartbeatTime() int64 {
+	return wsConn.heartbeatTime.Load()
+}
+
+// onPing answer a ping of the peer, as the default handler does.
+func (wsConn *WSConn) onPing(data string) error {
+	wsConn.heartbeatTime.Store(time.Now().Unix())
+	err := wsConn.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	var ne net.Error
+	if err == websocket.ErrCloseSent || errors.As(err, &ne) && ne.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// onPong measure the round trip of a ping of Ping.
+func (wsConn *WSConn) onPong(data string) error {
+	now := time.Now()
+	wsConn.heartbeatTime.Store(now.Unix())
+	if len(data) == 8 {
+		sent := int64(binary.BigEndian.Uint64([]byte(data)))
+		if rtt := time.Duration(now.UnixNano() - sent); rtt >= 0 {
+			wsConn.rtt.Add(rtt)
+		}
+	}
+	return nil
+}
+
 func (wsConn *WSConn) doDestroy() {
-	wsConn.conn.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	setLinger(wsConn.conn.UnderlyingConn(), 0)
 	wsConn.conn.Close()
 
 	if !wsConn.closeFlag.Load() {
@@ -59,6 +118,22 @@ func (wsConn *WSConn) Destroy() {
 	wsConn.doDestroy()
 }
 
+// drain flush the pending writes and say going away before closing, writes after
+// deadline are given up.
+func (wsConn *WSConn) drain(deadline time.Time) {
+	if !deadline.IsZero() {
+		_ = wsConn.conn.SetWriteDeadline(deadline)
+	}
+	wsConn.draining.Store(true)
+	wsConn.Close()
+}
+
+// forceClose close the connection at once, the pending writes are dropped.
+func (wsConn *WSConn) forceClose() {
+	setLinger(wsConn.conn.UnderlyingConn(), 0)
+	_ = wsConn.conn.Close()
+}
+
 func (wsConn *WSConn) Close() {
 
 	if wsConn.closeFlag.Load() {
@@ -70,8 +145,10 @@ func (wsConn *WSConn) Close() {
 }
 
 func (wsConn *WSConn) doWrite(b []byte) {
+	observeWriteFill(transportWS, len(wsConn.writeChan), cap(wsConn.writeChan))
 	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
-		log.Info("close conn: channel full")
+		metricChanFull.Inc(transportWS)
+		log.With("remote", wsConn.RemoteAddr()).Info("close conn: channel full")
 		wsConn.doDestroy()
 		return
 	}
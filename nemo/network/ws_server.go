@@ -1,11 +1,13 @@
 package network
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/gorilla/websocket"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lircstar/nemo/nemo/conf"
@@ -23,18 +25,28 @@ type WSServer struct {
 	KeyFile         string
 	LittleEndian    bool
 	NewAgent        func(Conn) Agent
-	ln              net.Listener
-	handler         *WSHandler
+
+	// permessage-deflate, messages of at least CompressThreshold bytes are compressed.
+	Compression       bool
+	CompressThreshold int
+
+	// refuses the conns over the limits of their ip, nil for no limit.
+	IPLimiter *IPLimiter
+
+	ln      net.Listener
+	handler *WSHandler
 }
 
 type WSHandler struct {
-	maxConnNum      int
-	pendingWriteNum int
-	maxMsgLen       int
-	newAgent        func(Conn) Agent
-	upgrader        websocket.Upgrader
-	connPool        *pool.ObjectPool
-	wg              sync.WaitGroup
+	maxConnNum        atomic.Int64
+	pendingWriteNum   int
+	maxMsgLen         int
+	compressThreshold int
+	ipLimiter         *IPLimiter
+	newAgent          func(Conn) Agent
+	upgrader          websocket.Upgrader
+	connPool          *pool.ObjectPool
+	wg                sync.WaitGroup
 }
 
 func (handler *WSHandler) newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen int) *WSConn {
@@ -47,6 +59,7 @@ func (handler *WSHandler) newWSConn(conn *websocket.Conn, pendingWriteNum int, m
 
 	wsConn := handler.connPool.Get().(*WSConn)
 	wsConn.closeFlag.Store(false)
+	wsConn.draining.Store(false)
 	wsConn.conn = conn
 	return wsConn
 }
@@ -63,9 +76,17 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	ip := hostIP(r.RemoteAddr)
+	if !handler.ipLimiter.acquire(ip) {
+		metricRejected.Inc(transportWS)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		log.With("remote", r.RemoteAddr).Debug("ip refused")
+		return
+	}
+	defer handler.ipLimiter.release(ip)
 	conn, err := handler.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Debugf("upgrade error: %v", err)
+		log.With("remote", r.RemoteAddr).Debugf("upgrade error: %v", err)
 		return
 	}
 	conn.SetReadLimit(int64(handler.maxMsgLen))
@@ -77,16 +98,24 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		conn.Close()
 		return
 	}
-	if handler.connPool.UsedCount() >= handler.maxConnNum {
+	if int64(handler.connPool.UsedCount()) >= handler.maxConnNum.Load() {
+		metricRejected.Inc(transportWS)
 		conn.Close()
-		log.Warn("too many connections")
+		log.With("remote", conn.RemoteAddr()).Warn("too many connections")
 		return
 	}
 
+	metricAccepted.Inc(transportWS)
+	metricConns.Inc(transportWS)
+	defer metricConns.Dec(transportWS)
+
 	wsConn := handler.newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen)
+	wsConn.compressThreshold = handler.compressThreshold
 	wsConn.start()
 	agent := handler.newAgent(wsConn)
 	agent.SetType(TYPE_AGENT_WEBSOCKET)
+	wsConn.agent = agent
+	agent.OnConnect()
 	agent.Run(nil)
 
 	handler.delWSConn(wsConn)
@@ -104,12 +133,16 @@ func (server *WSServer) Start() {
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
+	// the port chosen for port 0.
+	server.Addr = ln.Addr().String()
 
 	if server.MaxConnNum <= 0 {
 		server.MaxConnNum = 100
 		log.Warnf("invalid MaxConnNum, reset to %v", server.MaxConnNum)
 	}
-	server.PendingWriteNum = config.PendingWriteNum
+	if server.PendingWriteNum <= 0 {
+		server.PendingWriteNum = config.PendingWriteNum
+	}
 	if server.PendingWriteNum <= 0 {
 		server.PendingWriteNum = 100
 		log.Warnf("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
@@ -119,7 +152,9 @@ func (server *WSServer) Start() {
 		server.MaxMsgLen = 4096
 		log.Warnf("invalid MaxMsgLen, reset to %v", server.MaxMsgLen)
 	}
-	server.HTTPTimeout = config.HTTPTimeout
+	if server.HTTPTimeout <= 0 {
+		server.HTTPTimeout = config.HTTPTimeout
+	}
 	if server.HTTPTimeout <= 0 {
 		server.HTTPTimeout = 10 * time.Second
 		log.Warnf("invalid HTTPTimeout, reset to %v", server.HTTPTimeout)
@@ -144,16 +179,19 @@ func (server *WSServer) Start() {
 
 	server.ln = ln
 	server.handler = &WSHandler{
-		maxConnNum:      server.MaxConnNum,
-		pendingWriteNum: server.PendingWriteNum,
-		maxMsgLen:       server.MaxMsgLen,
-		newAgent:        server.NewAgent,
-		connPool:        pool.NewObjectPool(),
+		pendingWriteNum:   server.PendingWriteNum,
+		maxMsgLen:         server.MaxMsgLen,
+		compressThreshold: server.CompressThreshold,
+		ipLimiter:         server.IPLimiter,
+		newAgent:          server.NewAgent,
+		connPool:          pool.NewObjectPool(),
 		upgrader: websocket.Upgrader{
-			HandshakeTimeout: server.HTTPTimeout,
-			CheckOrigin:      func(_ *http.Request) bool { return true },
+			HandshakeTimeout:  server.HTTPTimeout,
+			CheckOrigin:       func(_ *http.Request) bool { return true },
+			EnableCompression: server.Compression,
 		},
 	}
+	server.handler.maxConnNum.Store(int64(server.MaxConnNum))
 
 	httpServer := &http.Server{
 		Addr:           server.Addr,
@@ -182,3 +220,52 @@ func (server *WSServer) Close() {
 
 	server.handler.connPool = nil
 }
+
+// Shutdown stop accepting and tell every agent by OnDraining, then flush the write
+// queue of each connection before closing it. It returns when all agents are closed.
+// Connections still alive when ctx is done are closed at once.
+func (server *WSServer) Shutdown(ctx context.Context) error {
+	server.ln.Close()
+
+	var conns []*WSConn
+	server.handler.connPool.UsedRange(func(i any) {
+		conns = append(conns, i.(*WSConn))
+	})
+
+	for _, wsConn := range conns {
+		if wsConn.agent != nil {
+			wsConn.agent.OnDraining()
+		}
+	}
+
+	deadline, _ := ctx.Deadline()
+	for _, wsConn := range conns {
+		wsConn.drain(deadline)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.handler.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, wsConn := range conns {
+			wsConn.forceClose()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// SetMaxConnNum change MaxConnNum while the server runs, connections over it are
+// kept.
+func (server *WSServer) SetMaxConnNum(n int) {
+	if n > 0 && server.handler != nil {
+		server.MaxConnNum = n
+		server.handler.maxConnNum.Store(int64(n))
+	}
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/conf"
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+	"github.com/lircstar/nemo/sys/metrics"
+)
+
+// -------------------------------------------------------------------------------------
+// Admin http listener of the process.
+//
+//	GET  /metrics             metrics in the Prometheus text format.
+//	GET  /debug/pprof/        net/http/pprof.
+//	GET  /status              status of the instances.
+//	GET  /agents?addr=        connected agents of an instance.
+//	GET  /messages?addr=      registered messages of an instance.
+//	POST /kick?addr=&id=      close an agent.
+//	GET  /bans?addr=          banned ips and the end of their ban.
+//	POST /ban?addr=&ip=&time= ban an ip for time, a duration such as 10m.
+//	POST /unban?addr=&ip=     lift the ban of an ip.
+//	GET  /loglevel            log level.
+//	POST /loglevel?level=     change the log level.
+//
+// addr selects an attached instance by its listen address, the default instance is
+// used if it is empty. The requests must carry "Authorization: Bearer <token>" if the
+// listener has a token, it listens only on loopback addresses if it has none.
+
+var admin struct {
+	mu        sync.Mutex
+	srv       *http.Server
+	mux       *http.ServeMux
+	instances []*Instance
+}
+
+// AdminAttach make inst visible to the admin listener, the default instance is always
+// attached.
+func AdminAttach(inst *Instance) {
+	admin.mu.Lock()
+	defer admin.mu.Unlock()
+	admin.instances = append(admin.instances, inst)
+}
+
+// AdminHandle add a handler to the admin listener, it must be called before
+// StartAdmin.
+func AdminHandle(pattern string, handler http.Handler) {
+	admin.mu.Lock()
+	defer admin.mu.Unlock()
+	adminMux().Handle(pattern, handler)
+}
+
+func adminMux() *http.ServeMux {
+	if admin.mux == nil {
+		admin.mux = http.NewServeMux()
+		admin.mux.Handle("/metrics", metrics.Default.Handler())
+		admin.mux.HandleFunc("/debug/pprof/", pprof.Index)
+		admin.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		admin.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		admin.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		admin.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		admin.mux.HandleFunc("/status", adminStatus)
+		admin.mux.HandleFunc("/agents", adminAgents)
+		admin.mux.HandleFunc("/messages", adminMessages)
+		admin.mux.HandleFunc("/kick", adminKick)
+		admin.mux.HandleFunc("/bans", adminBans)
+		admin.mux.HandleFunc("/ban", adminBan)
+		admin.mux.HandleFunc("/unban", adminUnban)
+		admin.mux.HandleFunc("/loglevel", adminLogLevel)
+	}
+	return admin.mux
+}
+
+// StartAdmin listen on addr and serve the admin handlers, it doesn't block. With an
+// empty token addr must be a loopback address, as anyone reaching the listener could
+// kick, ban and profile.
+func StartAdmin(addr, token string) error {
+	admin.mu.Lock()
+	defer admin.mu.Unlock()
+	if admin.srv != nil {
+		return errors.New("admin listener already started")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tcpAddr := ln.Addr().(*net.TCPAddr); token == "" && !tcpAddr.IP.IsLoopback() {
+		_ = ln.Close()
+		return fmt.Errorf("admin listener on %s requires a token", tcpAddr)
+	}
+	admin.srv = &http.Server{Handler: adminAuth(adminMux(), token)}
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin listener error: %v", err)
+		}
+	}(admin.srv)
+
+	log.With("addr", ln.Addr()).Info("Admin Address")
+	return nil
+}
+
+// StopAdmin close the admin listener.
+func StopAdmin(ctx context.Context) error {
+	admin.mu.Lock()
+	srv := admin.srv
+	admin.srv = nil
+	admin.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
+
+// adminAuth let the requests carrying the bearer token through to h, all of them if
+// token is empty.
+func adminAuth(h http.Handler, token string) http.Handler {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//-------------------------------------------------------------------------------------
+// handlers.
+
+type instanceStatus struct {
+	Addr   string `json:"addr"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Agents int    `json:"agents"`
+}
+
+type agentInfo struct {
+	Id            uint64  `json:"id"`
+	Remote        string  `json:"remote"`
+	Type          string  `json:"type"`
+	Idle          int64   `json:"idle"`   // seconds since the last message.
+	RTT           float64 `json:"rtt_ms"` // smoothed by the heartbeat, 0 before a pong.
+	Jitter        float64 `json:"jitter_ms"`
+	Authenticated bool    `json:"authenticated"`
+}
+
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	var ret struct {
+		Version   string           `json:"version"`
+		Status    string           `json:"status"`
+		Instances []instanceStatus `json:"instances"`
+	}
+	ret.Version = conf.GetSYS().Version
+	ret.Status = statusName(GetStatus())
+	for _, inst := range adminInstances() {
+		s := instanceStatus{Status: statusName(inst.GetStatus()), Agents: inst.AgentCount()}
+		if inst.server != nil {
+			s.Addr = inst.GetAddr()
+			s.Type = serverTypeName(inst.GetType())
+		}
+		ret.Instances = append(ret.Instances, s)
+	}
+	writeJSON(w, ret)
+}
+
+func adminAgents(w http.ResponseWriter, r *http.Request) {
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	now := time.Now().Unix()
+	agents := make([]agentInfo, 0, inst.AgentCount())
+	inst.RangeAgents(func(agent network.Agent) bool {
+		rtt := agent.RTT()
+		info := agentInfo{
+			Id:            agent.ConnectionId(),
+			Type:          agentTypeName(agent.GetType()),
+			Idle:          now - agent.GetIdleTime(),
+			RTT:           float64(rtt.Smoothed) / float64(time.Millisecond),
+			Jitter:        float64(rtt.Jitter) / float64(time.Millisecond),
+			Authenticated: agent.IsAuthenticated(),
+		}
+		if addr := agent.RemoteAddr(); addr != nil {
+			info.Remote = addr.String()
+		}
+		agents = append(agents, info)
+		return true
+	})
+	writeJSON(w, agents)
+}
+
+func adminMessages(w http.ResponseWriter, r *http.Request) {
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	if inst.processor == nil {
+		writeJSON(w, []network.MsgEntry{})
+		return
+	}
+	writeJSON(w, network.MsgTable(inst.processor))
+}
+
+func adminKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	agent := inst.GetAgent(id)
+	if agent == nil {
+		http.Error(w, "agent not found", http.StatusNotFound)
+		return
+	}
+	log.With("conn", id, "remote", agent.RemoteAddr()).Info("kicked by admin")
+	agent.Close()
+	writeJSON(w, map[string]any{"kicked": id})
+}
+
+func adminBans(w http.ResponseWriter, r *http.Request) {
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	writeJSON(w, inst.Bans())
+}
+
+func adminBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	ip := r.FormValue("ip")
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("time"))
+	if err != nil || d <= 0 {
+		http.Error(w, "invalid time", http.StatusBadRequest)
+		return
+	}
+	log.With("ip", ip, "ban_time", d).Info("banned by admin")
+	inst.Ban(ip, d)
+	writeJSON(w, map[string]any{"banned": ip, "until": time.Now().Add(d)})
+}
+
+func adminUnban(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	ip := r.FormValue("ip")
+	if !inst.Unban(ip) {
+		http.Error(w, "ip not banned", http.StatusNotFound)
+		return
+	}
+	log.With("ip", ip).Info("unbanned by admin")
+	writeJSON(w, map[string]any{"unbanned": ip})
+}
+
+func adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		level := r.FormValue("level")
+		if _, err := log.ParseLevel(level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.SetLevel(level)
+		log.With("level", level).Info("log level changed by admin")
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]string{"level": log.GetLevel()})
+}
+
+//-------------------------------------------------------------------------------------
+// utility.
+
+func adminInstances() []*Instance {
+	admin.mu.Lock()
+	defer admin.mu.Unlock()
+	return append([]*Instance{defaultInstance}, admin.instances...)
+}
+
+// adminInstance find the instance of the addr parameter, it answers not found if there
+// is none.
+func adminInstance(w http.ResponseWriter, r *http.Request) *Instance {
+	addr := r.FormValue("addr")
+	if addr == "" {
+		return defaultInstance
+	}
+	for _, inst := range adminInstances() {
+		if inst.server != nil && inst.GetAddr() == addr {
+			return inst
+		}
+	}
+	http.Error(w, "instance not found", http.StatusNotFound)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("admin write response: %v", err)
+	}
+}
+
+func statusName(status int) string {
+	switch status {
+	case StatusServerStarting:
+		return "starting"
+	case StatusServerStarted:
+		return "started"
+	case StatusServerStopping:
+		return "stopping"
+	case StatusServerStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+func serverTypeName(style uint) string {
+	switch style {
+	case TYPE_SERVER_TCP:
+		return "tcp"
+	case TYPE_SEVER_WEBSOCKET:
+		return "ws"
+	case TYPE_SERVER_UDP:
+		return "udp"
+	}
+	return "unknown"
+}
+
+func agentTypeName(style uint) string {
+	switch style {
+	case network.TYPE_AGENT_TCP:
+		return "tcp"
+	case network.TYPE_AGENT_WEBSOCKET:
+		return "ws"
+	case network.TYPE_AGENT_UDP:
+		return "udp"
+	}
+	return "unknown"
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// adminDo serve the request to the admin handlers with token, and get its response.
+func adminDo(t *testing.T, method, target, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	adminAuth(adminMux(), "secret").ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	if w := adminDo(t, http.MethodGet, "/status", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d with no token", w.Code)
+	}
+	if w := adminDo(t, http.MethodGet, "/status", "guess"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d with a wrong token", w.Code)
+	}
+	if w := adminDo(t, http.MethodGet, "/status", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("status %d with the token", w.Code)
+	}
+
+	if err := StartAdmin("0.0.0.0:0", ""); err == nil {
+		_ = StopAdmin(context.Background())
+		t.Fatal("admin listener on all addresses started with no token")
+	}
+	if err := StartAdmin("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartAdmin("127.0.0.1:0", ""); err == nil {
+		t.Fatal("admin listener started twice")
+	}
+	if err := StopAdmin(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminHandlers(t *testing.T) {
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", nil)
+	AdminAttach(s.inst)
+	t.Cleanup(func() {
+		admin.mu.Lock()
+		admin.instances = nil
+		admin.mu.Unlock()
+	})
+	c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_TCP)
+	c.call(t, &testReq{N: 1})
+	var id uint64
+	s.inst.RangeAgents(func(agent network.Agent) bool {
+		id = agent.ConnectionId()
+		return false
+	})
+	of := "?addr=" + s.inst.GetAddr()
+
+	w := adminDo(t, http.MethodGet, "/status", "secret")
+	var status struct {
+		Instances []instanceStatus `json:"instances"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, inst := range status.Instances {
+		found = found || inst.Addr == s.inst.GetAddr() && inst.Agents == 1 && inst.Status == "started"
+	}
+	if !found {
+		t.Fatalf("instance not in status %+v", status.Instances)
+	}
+
+	for _, tc := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodGet, "/kick" + of, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/kick" + of + "&id=x", http.StatusBadRequest},
+		{http.MethodPost, "/kick" + of + "&id=999999", http.StatusNotFound},
+		{http.MethodPost, "/kick?addr=127.0.0.1:1&id=1", http.StatusNotFound},
+		{http.MethodGet, "/ban" + of, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/ban" + of + "&ip=nope&time=1m", http.StatusBadRequest},
+		{http.MethodPost, "/ban" + of + "&ip=10.0.0.9&time=soon", http.StatusBadRequest},
+		{http.MethodPost, "/ban" + of + "&ip=10.0.0.9&time=1m", http.StatusOK},
+		{http.MethodGet, "/unban" + of, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/unban" + of + "&ip=10.0.0.9", http.StatusOK},
+		{http.MethodPost, "/unban" + of + "&ip=10.0.0.9", http.StatusNotFound},
+		{http.MethodPost, "/loglevel?level=loud", http.StatusBadRequest},
+		{http.MethodDelete, "/loglevel", http.StatusMethodNotAllowed},
+	} {
+		if w := adminDo(t, tc.method, tc.target, "secret"); w.Code != tc.code {
+			t.Fatalf("%s %s: %d %s", tc.method, tc.target, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	if w := adminDo(t, http.MethodPost, "/kick"+of+"&id="+strconv.FormatUint(id, 10), "secret"); w.Code != http.StatusOK {
+		t.Fatalf("kick: %d", w.Code)
+	}
+	c.waitClosed(t)
+
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+	if w := adminDo(t, http.MethodPost, "/loglevel?level=warn", "secret"); w.Code != http.StatusOK || log.GetLevel() != "warn" {
+		t.Fatalf("loglevel: %d, level %s", w.Code, log.GetLevel())
+	}
+	if w := adminDo(t, http.MethodGet, "/loglevel", "secret"); !strings.Contains(w.Body.String(), `"warn"`) {
+		t.Fatalf("loglevel: %s", w.Body.String())
+	}
+}
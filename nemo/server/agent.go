@@ -2,24 +2,38 @@ package server
 
 import (
 	"encoding/binary"
-	"github.com/lircstar/nemo/nemo/conf"
 	"github.com/lircstar/nemo/nemo/network"
 	"github.com/lircstar/nemo/sys/log"
 	"github.com/lircstar/nemo/sys/pool"
 	"net"
 	"reflect"
+	"sync/atomic"
 	"time"
 )
 
 type Agent struct {
+	inst     *Instance
+	outer    network.Agent // the agent embedding it, or itself.
 	style    uint
 	conn     network.Conn
 	id       uint64
-	idleTime int64
+	idleTime atomic.Int64
 	active   bool
 	pool     *pool.ObjectPool
 	//outFlag  bool // it is a flag of connection connect to other server.
 	userData any
+
+	rpc     rpcTable
+	routing *Event // the message being routed.
+	session session
+	groups  map[string]struct{} // guarded by the registry of inst.
+
+	heartbeat heartbeat
+	limiter   rateLimiter
+	// a client agent pings its server every pingInterval, and closes after pingTimeOut
+	// seconds of silence.
+	pingInterval time.Duration
+	pingTimeOut  int64
 }
 
 func (a *Agent) GetType() uint {
@@ -47,8 +61,14 @@ func (a *Agent) GetConn() network.Conn {
 	return a.conn
 }
 
+// GetIdleTime get the unix time of the last message of the peer, or of its last ping
+// or pong.
 func (a *Agent) GetIdleTime() int64 {
-	return a.idleTime
+	idle := a.idleTime.Load()
+	if p, ok := a.conn.(network.Pinger); ok {
+		idle = max(idle, p.HeartbeatTime())
+	}
+	return idle
 }
 
 // Run goroutine safe
@@ -56,80 +76,204 @@ func (a *Agent) Run(data []byte) {
 	for {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
-			log.Debugf("read message: %v", err)
+			a.logger().Debugf("read message: %v", err)
 			break
 		}
 
-		if processor != nil {
-			msg, err := processor.Unmarshal(data)
-			if err != nil {
-				log.Warnf("unmarshal message error: %v", err)
-				break
-			}
-			// main loop
-			if conf.GetTCP().RoutineSafe {
-				eventChan <- &Event{a, msg, a.userData}
-			} else {
-				err = processor.Route(a, msg, a.userData)
-			}
-
-			if err != nil {
-				log.Warnf("route message error: %v", err)
-				break
-			}
+		if err = a.handle(a, data); err != nil {
+			break
 		}
-		a.idleTime = time.Now().Unix()
+		a.idleTime.Store(time.Now().Unix())
 	}
 }
 
+// handle unmarshal data and route it for agent, rpc responses go to the waiting Call.
+// data is released to the buffer pool once the message is routed, so the handlers of
+// raw messages must copy what they keep.
+func (a *Agent) handle(agent network.Agent, data []byte) error {
+	if a.onHeartbeat(data) {
+		network.ReleaseMsg(data)
+		return nil
+	}
+	if ok, err := a.allowRead(len(data)); !ok {
+		network.ReleaseMsg(data)
+		return err
+	}
+	processor := a.inst.processor
+	if processor == nil {
+		network.ReleaseMsg(data)
+		return nil
+	}
+
+	recvTime := time.Now()
+	buf := data
+	flag, seq, data := parseRpcHeader(data)
+	msg, err := processor.Unmarshal(data)
+	if err != nil {
+		network.ReleaseMsg(buf)
+		a.logger().Warnf("unmarshal message error: %v", err)
+		return err
+	}
+
+	if flag == rpcFlagResponse {
+		// buf is left to the gc, the Call keeps msg which may share it.
+		if !a.rpc.done(seq, msg) {
+			a.logger().With("seq", seq).Debug("response of no call")
+		}
+		return nil
+	}
+
+	msgId := a.inst.msgIdOf(msg)
+	if ok, err := a.allowMsg(msgId); !ok {
+		network.ReleaseMsg(buf)
+		return err
+	}
+
+	event := &Event{agent: agent, msg: msg, msgId: msgId, userData: a.userData, seq: seq, recvTime: recvTime, data: buf}
+
+	// main loop, it releases the event.
+	if a.inst.routineSafe {
+		a.inst.eventChan <- event
+		return nil
+	}
+
+	err = a.inst.dispatch(event)
+	event.release()
+	if err != nil {
+		a.logger().With("msg", reflect.TypeOf(msg)).Warnf("route message error: %v", err)
+	}
+	return err
+}
+
 func (a *Agent) SendMessage(msg any) bool {
-	if processor != nil {
+	if a.inst.processor == nil {
+		return false
+	}
+	return a.send(msg, nil, nil) == nil
+}
+
+// SendMessageOn send msg on the channel ch in place of the one registered for it. The
+// conns without channels deliver it reliable and ordered.
+func (a *Agent) SendMessageOn(ch network.Channel, msg any) bool {
+	if a.inst.processor == nil {
+		return false
+	}
+	return a.send(msg, nil, &ch) == nil
+}
+
+// send run the outbound interceptors, then marshal msg and write it after header, on
+// ch if it is not nil.
+func (a *Agent) send(msg any, header []byte, ch *network.Channel) error {
+	processor := a.inst.processor
+	return a.inst.outbound.invoke(a, a.inst.msgIdOf(msg), msg, func(agent network.Agent, msgId uint16, msg any) error {
 		data, err := processor.Marshal(msg)
 		if err != nil {
-			log.Errorf("marshal message %v error: %v", reflect.TypeOf(msg), err)
-			return false
+			a.logger().With("msg", reflect.TypeOf(msg)).Errorf("marshal message error: %v", err)
+			return err
 		}
-		err = a.conn.WriteMsg(data...)
+		if header != nil {
+			data = append([][]byte{header}, data...)
+		}
+		err = a.write(msgId, ch, data...)
 		if err != nil {
-			log.Errorf("write message %v error: %v", reflect.TypeOf(msg), err)
-			return false
+			a.logger().With("msg", reflect.TypeOf(msg)).Errorf("write message error: %v", err)
 		}
-		return true
-	}
-	return false
+		return err
+	})
 }
 
 func (a *Agent) SendRawMessage(id uint16, msg []byte) bool {
+	err := a.inst.outbound.invoke(a, id, msg, func(agent network.Agent, id uint16, msg any) error {
+		_id := make([]byte, 2)
+		if LittleEndian {
+			binary.LittleEndian.PutUint16(_id, id)
+		} else {
+			binary.BigEndian.PutUint16(_id, id)
+		}
+
+		err := a.write(id, nil, _id, msg.([]byte))
+		if err != nil {
+			a.logger().With("msg_id", id).Errorf("write message error: %v", err)
+		}
+		return err
+	})
+	return err == nil
+}
 
-	_id := make([]byte, 2)
-	if LittleEndian {
-		binary.LittleEndian.PutUint16(_id, id)
-	} else {
-		binary.BigEndian.PutUint16(_id, id)
+// write the message msgId on ch, or on the channel set by Instance.SetMsgChannel, and
+// in the priority class set by Instance.SetMsgPriority.
+func (a *Agent) write(msgId uint16, ch *network.Channel, args ...[]byte) error {
+	meta := a.inst.msgMeta[msgId]
+	if ch == nil && meta.onChannel {
+		ch = &meta.channel
+	}
+	if ch != nil {
+		if w, ok := a.conn.(network.ChannelWriter); ok {
+			return w.WriteMsgOn(*ch, args...)
+		}
 	}
+	if meta.prio != network.PriorityNormal {
+		if w, ok := a.conn.(network.PriorityWriter); ok {
+			return w.WriteMsgPriority(meta.prio, args...)
+		}
+	}
+	return a.conn.WriteMsg(args...)
+}
 
-	err := a.conn.WriteMsg(_id, msg)
-	if err != nil {
-		log.Errorf("write message %v error: %v", id, err)
-		return false
+// SetBackpressure set the backpressure of the conn of the agent in place of the one of
+// its server, false if the conn has none.
+func (a *Agent) SetBackpressure(bp network.Backpressure) bool {
+	conn, ok := a.conn.(interface{ SetBackpressure(*network.Backpressure) })
+	if ok {
+		conn.SetBackpressure(&bp)
 	}
-	return true
+	return ok
 }
 
 // OnConnect goroutine safe
 func (a *Agent) OnConnect() {
-	if onConnectCallback != nil {
-		onConnectCallback(a)
+	a.register()
+	a.startSession()
+	if a.active && a.pingInterval > 0 {
+		go a.keepalive(a.pingInterval, a.pingTimeOut)
+	}
+	if a.inst.onConnectCallback != nil {
+		a.inst.onConnectCallback(a)
+	}
+}
+
+// OnDraining goroutine safe
+func (a *Agent) OnDraining() {
+	if a.inst.onDrainingCallback != nil {
+		a.inst.onDrainingCallback(a)
+	}
+}
+
+// OnBackpressure goroutine safe, it is called by the writing goroutine.
+func (a *Agent) OnBackpressure() {
+	if a.inst.onBackpressureCallback != nil {
+		a.inst.onBackpressureCallback(a)
+	}
+}
+
+// OnTimeout goroutine safe, it is called before the agent is closed for its peer
+// being silent.
+func (a *Agent) OnTimeout() {
+	if a.inst.onTimeoutCallback != nil {
+		a.inst.onTimeoutCallback(a)
 	}
 }
 
 // OnClose goroutine safe
 func (a *Agent) OnClose() {
-	if onCloseCallback != nil {
-		onCloseCallback(a)
+	if a.inst.onCloseCallback != nil {
+		a.inst.onCloseCallback(a)
 	}
+	a.rpc.close()
+	a.endSession()
+	a.inst.registry.remove(a)
 	// free agent from pool.
-	delAgent(a)
+	a.inst.delAgent(a)
 }
 
 func (a *Agent) Close() {
@@ -156,6 +300,11 @@ func (a *Agent) SetUserData(data any) {
 	a.userData = data
 }
 
+// logger return a log entry with the connection id and remote address as fields.
+func (a *Agent) logger() *log.Entry {
+	return log.With("conn", a.id, "remote", a.RemoteAddr())
+}
+
 func (a *Agent) SetConnectionId(id uint64) {
 	a.id = id
 }
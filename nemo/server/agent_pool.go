@@ -6,88 +6,68 @@ import (
 	"time"
 )
 
-var agentPool *pool.ObjectPool
-
-func createAgentPool() {
-	if agentPool != nil {
+func (inst *Instance) createAgentPool() {
+	if inst.agentPool != nil {
 		return
 	}
-	agentPool = pool.NewObjectPool()
+	inst.agentPool = pool.NewObjectPool()
 }
 
-func newAgent(conn network.Conn) network.Agent {
-	if agentPool.FreeCount() <= 1 {
+func (inst *Instance) newAgent(conn network.Conn) network.Agent {
+	if inst.agentPool.FreeCount() <= 1 {
 		for i := 0; i < 128; i++ {
-			agentPool.Create(new(Agent))
+			inst.agentPool.Create(new(Agent))
 		}
 	}
-	a := agentPool.Get().(*Agent)
+	a := inst.agentPool.Get().(*Agent)
+	a.inst = inst
+	a.outer = a
+	a.id = inst.registry.nextId.Add(1)
 	a.conn = conn
-	a.idleTime = time.Now().Unix()
+	a.idleTime.Store(time.Now().Unix())
+	a.heartbeat.reset(time.Now())
+	a.limiter.reset()
 	return a
 }
 
-func delAgent(a network.Agent) {
-	if agentPool != nil {
-		agentPool.Free(a)
+func (inst *Instance) delAgent(a network.Agent) {
+	if inst.agentPool != nil {
+		inst.agentPool.Free(a)
 	}
 }
 
-func removeAgentPool() {
-	if agentPool == nil {
+func (inst *Instance) removeAgentPool() {
+	if inst.agentPool == nil {
 		return
 	}
-	agentPool.Range(func(i any) {
+	inst.agentPool.Range(func(i any) {
 		if i != nil {
 			i = nil
 		}
 	})
-	agentPool = nil
+	inst.agentPool = nil
 }
 
 ////////////////////////////////////////////////////////////////////
 // UdpAgent Pool
 
-var udpAgentPool *pool.ObjectPool = nil
-
-func createUdpAgentPool() *pool.ObjectPool {
-	if udpAgentPool != nil {
-		return udpAgentPool
-	}
-	udpAgentPool = pool.NewObjectPool()
-	return udpAgentPool
-}
-
-func newUdpAgent(conn network.Conn) network.Agent {
-	a := udpAgentPool.Get()
+func (inst *Instance) newUdpAgent(conn network.Conn) network.Agent {
+	a := inst.agentPool.Get()
 	if a == nil {
-		if udpAgentPool.FreeCount() <= 1 {
+		if inst.agentPool.FreeCount() <= 1 {
 			for i := 0; i < 128; i++ {
-				udpAgentPool.Create(new(UdpAgent))
+				inst.agentPool.Create(new(UdpAgent))
 			}
 		}
-		a = udpAgentPool.Get()
+		a = inst.agentPool.Get()
 	}
 	agent := a.(*UdpAgent)
+	agent.inst = inst
+	agent.outer = agent
+	agent.id = inst.registry.nextId.Add(1)
 	agent.conn = conn
-	agent.idleTime = time.Now().Unix()
+	agent.idleTime.Store(time.Now().Unix())
+	agent.heartbeat.reset(time.Now())
+	agent.limiter.reset()
 	return agent
 }
-
-func delUdpAgent(a network.Agent) {
-	if udpAgentPool != nil {
-		udpAgentPool.Free(a)
-	}
-}
-
-func removeUdpAgentPool() {
-	if udpAgentPool == nil {
-		return
-	}
-	udpAgentPool.Range(func(i any) {
-		if i != nil {
-			i = nil
-		}
-	})
-	udpAgentPool = nil
-}
@@ -19,6 +19,21 @@ import (
 
 type TcpClientWrapper struct {
 	network.TCPClient
+	inst      *Instance
+	reloading reloading
+}
+
+// Close the client, its config section is not followed anymore.
+func (client *TcpClientWrapper) Close() {
+	client.reloading.stop()
+	client.TCPClient.Close()
+}
+
+func (client *TcpClientWrapper) instance() *Instance {
+	if client.inst == nil {
+		client.inst = defaultInstance
+	}
+	return client.inst
 }
 
 // Connect Create a client and connect to a TCP server.
@@ -26,34 +41,79 @@ func (client *TcpClientWrapper) Connect(addr string) network.Client {
 	client.Addr = addr
 	config := conf.GetTCP()
 	client.AutoReconnect = config.Reconnect
-	client.ConnectInterval = 3 * time.Second
+	client.ConnectInterval = config.ConnectInterval
 	client.PendingWriteNum = config.PendingWriteNum
 	client.LenMsgLen = config.LenMsgLen
 	client.MaxMsgLen = math.MaxInt32
 	client.LittleEndian = LittleEndian
-	client.NewAgent = newClientAgent
+	client.TLS = config.TLS
+	client.CertFile = config.CertFile
+	client.KeyFile = config.KeyFile
+	client.CAFile = config.CAFile
+	client.ServerName = config.ServerName
+	client.InsecureSkipVerify = config.InsecureSkipVerify
+	client.Compression = config.Compression
+	client.CompressThreshold = config.CompressThreshold
+	client.Secure = secureConfig(config.Secure, config.SecureKey, config.SecurePeerKey)
+	inst := client.instance()
+	client.NewAgent = pinging(inst.newClientAgent, config.PingInterval, config.TimeOut)
 	// If have no processor create by server, create it by itself.
-	if processor == nil {
-		processor = protobuf.NewProcessor()
+	if inst.processor == nil {
+		inst.processor = protobuf.NewProcessor()
 	}
 
 	client.Start()
+	client.reloading.start(conf.SectionTCP, func() {
+		config := conf.GetTCP()
+		client.SetReconnect(config.Reconnect, config.ConnectInterval)
+	})
 	return client
 }
 
-func newClientAgent(conn network.Conn) network.Agent {
+func (inst *Instance) newClientAgent(conn network.Conn) network.Agent {
 	a := new(Agent)
+	a.inst = inst
+	a.outer = a
+	a.id = inst.registry.nextId.Add(1)
 	a.conn = conn
 	a.active = true
-	a.idleTime = time.Now().Unix()
+	a.idleTime.Store(time.Now().Unix())
+	a.heartbeat.reset(time.Now())
 	return a
 }
 
+// pinging wrap newAgent so its agents ping their server every interval, and close
+// after timeOut seconds of silence. No ping is sent if interval is 0.
+func pinging(newAgent func(network.Conn) network.Agent, interval, timeOut time.Duration) func(network.Conn) network.Agent {
+	return func(conn network.Conn) network.Agent {
+		agent := newAgent(conn)
+		a := agent.(interface{ base() *Agent }).base()
+		a.pingInterval = interval
+		a.pingTimeOut = int64(timeOut / time.Second)
+		return agent
+	}
+}
+
 //-------------------------------------------------------------------------------------
 // Connect to a WebSocket server.
 
 type WsClientWrapper struct {
 	network.WSClient
+	inst      *Instance
+	reloading reloading
+}
+
+// Close the client, its config section is not followed anymore.
+func (client *WsClientWrapper) Close() {
+	client.reloading.stop()
+	client.WSClient.Close()
+}
+
+func (client *WsClientWrapper) instance() *Instance {
+	if client.inst == nil {
+		client.inst = defaultInstance
+	}
+	return client.inst
 }
 
 func (client *WsClientWrapper) Connect(addr string) network.Client {
@@ -64,10 +124,18 @@ func (client *WsClientWrapper) Connect(addr string) network.Client {
 	client.PendingWriteNum = config.PendingWriteNum
 	client.MaxMsgLen = math.MaxInt32
 	client.LittleEndian = LittleEndian
-	client.NewAgent = newClientAgent
+	client.Compression = config.Compression
+	client.CompressThreshold = config.CompressThreshold
+	inst := client.instance()
+	client.NewAgent = pinging(inst.newClientAgent, config.PingInterval, config.TimeOut)
 	// If have no processor create by server, create it by itself.
-	processor = json.NewProcessor()
+	if inst.processor == nil {
+		inst.processor = json.NewProcessor()
+	}
 	client.Start()
+	client.reloading.start(conf.SectionWSS, func() {
+		client.SetReconnect(conf.GetWSS().Reconnect, 0)
+	})
 	return client
 }
 
@@ -76,31 +144,59 @@ func (client *WsClientWrapper) Connect(addr string) network.Client {
 
 type UdpClientWrapper struct {
 	network.UDPClient
+	inst      *Instance
+	reloading reloading
+}
+
+// Close the client, its config section is not followed anymore.
+func (client *UdpClientWrapper) Close() {
+	client.reloading.stop()
+	client.UDPClient.Close()
+}
+
+func (client *UdpClientWrapper) instance() *Instance {
+	if client.inst == nil {
+		client.inst = defaultInstance
+	}
+	return client.inst
 }
 
 func (client *UdpClientWrapper) Connect(addr string) network.Client {
 	client.Addr = addr
 	config := conf.GetUDP()
-	client.TimeOut = config.TimeOut
+	client.TimeOut = int(config.TimeOut / time.Second)
 	client.MinMsgLen = config.MinMsgLen
 	client.MaxMsgLen = config.MaxMsgLen
 	client.LittleEndian = LittleEndian
 	client.AutoReconnect = config.Reconnect
 	client.ConnectInterval = config.ConnectInterval
-	client.NewAgent = newUdpClientAgent
+	client.Secure = secureConfig(config.Secure, config.SecureKey, config.SecurePeerKey)
+	client.Reliable = reliableConfig(config)
+	client.Handshake = config.Handshake
+	inst := client.instance()
+	client.NewAgent = pinging(inst.newUdpClientAgent, config.PingInterval, config.TimeOut)
 	// If have no processor create by server, create it by itself.
-	if processor == nil {
+	if inst.processor == nil {
 		fmt.Println("No processor found, use default protobuf.")
-		processor = protobuf.NewProcessor()
+		inst.processor = protobuf.NewProcessor()
 	}
 	client.Start()
+	client.reloading.start(conf.SectionUDP, func() {
+		config := conf.GetUDP()
+		client.SetReconnect(config.Reconnect, config.ConnectInterval)
+	})
 
 	return client
 }
 
-func newUdpClientAgent(conn network.Conn) network.Agent {
+func (inst *Instance) newUdpClientAgent(conn network.Conn) network.Agent {
 	a := new(UdpAgent)
+	a.inst = inst
+	a.outer = a
+	a.id = inst.registry.nextId.Add(1)
 	a.conn = conn
-	a.idleTime = time.Now().Unix()
+	a.active = true
+	a.idleTime.Store(time.Now().Unix())
+	a.heartbeat.reset(time.Now())
 	return a
 }
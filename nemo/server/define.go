@@ -1,6 +1,9 @@
 package server
 
 import (
+	"context"
+	"time"
+
 	"github.com/lircstar/nemo/nemo/conf"
 	"github.com/lircstar/nemo/nemo/network"
 )
@@ -19,82 +22,179 @@ type Server interface {
 
 	Start()
 	Stop()
+	Shutdown(ctx context.Context) error
 }
 
 type Event struct {
 	agent    network.Agent
 	msg      any
+	msgId    uint16
 	userData any
+	seq      uint32 // rpc request seq, 0 for normal message.
+	recvTime time.Time
+	data     []byte // the message read, released after routing.
 }
 
-var LittleEndian = conf.GetSYS().LittleEndian
+// release give back the data of ev to the buffer pool.
+func (ev *Event) release() {
+	network.ReleaseMsg(ev.data)
+	ev.data = nil
+}
 
-var processor network.Processor
+var LittleEndian = conf.GetSYS().LittleEndian
 
 type ProcessCallBack func() network.Processor
 
-var registerProcessor func() network.Processor
-
+// EventCallback
+// OnInit : Server begin. (Initialize data before running server)
+// OnLoop : Server main loop
+// OnDestroy : Server end. (For exiting server's withdraw)
 type EventCallback func()
 
-// Server begin. (Initialize data before running server)
-var onInitCallback EventCallback
-
-// Server main loop
-var onLoopCallback func()
-
-// Server end. (For exiting server's withdraw)
-var onDestroyCallback func()
-
+// ConnectCallback
+// OnConnect : Agent connected.
+// OnDraining : Server is shutting down gracefully, the agent can still send messages.
+// OnClose : Agent closed.
 type ConnectCallback func(network.Agent)
 
-// Agent connected.
-var onConnectCallback func(network.Agent)
+// The instance used by package level functions.
+var defaultInstance = NewInstance(nil)
 
-// Agent closed.
-var onCloseCallback func(network.Agent)
+func DefaultInstance() *Instance {
+	return defaultInstance
+}
 
 //-------------------------------------------------------------------------------------
 // interface function.
 
 func RegisterProcessor(pro network.Processor) {
-	processor = pro
+	defaultInstance.RegisterProcessor(pro)
+}
+
+func GetProcessor() network.Processor {
+	return defaultInstance.Processor()
 }
 
 func RegisterMessage(msg any, msgHandler network.MsgHandler) {
-	processor.Register(msg)
-	processor.SetHandler(msg, msgHandler)
+	defaultInstance.RegisterMessage(msg, msgHandler)
+}
+
+func RegisterMessageWithID(id uint16, msg any, msgHandler network.MsgHandler) {
+	defaultInstance.RegisterMessageWithID(id, msg, msgHandler)
+}
 
+func RegisterMessageOn(ch network.Channel, msg any, msgHandler network.MsgHandler) {
+	defaultInstance.RegisterMessageOn(ch, msg, msgHandler)
 }
 
 func RegisterRawMessage(id uint16, msgHandler network.MsgHandler) {
-	processor.SetRawHandler(id, msgHandler)
+	defaultInstance.RegisterRawMessage(id, msgHandler)
 }
 
 func RegisterMessageNoHandler(msg any) {
-	processor.Register(msg)
+	defaultInstance.RegisterMessageNoHandler(msg)
 }
 
 func RegisterRawMessageNoHandler(msg interface{}) {
-	processor.Register(msg)
+	defaultInstance.RegisterMessageNoHandler(msg)
+}
+
+func Use(i ...Interceptor) {
+	defaultInstance.Use(i...)
+}
+
+func UseMessage(msg any, i ...Interceptor) {
+	defaultInstance.UseMessage(msg, i...)
+}
+
+func UseOutbound(i ...Interceptor) {
+	defaultInstance.UseOutbound(i...)
+}
+
+func UseOutboundMessage(msg any, i ...Interceptor) {
+	defaultInstance.UseOutboundMessage(msg, i...)
+}
+
+func RequireAuth(timeout time.Duration, whitelist ...any) {
+	defaultInstance.RequireAuth(timeout, whitelist...)
+}
+
+func GetAgentByIdentity(identity any) network.Agent {
+	return defaultInstance.GetAgentByIdentity(identity)
+}
+
+func GetAgent(id uint64) network.Agent {
+	return defaultInstance.GetAgent(id)
+}
+
+func Broadcast(msg any, filter func(agent network.Agent) bool) int {
+	return defaultInstance.Broadcast(msg, filter)
+}
+
+func Join(name string, agent network.Agent) {
+	defaultInstance.Join(name, agent)
+}
+
+func Leave(name string, agent network.Agent) {
+	defaultInstance.Leave(name, agent)
+}
+
+func Multicast(name string, msg any) int {
+	return defaultInstance.Multicast(name, msg)
 }
 
 func RegisterOnInit(cb EventCallback) {
-	onInitCallback = cb
+	defaultInstance.RegisterOnInit(cb)
 }
 
 func RegisterOnLoop(cb EventCallback) {
-	onLoopCallback = cb
+	defaultInstance.RegisterOnLoop(cb)
 }
 
 func RegisterOnDestroy(cb EventCallback) {
-	onDestroyCallback = cb
+	defaultInstance.RegisterOnDestroy(cb)
 }
 
 func RegisterOnConnect(cb ConnectCallback) {
-	onConnectCallback = cb
+	defaultInstance.RegisterOnConnect(cb)
+}
+
+func RegisterOnDraining(cb ConnectCallback) {
+	defaultInstance.RegisterOnDraining(cb)
 }
 
 func RegisterOnClose(cb ConnectCallback) {
-	onCloseCallback = cb
+	defaultInstance.RegisterOnClose(cb)
+}
+
+func RegisterOnBackpressure(cb ConnectCallback) {
+	defaultInstance.RegisterOnBackpressure(cb)
+}
+
+func RegisterOnTimeout(cb ConnectCallback) {
+	defaultInstance.RegisterOnTimeout(cb)
+}
+
+func SetMsgPriority(id uint16, prio int) {
+	defaultInstance.SetMsgPriority(id, prio)
+}
+
+func SetMsgChannel(id uint16, ch network.Channel) {
+	defaultInstance.SetMsgChannel(id, ch)
+}
+
+func SetMsgRateLimit(id uint16, rate float64, burst int) {
+	defaultInstance.SetMsgRateLimit(id, rate, burst)
+}
+
+func Ban(ip string, d time.Duration) {
+	defaultInstance.Ban(ip, d)
+}
+
+func Unban(ip string) bool {
+	return defaultInstance.Unban(ip)
+}
+
+func Bans() map[string]time.Time {
+	return defaultInstance.Bans()
 }
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+	protobuf "github.com/lircstar/nemo/nemo/network/proto"
+	"github.com/lircstar/nemo/nemo/network/raw"
+	"github.com/lircstar/nemo/sys/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// -------------------------------------------------------------------------------------
+// MsgContext is given to typed handlers instead of the raw args of network.MsgHandler.
+
+type MsgContext struct {
+	Agent    network.Agent
+	UserData any
+	MsgId    uint16
+	RecvTime time.Time
+
+	seq uint32 // rpc request seq, 0 for normal message.
+}
+
+// Reply answer the request of the context, it can be called after the handler returns.
+// It sends resp as a normal message if the message is not a request.
+func (ctx *MsgContext) Reply(resp any) bool {
+	if a, ok := ctx.Agent.(router); ok {
+		return a.replyTo(ctx.seq, resp)
+	}
+	return ctx.Agent.Reply(resp)
+}
+
+// router is implemented by Agent, the event is kept while it is routed so handlers
+// know the context of the message.
+type router interface {
+	setRouting(ev *Event)
+	getRouting() *Event
+	replyTo(seq uint32, resp any) bool
+}
+
+func (a *Agent) setRouting(ev *Event) {
+	a.routing = ev
+}
+
+func (a *Agent) getRouting() *Event {
+	return a.routing
+}
+
+// dispatch route the message of ev to its handler.
+func (inst *Instance) dispatch(ev *Event) error {
+	if r, ok := ev.agent.(router); ok {
+		r.setRouting(ev)
+		defer r.setRouting(nil)
+	}
+	if !inst.authorized(ev) {
+		log.With("msg_id", ev.msgId, "remote", ev.agent.RemoteAddr()).Warn("message before auth dropped")
+		return nil
+	}
+	return inst.inbound.invoke(ev.agent, ev.msgId, ev.msg, func(agent network.Agent, msgId uint16, msg any) error {
+		label := msgIdLabel(msgId)
+		start := time.Now()
+		err := inst.processor.Route(agent, msg, ev.userData)
+		metricHandlerSeconds.Observe(time.Since(start).Seconds(), label)
+		metricMessages.Inc(label)
+		if err != nil {
+			metricRouteErrors.Inc(label)
+		}
+		return err
+	})
+}
+
+func newMsgContext(agent network.Agent, msgId uint16, userData any) *MsgContext {
+	ctx := &MsgContext{Agent: agent, UserData: userData, MsgId: msgId}
+	if r, ok := agent.(router); ok {
+		if ev := r.getRouting(); ev != nil {
+			ctx.seq = ev.seq
+			ctx.RecvTime = ev.recvTime
+		}
+	}
+	if ctx.RecvTime.IsZero() {
+		ctx.RecvTime = time.Now()
+	}
+	return ctx
+}
+
+// -------------------------------------------------------------------------------------
+// typed handler.
+
+// Handle register T and its handler to the default instance.
+func Handle[T any](h func(ctx *MsgContext, msg T)) {
+	HandleOn(defaultInstance, h)
+}
+
+// HandleOn register T and its handler to inst. T must be a message pointer the
+// processor of inst accepts, mistakes are fatal here instead of on routing.
+func HandleOn[T any](inst *Instance, h func(ctx *MsgContext, msg T)) {
+	if err := RegisterHandler(inst, h); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// RegisterHandler register T and its handler to inst like HandleOn, but a T the
+// processor of inst doesn't accept is returned as an error.
+func RegisterHandler[T any](inst *Instance, h func(ctx *MsgContext, msg T)) error {
+	if inst.processor == nil {
+		return errors.New("register processor before handling messages")
+	}
+
+	var zero T
+	msgType := reflect.TypeOf(zero)
+	switch inst.processor.(type) {
+	case *raw.Processor:
+		return errors.New("raw processor has no message type, use HandleRaw")
+	case *protobuf.Processor:
+		if _, ok := any(zero).(proto.Message); !ok {
+			return fmt.Errorf("message %v is not a protobuf message", msgType)
+		}
+	}
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		return fmt.Errorf("message pointer required, got %v", msgType)
+	}
+	if msgType.Elem().Name() == "" {
+		return fmt.Errorf("unnamed message %v", msgType)
+	}
+
+	inst.processor.Register(zero)
+	msgId := inst.processor.GetMsgId(msgType)
+	inst.processor.SetHandler(zero, func(agent network.Agent, args []any) {
+		msg, ok := args[0].(T)
+		if !ok {
+			log.With("msg", reflect.TypeOf(args[0]), "want", msgType).Error("message type mismatch")
+			return
+		}
+		h(newMsgContext(agent, msgId, args[1]), msg)
+	})
+	return nil
+}
+
+// HandleRaw register a raw handler of id to the default instance.
+func HandleRaw(id uint16, h func(ctx *MsgContext, data []byte)) {
+	defaultInstance.HandleRaw(id, h)
+}
+
+// HandleRaw register a raw handler of id, the data is the message without its id.
+func (inst *Instance) HandleRaw(id uint16, h func(ctx *MsgContext, data []byte)) {
+	if inst.processor == nil {
+		log.Fatalf("register processor before handling messages")
+	}
+
+	// raw processor gives {data, userData}, the others {id, data, userData}.
+	if _, ok := inst.processor.(*raw.Processor); ok {
+		inst.processor.SetHandler(id, func(agent network.Agent, args []any) {
+			h(newMsgContext(agent, id, args[1]), rawBytes(args[0]))
+		})
+		return
+	}
+	inst.processor.SetRawHandler(id, func(agent network.Agent, args []any) {
+		h(newMsgContext(agent, id, args[2]), rawBytes(args[1]))
+	})
+}
+
+func rawBytes(v any) []byte {
+	switch data := v.(type) {
+	case []byte:
+		return data
+	case json.RawMessage:
+		return data
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/nemo/network/json"
+	protobuf "github.com/lircstar/nemo/nemo/network/proto"
+	"github.com/lircstar/nemo/nemo/network/raw"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRegisterHandlerMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		processor network.Processor
+		register  func(inst *Instance) error
+		err       string // in the error, "" for none.
+	}{
+		{"json pointer", json.NewProcessor(), func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg *testReq) {})
+		}, ""},
+		{"json value", json.NewProcessor(), func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg testReq) {})
+		}, "message pointer required"},
+		{"json interface", json.NewProcessor(), func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg any) {})
+		}, "message pointer required"},
+		{"json unnamed", json.NewProcessor(), func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg *struct{ N int }) {})
+		}, "unnamed message"},
+		{"protobuf message", protobuf.NewProcessor(), func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg *wrapperspb.StringValue) {})
+		}, ""},
+		{"protobuf non-message", protobuf.NewProcessor(), func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg *testReq) {})
+		}, "not a protobuf message"},
+		{"raw", raw.NewProcessor(), func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg *testReq) {})
+		}, "use HandleRaw"},
+		{"no processor", nil, func(inst *Instance) error {
+			return RegisterHandler(inst, func(ctx *MsgContext, msg *testReq) {})
+		}, "register processor"},
+	} {
+		inst := NewInstance(nil)
+		if tc.processor != nil {
+			inst.RegisterProcessor(tc.processor)
+		}
+		err := tc.register(inst)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("%s: error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestHandleOnMismatch(t *testing.T) {
+	inst := NewInstance(nil)
+	inst.RegisterProcessor(json.NewProcessor())
+	msg := func() (msg string) {
+		defer func() {
+			if r := recover(); r != nil {
+				msg = fmt.Sprint(r)
+			}
+		}()
+		HandleOn(inst, func(ctx *MsgContext, msg testReq) {})
+		return ""
+	}()
+	if !strings.Contains(msg, "message pointer required") {
+		t.Fatalf("handler of a message value: fatal %q", msg)
+	}
+}
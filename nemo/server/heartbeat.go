@@ -0,0 +1,145 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+)
+
+// -------------------------------------------------------------------------------------
+// Heartbeat of the agents. A ping is an rpc frame with no processor message, answered
+// at once by a pong of its seq, whatever the processor is:
+// ----------------------------------------------------
+// | MSG_ID_RPC(2) | rpcFlagPing/rpcFlagPong(1) | seq(4) |
+// ----------------------------------------------------
+// A WebSocket conn uses its ping frames instead, see network.Pinger. The server agents
+// are pinged by the loop of the instance, the client agents by their own goroutine.
+
+// maxHeartbeatPeriod is the period of the checks when no ping is sent.
+const maxHeartbeatPeriod = 10 * time.Second
+
+// heartbeatPeriod get the period of the checks for the ping interval, so the pings go
+// between interval and 1.5 interval.
+func heartbeatPeriod(interval time.Duration) time.Duration {
+	period := interval / 2
+	if interval <= 0 || period > maxHeartbeatPeriod {
+		return maxHeartbeatPeriod
+	}
+	return max(period, 10*time.Millisecond)
+}
+
+// heartbeat is the state of the pings of an agent.
+type heartbeat struct {
+	rtt network.RTTMeter
+
+	mu       sync.Mutex
+	seq      uint32
+	sentAt   time.Time // of the ping of seq, zero once its pong came.
+	lastPing time.Time
+}
+
+// reset the heartbeat for a new peer.
+func (h *heartbeat) reset(now time.Time) {
+	h.rtt.Reset()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sentAt = time.Time{}
+	h.lastPing = now
+}
+
+// next get the seq of the next ping, false if it is not due yet. A ping still waiting
+// for its pong is lost.
+func (h *heartbeat) next(now time.Time, interval time.Duration) (uint32, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.lastPing) < interval {
+		return 0, false
+	}
+	h.lastPing = now
+	h.seq++
+	h.sentAt = now
+	return h.seq, true
+}
+
+// pong measure the round trip of the ping seq.
+func (h *heartbeat) pong(seq uint32, now time.Time) {
+	h.mu.Lock()
+	sentAt := h.sentAt
+	if seq != h.seq || sentAt.IsZero() {
+		h.mu.Unlock()
+		return
+	}
+	h.sentAt = time.Time{}
+	h.mu.Unlock()
+	h.rtt.Add(now.Sub(sentAt))
+}
+
+// base get the agent embedded by the agents of the pool.
+func (a *Agent) base() *Agent {
+	return a
+}
+
+// onHeartbeat answer a ping or measure a pong, false if data is not one.
+func (a *Agent) onHeartbeat(data []byte) bool {
+	flag, seq, _ := parseRpcHeader(data)
+	switch flag {
+	case rpcFlagPing:
+		if err := a.conn.WriteMsg(putRpcHeader(rpcFlagPong, seq)); err != nil {
+			a.logger().Debugf("write pong: %v", err)
+		}
+	case rpcFlagPong:
+		a.heartbeat.pong(seq, time.Now())
+	default:
+		return false
+	}
+	return true
+}
+
+// beat close a if its peer was silent for timeOut seconds, else ping the peer if it
+// is due. 0 turns either off.
+func (a *Agent) beat(now time.Time, interval time.Duration, timeOut int64) {
+	if timeOut > 0 && now.Unix()-a.outer.GetIdleTime() > timeOut {
+		a.logger().Debug("close agent: timeout")
+		metricTimeouts.Inc(a.inst.metricAddr())
+		a.outer.OnTimeout()
+		a.outer.Close()
+		return
+	}
+	if interval <= 0 {
+		return
+	}
+	seq, ok := a.heartbeat.next(now, interval)
+	if !ok {
+		return
+	}
+	var err error
+	if p, ok := a.conn.(network.Pinger); ok {
+		err = p.Ping()
+	} else {
+		err = a.conn.WriteMsg(putRpcHeader(rpcFlagPing, seq))
+	}
+	if err != nil {
+		a.logger().Debugf("write ping: %v", err)
+	}
+}
+
+// keepalive ping the server of a client agent until its conn is closed.
+func (a *Agent) keepalive(interval time.Duration, timeOut int64) {
+	ticker := time.NewTicker(heartbeatPeriod(interval))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if a.conn.IsClosed() {
+			return
+		}
+		a.beat(now, interval, timeOut)
+	}
+}
+
+// RTT get the round trip times measured by the heartbeat.
+func (a *Agent) RTT() network.RTTStats {
+	if p, ok := a.conn.(network.Pinger); ok {
+		return p.RTT()
+	}
+	return a.heartbeat.rtt.Stats()
+}
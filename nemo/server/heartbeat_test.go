@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+)
+
+func TestHeartbeat(t *testing.T) {
+	config := testTCPConfig()
+	config.PingInterval = 50 * time.Millisecond
+	config.TimeOut = time.Second
+	timeouts := make(chan network.Agent, 1)
+	s := startTestServer(t, &TcpServerWrapper{Config: config}, "tcp", func(inst *Instance) {
+		inst.RegisterOnTimeout(func(agent network.Agent) { timeouts <- agent })
+	})
+	addr := s.inst.GetAddr()
+
+	// a client answers the pings, a raw conn doesn't.
+	c := dialTestClient(t, addr, network.TYPE_CLIENT_TCP)
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	waitFor(t, "rtt", func() bool {
+		samples := int64(0)
+		s.inst.RangeAgents(func(agent network.Agent) bool {
+			samples = max(samples, agent.RTT().Samples)
+			return true
+		})
+		return samples > 0
+	})
+
+	select {
+	case agent := <-timeouts:
+		if agent.RemoteAddr().String() != raw.LocalAddr().String() {
+			t.Fatalf("timeout of %v", agent.RemoteAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer not timed out")
+	}
+	_ = raw.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 64)
+	for {
+		if _, err = raw.Read(buf); err != nil {
+			break
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("silent peer not closed")
+	}
+
+	// the client kept alive by its pongs.
+	if resp := c.call(t, &testReq{N: 1}); resp.N != 1 {
+		t.Fatalf("call after the timeout: %+v", resp)
+	}
+}
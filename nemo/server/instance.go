@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/conf"
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+	"github.com/lircstar/nemo/sys/pool"
+)
+
+// -------------------------------------------------------------------------------------
+// Instance owns everything one listener needs: processor, event loop, agent pool and
+// lifecycle callbacks. Several instances can run side by side in one process.
+
+type Instance struct {
+	server    Server
+	processor network.Processor
+
+	eventChan    chan *Event
+	exitProcChan chan int
+	endProcChan  chan int
+	status       atomic.Int32 // read by the other goroutines, see GetStatus.
+
+	agentPool *pool.ObjectPool
+
+	// taken from the config section of the server wrapper on start.
+	routineSafe bool
+	timeOut     atomic.Int64 // seconds.
+	// the server agents are pinged every pingInterval, a time.Duration.
+	pingInterval atomic.Int64
+	limits       atomic.Pointer[limits]
+
+	// shared by the servers of the instance, it keeps the ban list.
+	ipLimiter *network.IPLimiter
+	// ticked by the event loop, the tcp conns flushing on tick wait for it.
+	flushTicker *network.FlushTicker
+
+	sessions sessionConfig
+	registry registry
+
+	inbound  interceptorChain
+	outbound interceptorChain
+
+	onInitCallback     EventCallback
+	onLoopCallback     EventCallback
+	onDestroyCallback  EventCallback
+	onConnectCallback  ConnectCallback
+	onDrainingCallback ConnectCallback
+	onCloseCallback    ConnectCallback
+
+	onBackpressureCallback ConnectCallback
+	onTimeoutCallback      ConnectCallback
+	msgMeta                map[uint16]msgMeta // set before start.
+}
+
+// msgMeta is what is registered of a message id besides its handler.
+type msgMeta struct {
+	prio      int
+	channel   network.Channel
+	onChannel bool
+	rate      float64 // read by an agent a second, see SetMsgRateLimit.
+	burst     int
+}
+
+func (inst *Instance) setMsgMeta(id uint16, set func(meta *msgMeta)) {
+	if inst.msgMeta == nil {
+		inst.msgMeta = make(map[uint16]msgMeta)
+	}
+	meta := inst.msgMeta[id]
+	set(&meta)
+	inst.msgMeta[id] = meta
+}
+
+// server wrappers implement it to get the instance they belong to.
+type instanceBinder interface {
+	setInstance(inst *Instance)
+}
+
+// NewInstance create an instance running the server s. s may be nil for an instance
+// which is only used by clients.
+func NewInstance(s Server) *Instance {
+	inst := new(Instance)
+	inst.eventChan = make(chan *Event, 1024)
+	inst.exitProcChan = make(chan int, 1)
+	inst.endProcChan = make(chan int)
+	inst.status.Store(StatusServerStopped)
+	inst.routineSafe = conf.GetTCP().RoutineSafe
+	inst.timeOut.Store(int64(conf.GetTCP().TimeOut / time.Second))
+	inst.ipLimiter = network.NewIPLimiter(0)
+	inst.flushTicker = network.NewFlushTicker()
+	inst.setServer(s)
+	return inst
+}
+
+func (inst *Instance) setServer(s Server) {
+	inst.server = s
+	if b, ok := s.(instanceBinder); ok {
+		b.setInstance(inst)
+	}
+}
+
+func (inst *Instance) GetType() uint {
+	return inst.server.GetType()
+}
+
+func (inst *Instance) GetAddr() string {
+	return inst.server.GetAddr()
+}
+
+func (inst *Instance) GetStatus() int {
+	return int(inst.status.Load())
+}
+
+func (inst *Instance) Processor() network.Processor {
+	return inst.processor
+}
+
+//-------------------------------------------------------------------------------------
+// register function.
+
+func (inst *Instance) RegisterProcessor(pro network.Processor) {
+	inst.processor = pro
+}
+
+func (inst *Instance) RegisterMessage(msg any, msgHandler network.MsgHandler) {
+	inst.processor.Register(msg)
+	inst.processor.SetHandler(msg, msgHandler)
+}
+
+// RegisterMessageWithID register msg with an explicit id, for messages whose hashed
+// id collides with another one.
+func (inst *Instance) RegisterMessageWithID(id uint16, msg any, msgHandler network.MsgHandler) {
+	inst.processor.RegisterWithID(id, msg)
+	if msgHandler != nil {
+		inst.processor.SetHandler(msg, msgHandler)
+	}
+}
+
+// RegisterMessageOn register msg sent on ch, see SetMsgChannel.
+func (inst *Instance) RegisterMessageOn(ch network.Channel, msg any, msgHandler network.MsgHandler) {
+	inst.RegisterMessage(msg, msgHandler)
+	inst.SetMsgChannel(inst.msgIdOf(msg), ch)
+}
+
+func (inst *Instance) RegisterRawMessage(id uint16, msgHandler network.MsgHandler) {
+	inst.processor.SetRawHandler(id, msgHandler)
+}
+
+func (inst *Instance) RegisterMessageNoHandler(msg any) {
+	inst.processor.Register(msg)
+}
+
+func (inst *Instance) RegisterOnInit(cb EventCallback) {
+	inst.onInitCallback = cb
+}
+
+func (inst *Instance) RegisterOnLoop(cb EventCallback) {
+	inst.onLoopCallback = cb
+}
+
+func (inst *Instance) RegisterOnDestroy(cb EventCallback) {
+	inst.onDestroyCallback = cb
+}
+
+func (inst *Instance) RegisterOnConnect(cb ConnectCallback) {
+	inst.onConnectCallback = cb
+}
+
+func (inst *Instance) RegisterOnDraining(cb ConnectCallback) {
+	inst.onDrainingCallback = cb
+}
+
+func (inst *Instance) RegisterOnClose(cb ConnectCallback) {
+	inst.onCloseCallback = cb
+}
+
+// RegisterOnBackpressure set cb called when the backpressure policy of the conn of an
+// agent acts, in the goroutine writing to the conn.
+func (inst *Instance) RegisterOnBackpressure(cb ConnectCallback) {
+	inst.onBackpressureCallback = cb
+}
+
+// RegisterOnTimeout set cb called before an agent is closed for its peer being silent
+// for the time out of its server.
+func (inst *Instance) RegisterOnTimeout(cb ConnectCallback) {
+	inst.onTimeoutCallback = cb
+}
+
+// SetMsgPriority set the priority class of the message id for the backpressure policy
+// network.BackpressurePriority, call it before start.
+func (inst *Instance) SetMsgPriority(id uint16, prio int) {
+	inst.setMsgMeta(id, func(meta *msgMeta) { meta.prio = prio })
+}
+
+// SetMsgChannel set the channel SendMessage writes the message id on, for the conns
+// with channels, call it before start.
+func (inst *Instance) SetMsgChannel(id uint16, ch network.Channel) {
+	inst.setMsgMeta(id, func(meta *msgMeta) { meta.channel, meta.onChannel = ch, true })
+}
+
+//-------------------------------------------------------------------------------------
+// lifecycle.
+
+// Start the event loop and the server, it doesn't block.
+func (inst *Instance) Start() {
+	if inst.server == nil {
+		log.Error("instance has no server.")
+		return
+	}
+
+	inst.status.Store(StatusServerStarting)
+
+	inst.createAgentPool()
+
+	inst.server.Start()
+
+	// the events queued by the agents meanwhile wait in eventChan.
+	go inst.mainProc(inst.metricAddr())
+
+	if inst.onInitCallback != nil {
+		inst.onInitCallback()
+	}
+	inst.status.Store(StatusServerStarted)
+
+	log.Infof("Nemo %v starting up.", conf.GetSYS().Version)
+	log.With("addr", inst.server.GetAddr()).Info("Listen Address")
+}
+
+// Stop ask the event loop to close the server, use Wait to know when it is done.
+func (inst *Instance) Stop() {
+	inst.exitProcChan <- 0
+}
+
+// Shutdown drain the server gracefully then stop the instance. It returns when all
+// agents' OnClose are done, agents still alive when ctx is done are closed at once.
+func (inst *Instance) Shutdown(ctx context.Context) error {
+	inst.status.Store(StatusServerStopping)
+	err := inst.server.Shutdown(ctx)
+	inst.Stop()
+	inst.Wait()
+	return err
+}
+
+// Wait block until the instance is stopped.
+func (inst *Instance) Wait() {
+	<-inst.endProcChan
+}
+
+func (inst *Instance) destroy() {
+	if inst.onDestroyCallback != nil {
+		inst.onDestroyCallback()
+	}
+
+	inst.server.Stop()
+}
+
+//-------------------------------------------------------------------------------------
+// Connect to other server with this instance's processor and callbacks.
+
+func (inst *Instance) Connect(addr string, style uint) network.Client {
+	var ret network.Client
+	if style == network.TYPE_CLIENT_TCP {
+		client := &TcpClientWrapper{inst: inst}
+		ret = client.Connect(addr)
+	} else if style == network.TYPE_CLIENT_WEBSOCKET {
+		client := &WsClientWrapper{inst: inst}
+		ret = client.Connect(addr)
+	} else if style == network.TYPE_CLIENT_UDP {
+		client := &UdpClientWrapper{inst: inst}
+		ret = client.Connect(addr)
+	}
+	return ret
+}
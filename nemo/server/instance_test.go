@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/conf"
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/nemo/network/json"
+)
+
+type testReq struct{ N int }
+
+type testResp struct {
+	N    int
+	From string
+}
+
+type testLogin struct{ Name string }
+
+type testJoin struct{ Group string }
+
+type testNote struct{ Text string }
+
+// testServer is an instance answering the test messages, tag tells it in the
+// responses.
+type testServer struct {
+	inst  *Instance
+	tag   string
+	notes chan *testNote
+	times chan time.Time // of the notes.
+}
+
+// startTestServer run the server s on 127.0.0.1:0, setup is called once the messages
+// are registered and before the instance starts.
+func startTestServer(t *testing.T, s Server, tag string, setup func(inst *Instance)) *testServer {
+	t.Helper()
+	ts := &testServer{
+		inst:  NewInstance(s),
+		tag:   tag,
+		notes: make(chan *testNote, 64),
+		times: make(chan time.Time, 64),
+	}
+	inst := ts.inst
+	inst.RegisterProcessor(json.NewProcessor())
+	HandleOn(inst, func(ctx *MsgContext, msg *testReq) {
+		ctx.Reply(&testResp{N: msg.N, From: tag})
+	})
+	HandleOn(inst, func(ctx *MsgContext, msg *testLogin) {
+		ctx.Agent.Authenticate(msg.Name)
+		ctx.Reply(&testResp{From: tag})
+	})
+	HandleOn(inst, func(ctx *MsgContext, msg *testJoin) {
+		inst.Join(msg.Group, ctx.Agent)
+		ctx.Reply(&testResp{N: int(ctx.Agent.ConnectionId()), From: tag})
+	})
+	HandleOn(inst, func(ctx *MsgContext, msg *testNote) {
+		ts.times <- time.Now()
+		ts.notes <- msg
+	})
+	inst.RegisterMessageNoHandler(&testResp{})
+	if setup != nil {
+		setup(inst)
+	}
+	inst.Start()
+	t.Cleanup(func() {
+		inst.Stop()
+		inst.Wait()
+	})
+	return ts
+}
+
+func testTCPConfig() *conf.TCP {
+	c := conf.Default().Tcp
+	c.Addr = "127.0.0.1:0"
+	return &c
+}
+
+func testWSConfig() *conf.WSS {
+	c := conf.Default().Wss
+	c.Addr = "127.0.0.1:0"
+	return &c
+}
+
+func testUDPConfig() *conf.UDP {
+	c := conf.Default().Udp
+	c.Addr = "127.0.0.1:0"
+	return &c
+}
+
+// testClient is a client of its own instance, its messages are routed by the reader.
+type testClient struct {
+	inst   *Instance
+	client network.Client
+	agent  network.Agent
+	notes  chan *testNote
+	closed chan struct{}
+}
+
+func dialTestClient(t *testing.T, addr string, style uint) *testClient {
+	t.Helper()
+	c := &testClient{
+		inst:   NewInstance(nil),
+		notes:  make(chan *testNote, 64),
+		closed: make(chan struct{}),
+	}
+	c.inst.routineSafe = false
+	c.inst.RegisterProcessor(json.NewProcessor())
+	HandleOn(c.inst, func(ctx *MsgContext, msg *testNote) {
+		c.notes <- msg
+	})
+	for _, msg := range []any{&testReq{}, &testResp{}, &testLogin{}, &testJoin{}} {
+		c.inst.RegisterMessageNoHandler(msg)
+	}
+	agents := make(chan network.Agent, 1)
+	c.inst.RegisterOnConnect(func(agent network.Agent) { agents <- agent })
+	c.inst.RegisterOnClose(func(network.Agent) { close(c.closed) })
+
+	c.client = c.inst.Connect(addr, style)
+	select {
+	case c.agent = <-agents:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("client of %s not connected", addr)
+	}
+	t.Cleanup(func() {
+		c.client.Close()
+		c.waitClosed(t)
+	})
+	return c
+}
+
+func (c *testClient) call(t *testing.T, req any) *testResp {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	resp, err := c.agent.Call(ctx, req)
+	if err != nil {
+		t.Fatalf("call %T: %v", req, err)
+	}
+	return resp.(*testResp)
+}
+
+func (c *testClient) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not closed")
+	}
+}
+
+// waitFor poll cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not done", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInstancesSideBySide(t *testing.T) {
+	wsConfig := testWSConfig()
+	wsConfig.PendingWriteNum = 7
+	ws := &WsServerWrapper{Config: wsConfig}
+	servers := []struct {
+		s     *testServer
+		style uint
+	}{
+		{s: startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp1", nil), style: network.TYPE_CLIENT_TCP},
+		{s: startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp2", nil), style: network.TYPE_CLIENT_TCP},
+		{s: startTestServer(t, ws, "ws", nil), style: network.TYPE_CLIENT_WEBSOCKET},
+		{s: startTestServer(t, &UdpServerWrapper{Config: testUDPConfig()}, "udp", nil), style: network.TYPE_CLIENT_UDP},
+	}
+	if ws.server.PendingWriteNum != 7 {
+		t.Fatalf("pending write num of the config lost: %d", ws.server.PendingWriteNum)
+	}
+
+	for i, s := range servers {
+		addr := s.s.inst.GetAddr()
+		if s.style == network.TYPE_CLIENT_WEBSOCKET {
+			addr = "ws://" + addr
+		}
+		c := dialTestClient(t, addr, s.style)
+		for n := 0; n < 3; n++ {
+			if resp := c.call(t, &testReq{N: i*10 + n}); resp.N != i*10+n || resp.From != s.s.tag {
+				t.Fatalf("call of %s: %+v", s.s.tag, resp)
+			}
+		}
+		waitFor(t, s.s.tag+" agent count", func() bool { return s.s.inst.AgentCount() == 1 })
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, style := range []uint{network.TYPE_CLIENT_TCP, network.TYPE_CLIENT_UDP} {
+		var server Server = &TcpServerWrapper{Config: testTCPConfig()}
+		if style == network.TYPE_CLIENT_UDP {
+			server = &UdpServerWrapper{Config: testUDPConfig()}
+		}
+		drained := make(chan network.Agent, 4)
+		s := startTestServer(t, server, "shutdown", func(inst *Instance) {
+			inst.RegisterOnDraining(func(agent network.Agent) {
+				// the agents draining can still send.
+				agent.SendMessage(&testNote{Text: "bye"})
+				drained <- agent
+			})
+		})
+		clients := []*testClient{
+			dialTestClient(t, s.inst.GetAddr(), style),
+			dialTestClient(t, s.inst.GetAddr(), style),
+		}
+		for _, c := range clients {
+			c.call(t, &testReq{N: 1})
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		start := time.Now()
+		err := s.inst.Shutdown(ctx)
+		cancel()
+		if err != nil || time.Since(start) > 2*time.Second {
+			t.Fatalf("shutdown of %d: %v in %v", style, err, time.Since(start))
+		}
+		if len(drained) != len(clients) {
+			t.Fatalf("%d of %d agents drained", len(drained), len(clients))
+		}
+		if n := s.inst.AgentCount(); n != 0 {
+			t.Fatalf("%d agents left after shutdown", n)
+		}
+		for _, c := range clients {
+			select {
+			case note := <-c.notes:
+				if note.Text != "bye" {
+					t.Fatalf("note %q while draining", note.Text)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("note of the draining agent not received")
+			}
+			// the udp clients are not told.
+			if style == network.TYPE_CLIENT_TCP {
+				c.waitClosed(t)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"runtime/debug"
+
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// -------------------------------------------------------------------------------------
+// Interceptors wrap the routing of inbound messages and the writing of outbound ones.
+// Global interceptors run first, then the ones of the message, in the order they are
+// added. An interceptor short-circuits by not calling next, it returns nil to drop the
+// message silently. An inbound error is logged, and closes the connection when the
+// instance is not RoutineSafe, like a routing error.
+// They must be added before the instance starts.
+
+// Invoker handles the message at the end of the chain.
+type Invoker func(agent network.Agent, msgId uint16, msg any) error
+
+type Interceptor func(agent network.Agent, msgId uint16, msg any, next Invoker) error
+
+type interceptorChain struct {
+	global []Interceptor
+	msg    map[uint16][]Interceptor
+}
+
+func (c *interceptorChain) add(i []Interceptor) {
+	c.global = append(c.global, i...)
+}
+
+func (c *interceptorChain) addMsg(id uint16, i []Interceptor) {
+	if c.msg == nil {
+		c.msg = make(map[uint16][]Interceptor)
+	}
+	c.msg[id] = append(c.msg[id], i...)
+}
+
+func (c *interceptorChain) empty() bool {
+	return len(c.global) == 0 && len(c.msg) == 0
+}
+
+func (c *interceptorChain) invoke(agent network.Agent, msgId uint16, msg any, final Invoker) error {
+	if c.empty() {
+		return final(agent, msgId, msg)
+	}
+	return invokeChain(c.global, agent, msgId, msg, func(agent network.Agent, msgId uint16, msg any) error {
+		return invokeChain(c.msg[msgId], agent, msgId, msg, final)
+	})
+}
+
+func invokeChain(chain []Interceptor, agent network.Agent, msgId uint16, msg any, final Invoker) error {
+	if len(chain) == 0 {
+		return final(agent, msgId, msg)
+	}
+	return chain[0](agent, msgId, msg, func(agent network.Agent, msgId uint16, msg any) error {
+		return invokeChain(chain[1:], agent, msgId, msg, final)
+	})
+}
+
+//-------------------------------------------------------------------------------------
+// register function.
+
+// Use add global inbound interceptors.
+func (inst *Instance) Use(i ...Interceptor) {
+	inst.inbound.add(i)
+}
+
+// UseMessage add inbound interceptors of msg, msg is a registered message or its id.
+func (inst *Instance) UseMessage(msg any, i ...Interceptor) {
+	inst.inbound.addMsg(inst.interceptId(msg), i)
+}
+
+// UseOutbound add global outbound interceptors, they run on SendMessage,
+// SendRawMessage, Call and Reply.
+func (inst *Instance) UseOutbound(i ...Interceptor) {
+	inst.outbound.add(i)
+}
+
+// UseOutboundMessage add outbound interceptors of msg, msg is a registered message or
+// its id.
+func (inst *Instance) UseOutboundMessage(msg any, i ...Interceptor) {
+	inst.outbound.addMsg(inst.interceptId(msg), i)
+}
+
+func (inst *Instance) interceptId(msg any) uint16 {
+	if id, ok := msg.(uint16); ok {
+		return id
+	}
+	if inst.processor == nil {
+		log.Fatalf("register processor before adding message interceptors")
+	}
+	id := inst.msgIdOf(msg)
+	if id == 0 {
+		log.Fatalf("message %v not registered", reflect.TypeOf(msg))
+	}
+	return id
+}
+
+// msgIdOf get the id of a message given or taken by the processor.
+func (inst *Instance) msgIdOf(msg any) uint16 {
+	if m, ok := msg.(interface{ MsgId() uint16 }); ok {
+		return m.MsgId()
+	}
+	return inst.processor.GetMsgId(reflect.TypeOf(msg))
+}
+
+//-------------------------------------------------------------------------------------
+// common interceptors.
+
+// RecoverInterceptor turn a panic of the handler into an error so one bad message
+// doesn't take the process down.
+func RecoverInterceptor(agent network.Agent, msgId uint16, msg any, next Invoker) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.With("msg_id", msgId, "remote", agent.RemoteAddr()).Errorf("handler panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("handler of message %v panic: %v", msgId, r)
+		}
+	}()
+	return next(agent, msgId, msg)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// trace records the interceptors run, they run in the event loop.
+type trace struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (tr *trace) interceptor(name string) Interceptor {
+	return func(agent network.Agent, msgId uint16, msg any, next Invoker) error {
+		tr.mu.Lock()
+		tr.names = append(tr.names, name)
+		tr.mu.Unlock()
+		return next(agent, msgId, msg)
+	}
+}
+
+func (tr *trace) take() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	ret := strings.Join(tr.names, " ")
+	tr.names = nil
+	return ret
+}
+
+func waitNote(t *testing.T, notes chan *testNote) *testNote {
+	t.Helper()
+	select {
+	case note := <-notes:
+		return note
+	case <-time.After(3 * time.Second):
+		t.Fatal("note not received")
+	}
+	return nil
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	tr := new(trace)
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", func(inst *Instance) {
+		inst.Use(tr.interceptor("global1"))
+		inst.UseMessage(&testReq{}, tr.interceptor("req1"))
+		// the global ones run first, whenever they are added.
+		inst.Use(tr.interceptor("global2"))
+		inst.UseMessage(&testReq{}, tr.interceptor("req2"))
+		inst.UseMessage(&testNote{}, tr.interceptor("note"))
+	})
+	c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_TCP)
+
+	if resp := c.call(t, &testReq{N: 3}); resp.N != 3 {
+		t.Fatalf("call through the interceptors: %+v", resp)
+	}
+	if got := tr.take(); got != "global1 global2 req1 req2" {
+		t.Fatalf("interceptors of testReq: %q", got)
+	}
+	c.agent.SendMessage(&testNote{Text: "hi"})
+	waitNote(t, s.notes)
+	if got := tr.take(); got != "global1 global2 note" {
+		t.Fatalf("interceptors of testNote: %q", got)
+	}
+}
+
+func TestInterceptorShortCircuit(t *testing.T) {
+	tr := new(trace)
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", func(inst *Instance) {
+		inst.Use(tr.interceptor("before"))
+		inst.UseMessage(&testNote{}, func(agent network.Agent, msgId uint16, msg any, next Invoker) error {
+			switch msg.(*testNote).Text {
+			case "deny":
+				return errors.New("denied")
+			case "drop":
+				return nil
+			}
+			return next(agent, msgId, msg)
+		})
+		inst.UseMessage(&testNote{}, tr.interceptor("after"))
+	})
+	c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_TCP)
+
+	for _, text := range []string{"deny", "drop", "pass"} {
+		c.agent.SendMessage(&testNote{Text: text})
+	}
+	// the notes are routed in order, so the first two are done.
+	if note := waitNote(t, s.notes); note.Text != "pass" {
+		t.Fatalf("note %q reached the handler", note.Text)
+	}
+	if got := tr.take(); got != "before before before after" {
+		t.Fatalf("interceptors run: %q", got)
+	}
+	// the error is logged, the conn of a RoutineSafe instance stays.
+	if resp := c.call(t, &testReq{N: 1}); resp.N != 1 {
+		t.Fatalf("call after an error: %+v", resp)
+	}
+}
+
+func TestInterceptorOutbound(t *testing.T) {
+	tr := new(trace)
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", func(inst *Instance) {
+		inst.UseOutbound(tr.interceptor("out"))
+		inst.UseOutboundMessage(&testResp{}, func(agent network.Agent, msgId uint16, msg any, next Invoker) error {
+			resp := *msg.(*testResp)
+			resp.From = "rewritten"
+			return next(agent, msgId, &resp)
+		})
+		inst.UseOutboundMessage(&testNote{}, func(agent network.Agent, msgId uint16, msg any, next Invoker) error {
+			return nil
+		})
+	})
+	c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_TCP)
+
+	if resp := c.call(t, &testReq{N: 2}); resp.N != 2 || resp.From != "rewritten" {
+		t.Fatalf("reply not rewritten: %+v", resp)
+	}
+	if got := tr.take(); got != "out" {
+		t.Fatalf("outbound interceptors run: %q", got)
+	}
+
+	var agent network.Agent
+	s.inst.RangeAgents(func(a network.Agent) bool {
+		agent = a
+		return false
+	})
+	// dropped by its interceptor, nothing is written.
+	if !agent.SendMessage(&testNote{Text: "dropped"}) {
+		t.Fatal("message dropped by an interceptor not sent")
+	}
+	c.call(t, &testReq{N: 3})
+	select {
+	case note := <-c.notes:
+		t.Fatalf("note %q written", note.Text)
+	default:
+	}
+}
+
+func TestRecoverInterceptor(t *testing.T) {
+	ring := log.NewRingSink(64)
+	log.AddSink(ring)
+	defer log.SetSinks()
+
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", func(inst *Instance) {
+		inst.Use(RecoverInterceptor)
+		// in place of the handler of startTestServer.
+		inst.Processor().SetHandler(&testJoin{}, func(agent network.Agent, args []any) {
+			panic("boom " + args[0].(*testJoin).Group)
+		})
+	})
+	c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_TCP)
+
+	c.agent.SendMessage(&testJoin{Group: "g"})
+	// the process and the conn survive the panic.
+	if resp := c.call(t, &testReq{N: 4}); resp.N != 4 {
+		t.Fatalf("call after a handler panic: %+v", resp)
+	}
+	waitFor(t, "panic log", func() bool {
+		for _, rec := range ring.Records() {
+			if rec.Level == log.Level_Error && strings.Contains(rec.Text, "handler panic: boom g") {
+				return true
+			}
+		}
+		return false
+	})
+}
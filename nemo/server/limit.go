@@ -0,0 +1,274 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/conf"
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// -------------------------------------------------------------------------------------
+// Flood protection of the server agents. Each agent reads through token buckets of
+// messages and bytes, and of the message ids given a rate by SetMsgRateLimit. A message
+// over a bucket is dropped, delayed, kicks its agent or bans its ip, by the Limit of the
+// config. The heartbeat frames are not limited. The conns of each ip are limited by the
+// network.IPLimiter of the instance.
+
+// LimitAction is what is done with a message over a limit.
+type LimitAction int
+
+const (
+	LimitDrop  LimitAction = iota // the message is dropped.
+	LimitDelay                    // the message waits for its tokens.
+	LimitKick                     // the agent is closed.
+	LimitBan                      // the agent is closed and its ip refused for a while.
+)
+
+var limitActionNames = [...]string{"drop", "delay", "kick", "ban"}
+
+func (act LimitAction) String() string {
+	if act < 0 || int(act) >= len(limitActionNames) {
+		return "unknown"
+	}
+	return limitActionNames[act]
+}
+
+// ParseLimitAction get the action of its name, "" is LimitDrop.
+func ParseLimitAction(name string) (LimitAction, bool) {
+	if name == "" {
+		return LimitDrop, true
+	}
+	for i, n := range limitActionNames {
+		if n == name {
+			return LimitAction(i), true
+		}
+	}
+	return LimitDrop, false
+}
+
+// errLimited is the error of an agent closed by its limits.
+var errLimited = errors.New("rate limited")
+
+// maxDelayed is the count of messages of an agent waiting for their tokens, the next
+// ones are dropped. Only the agents run by datagram have more than one.
+const maxDelayed = 128
+
+// limits of the agents of an instance, a rate of 0 is off.
+type limits struct {
+	msgRate   float64
+	msgBurst  float64
+	byteRate  float64
+	byteBurst float64
+	action    LimitAction
+	banTime   time.Duration
+}
+
+// noLimits are the limits of an instance started by no server wrapper.
+var noLimits = &limits{}
+
+func newLimits(c *conf.Limit) *limits {
+	action, ok := ParseLimitAction(c.Action)
+	if !ok {
+		log.Fatalf("unknown limit action %q", c.Action)
+	}
+	return &limits{
+		msgRate:   c.MsgRate,
+		msgBurst:  float64(c.MsgBurst),
+		byteRate:  c.ByteRate,
+		byteBurst: float64(c.ByteBurst),
+		action:    action,
+		banTime:   c.BanTime,
+	}
+}
+
+// setLimits apply the limits of a config section.
+func (inst *Instance) setLimits(c *conf.Limit) {
+	inst.limits.Store(newLimits(c))
+	inst.ipLimiter.SetMaxConnPerIP(c.MaxConnPerIP)
+}
+
+func (inst *Instance) getLimits() *limits {
+	if l := inst.limits.Load(); l != nil {
+		return l
+	}
+	return noLimits
+}
+
+// tokenBucket fills at rate tokens a second up to burst, the rate if burst is 0.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take n tokens, n is at most burst. It get the wait until they are there, 0 if they
+// are taken. With debt they are taken anyway, and the next ones wait for them.
+func (b *tokenBucket) take(now time.Time, n, rate, burst float64, debt bool) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	n = min(n, burst)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0
+	}
+	wait := time.Duration((n - b.tokens) / rate * float64(time.Second))
+	if debt {
+		b.tokens -= n
+	}
+	return max(wait, 1)
+}
+
+// rateLimiter are the buckets of an agent.
+type rateLimiter struct {
+	mu    sync.Mutex
+	msgs  tokenBucket
+	bytes tokenBucket
+	ids   map[uint16]*tokenBucket
+
+	// the delayed messages wait one after the other.
+	delay   sync.Mutex
+	delayed atomic.Int32
+}
+
+// reset the buckets for a new peer.
+func (l *rateLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = tokenBucket{}
+	l.bytes = tokenBucket{}
+	l.ids = nil
+}
+
+// allowRead check a message of n bytes against the limits of the instance, before it
+// is unmarshaled. It get false if the message is dropped, with an error if the agent
+// is closed.
+func (a *Agent) allowRead(n int) (bool, error) {
+	if a.active {
+		return true, nil
+	}
+	l := a.inst.getLimits()
+	if l.msgRate <= 0 && l.byteRate <= 0 {
+		return true, nil
+	}
+	return a.limit(l, func(now time.Time, debt bool) time.Duration {
+		wait := a.limiter.msgs.take(now, 1, l.msgRate, l.msgBurst, debt)
+		if wait == 0 || debt {
+			wait = max(wait, a.limiter.bytes.take(now, float64(n), l.byteRate, l.byteBurst, debt))
+		}
+		return wait
+	})
+}
+
+// allowMsg check the message id against its rate set by SetMsgRateLimit.
+func (a *Agent) allowMsg(id uint16) (bool, error) {
+	meta := a.inst.msgMeta[id]
+	if a.active || meta.rate <= 0 {
+		return true, nil
+	}
+	return a.limit(a.inst.getLimits(), func(now time.Time, debt bool) time.Duration {
+		if a.limiter.ids == nil {
+			a.limiter.ids = make(map[uint16]*tokenBucket)
+		}
+		b := a.limiter.ids[id]
+		if b == nil {
+			b = new(tokenBucket)
+			a.limiter.ids[id] = b
+		}
+		return b.take(now, 1, meta.rate, float64(meta.burst), debt)
+	})
+}
+
+// limit take the tokens of a message by take, under the lock of the buckets, and do
+// the action of l if they are not there. The delayed messages of an agent wait one
+// after the other, so the agents run by datagram are delayed as the others.
+func (a *Agent) limit(l *limits, take func(now time.Time, debt bool) time.Duration) (bool, error) {
+	if l.action != LimitDelay {
+		a.limiter.mu.Lock()
+		wait := take(time.Now(), false)
+		a.limiter.mu.Unlock()
+		return a.overLimit(l, wait)
+	}
+
+	if a.limiter.delayed.Add(1) > maxDelayed {
+		a.limiter.delayed.Add(-1)
+		metricLimited.Inc(LimitDrop.String())
+		return false, nil
+	}
+	defer a.limiter.delayed.Add(-1)
+	a.limiter.delay.Lock()
+	defer a.limiter.delay.Unlock()
+	a.limiter.mu.Lock()
+	wait := take(time.Now(), true)
+	a.limiter.mu.Unlock()
+	if wait > 0 {
+		metricLimited.Inc(l.action.String())
+		time.Sleep(wait)
+	}
+	return true, nil
+}
+
+// overLimit drop, kick or ban by l for a message waiting wait for its tokens.
+func (a *Agent) overLimit(l *limits, wait time.Duration) (bool, error) {
+	if wait <= 0 {
+		return true, nil
+	}
+	metricLimited.Inc(l.action.String())
+	switch l.action {
+	case LimitKick:
+		a.logger().Info("close agent: rate limited")
+		a.outer.Close()
+		return false, errLimited
+	case LimitBan:
+		a.logger().With("ban_time", l.banTime).Info("ban agent: rate limited")
+		a.outer.Close()
+		a.inst.Ban(network.IPOf(a.RemoteAddr()), l.banTime)
+		return false, errLimited
+	}
+	return false, nil
+}
+
+//-------------------------------------------------------------------------------------
+// ban list.
+
+// Ban refuse the conns of ip for d and close its agents.
+func (inst *Instance) Ban(ip string, d time.Duration) {
+	if ip == "" {
+		return
+	}
+	inst.ipLimiter.Ban(ip, d)
+	for _, a := range inst.registry.snapshot("", true) {
+		if network.IPOf(a.RemoteAddr()) == ip {
+			a.outer.Close()
+		}
+	}
+}
+
+// Unban accept the conns of ip again, false if it is not banned.
+func (inst *Instance) Unban(ip string) bool {
+	return inst.ipLimiter.Unban(ip)
+}
+
+// Bans get the banned ips and the end of their ban.
+func (inst *Instance) Bans() map[string]time.Time {
+	return inst.ipLimiter.Bans()
+}
+
+// SetMsgRateLimit let each agent read the message id up to rate times a second, and
+// burst times at once, call it before start. The action is the one of the limits of
+// the server.
+func (inst *Instance) SetMsgRateLimit(id uint16, rate float64, burst int) {
+	inst.setMsgMeta(id, func(meta *msgMeta) { meta.rate, meta.burst = rate, burst })
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/conf"
+	"github.com/lircstar/nemo/nemo/network"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		config := testTCPConfig()
+		config.Limit = conf.Limit{MsgRate: 10, MsgBurst: 2, Action: "drop"}
+		s := startTestServer(t, &TcpServerWrapper{Config: config}, "tcp", nil)
+		c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_TCP)
+		for i := 0; i < 20; i++ {
+			c.agent.SendMessage(&testNote{Text: "flood"})
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := len(s.notes); n < 2 || n > 6 {
+			t.Fatalf("%d of 20 notes routed", n)
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		config := testUDPConfig()
+		config.Limit = conf.Limit{MsgRate: 20, MsgBurst: 1, Action: "delay"}
+		s := startTestServer(t, &UdpServerWrapper{Config: config}, "udp", nil)
+		c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_UDP)
+		const n = 5
+		for i := 0; i < n; i++ {
+			c.agent.SendMessage(&testNote{Text: "burst"})
+		}
+		var first, last time.Time
+		for i := 0; i < n; i++ {
+			select {
+			case last = <-s.times:
+				if i == 0 {
+					first = last
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("%d of %d notes routed", i, n)
+			}
+		}
+		// the datagrams of the agent are run at once, they wait one after the other.
+		if d := last.Sub(first); d < 150*time.Millisecond {
+			t.Fatalf("%d notes routed in %v", n, d)
+		}
+	})
+
+	t.Run("ban", func(t *testing.T) {
+		config := testTCPConfig()
+		config.Limit = conf.Limit{MsgRate: 1, Action: "ban", BanTime: time.Minute}
+		s := startTestServer(t, &TcpServerWrapper{Config: config}, "tcp", nil)
+		addr := s.inst.GetAddr()
+		c := dialTestClient(t, addr, network.TYPE_CLIENT_TCP)
+		c.agent.SendMessage(&testNote{Text: "one"})
+		c.agent.SendMessage(&testNote{Text: "two"})
+		c.waitClosed(t)
+		if _, ok := s.inst.Bans()["127.0.0.1"]; !ok {
+			t.Fatalf("bans %v", s.inst.Bans())
+		}
+
+		// a banned ip is refused until it is unbanned.
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = raw.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err = raw.Read(make([]byte, 1)); err == nil {
+			t.Fatal("banned ip accepted")
+		}
+		_ = raw.Close()
+		if !s.inst.Unban("127.0.0.1") {
+			t.Fatal("ip not unbanned")
+		}
+		dialTestClient(t, addr, network.TYPE_CLIENT_TCP).call(t, &testReq{N: 1})
+	})
+}
@@ -1,10 +1,11 @@
 package server
 
 import (
+	"context"
 	"github.com/lircstar/nemo/nemo/conf"
-	"github.com/lircstar/nemo/nemo/network"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime/pprof"
 	"strconv"
 	"syscall"
@@ -13,6 +14,9 @@ import (
 	"github.com/lircstar/nemo/sys/log"
 )
 
+// loopPeriod is the tick of onLoop and of the tcp conns flushing on tick.
+const loopPeriod = 30 * time.Millisecond
+
 const (
 	StatusServerStarting = 1
 	StatusServerStarted  = 2
@@ -20,83 +24,69 @@ const (
 	StatusServerStopped  = 4
 )
 
-var server Server = nil
-
-var eventChan = make(chan *Event, 1024)
-var exitProcChan = make(chan int, 1)
-var endProcChan = make(chan int, 1)
-
-var serverStatus = StatusServerStopped
-
 func New(s Server) Server {
-	server = s
-	return server
+	defaultInstance.setServer(s)
+	return s
 }
 
-func mainProc() {
-	t1 := time.NewTimer(time.Second * 10)
+// mainProc run the event loop, addr is the metric label of the instance.
+func (inst *Instance) mainProc(addr string) {
+	t1 := time.NewTimer(inst.heartbeatPeriod())
+	loop := time.NewTicker(loopPeriod)
+	defer loop.Stop()
 	for {
 		select {
-		case event := <-eventChan:
-			err := processor.Route(event.agent, event.msg, event.userData)
+		case event := <-inst.eventChan:
+			metricEventQueue.Set(float64(len(inst.eventChan)), addr)
+			err := inst.dispatch(event)
+			event.release()
 			if err != nil {
-				log.Debugf("route message error: %v", err)
+				log.With("conn", event.agent.ConnectionId(), "remote", event.agent.RemoteAddr(),
+					"msg", reflect.TypeOf(event.msg)).Debugf("route message error: %v", err)
 			}
-		case <-time.After(time.Millisecond * 30):
-			if serverStatus == StatusServerStarted {
-				onLoopCallback()
+		case <-loop.C:
+			if inst.status.Load() == StatusServerStarted && inst.onLoopCallback != nil {
+				inst.onLoopCallback()
 			}
+			inst.flushTicker.Tick()
 		case <-t1.C:
-			if server.GetType() == TYPE_SERVER_TCP {
-				loopAgentPool()
-				loopUdpAgentPool()
-			}
-			t1.Reset(time.Second * 10)
-		case <-exitProcChan:
-			serverStatus = StatusServerStopping
-			doFinish()
-			serverStatus = StatusServerStopped
+			inst.loopAgentPool()
+			t1.Reset(inst.heartbeatPeriod())
+		case <-inst.exitProcChan:
+			inst.status.Store(StatusServerStopping)
+			inst.doFinish()
 			return
 		}
 	}
 }
 
-func doFinish() {
-	destroy()
-	endProcChan <- 0
+func (inst *Instance) doFinish() {
+	inst.destroy()
+	inst.removeAgentPool()
+	inst.status.Store(StatusServerStopped)
+	close(inst.endProcChan)
 	log.Info("Nemo closed.")
 }
 
-func loopAgentPool() {
-	agentPool.UsedRange(func(i any) {
-		agent := i.(network.Agent)
-		if agent != nil {
-			conn := agent.GetConn()
-			if conn != nil && !conn.IsClosed() {
-				timeout := conf.GetTCP().TimeOut
-				if timeout > 0 && !agent.IsActive() &&
-					time.Now().Unix()-agent.GetIdleTime() > int64(timeout) {
-					agent.Close()
-				}
-			}
-		}
-	})
+// heartbeatPeriod get the period of loopAgentPool.
+func (inst *Instance) heartbeatPeriod() time.Duration {
+	return heartbeatPeriod(time.Duration(inst.pingInterval.Load()))
 }
 
-func loopUdpAgentPool() {
-	if udpAgentPool != nil {
-		udpAgentPool.UsedRange(func(i interface{}) {
-			agent := i.(*UdpAgent)
-			if agent != nil {
-				if agent.conn != nil && !agent.conn.IsClosed() {
-					timeout := conf.GetUDP().TimeOut
-					if timeout > 0 &&
-						time.Now().Unix()-agent.idleTime > int64(timeout) {
-						agent.Close()
-					}
-				}
-			}
-		})
+// loopAgentPool close the agents silent for the time out, and ping the others.
+func (inst *Instance) loopAgentPool() {
+	timeout := inst.timeOut.Load()
+	interval := time.Duration(inst.pingInterval.Load())
+	if timeout <= 0 && interval <= 0 {
+		return
+	}
+	// the registry holds the connected server agents, the pool also the ones being
+	// made by the servers.
+	now := time.Now()
+	for _, a := range inst.registry.snapshot("", true) {
+		if !a.conn.IsClosed() {
+			a.beat(now, interval, timeout)
+		}
 	}
 }
 
@@ -109,10 +99,39 @@ func logInit() {
 		log.SetLevel(config.LogLevel)
 	}
 	if config.LogFile {
+		log.SetRotate(log.RotateOption{
+			MaxSize:    int64(config.LogMaxSize) * 1024 * 1024,
+			Rotate:     config.LogRotate,
+			MaxBackups: config.LogMaxBackups,
+			MaxAge:     time.Duration(config.LogMaxAge) * 24 * time.Hour,
+			Compress:   true,
+		})
 		log.LogFile()
 	}
 }
 
+// watchConf reload the config file on SIGHUP or when it changes, the log level is
+// applied live. The servers apply their own sections.
+func watchConf() (stop func()) {
+	stopLevel := conf.OnChange(conf.SectionSYS, func() {
+		log.SetLevel(conf.GetSYS().LogLevel)
+	})
+	if conf.Path() == "" {
+		return stopLevel
+	}
+
+	stopSignal := conf.WatchSignal()
+	stopWatch := func() {}
+	if interval := conf.GetSYS().ConfWatch; interval > 0 {
+		stopWatch = conf.Watch(interval)
+	}
+	return func() {
+		stopLevel()
+		stopSignal()
+		stopWatch()
+	}
+}
+
 func logClose() {
 	log.Close()
 }
@@ -174,53 +193,58 @@ func closeSig() {
 		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 		sig := <-c
 		log.Infof("Nemo closing. (signal:%v)", sig)
-		exitProcChan <- 0
+		if timeout := conf.GetSYS().ShutdownTimeout; timeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := defaultInstance.Shutdown(ctx); err != nil {
+				log.Warnf("shutdown not finished in %v; %v", timeout, err)
+			}
+			cancel()
+		} else {
+			defaultInstance.Stop()
+		}
 	}
-	<-endProcChan
+	defaultInstance.Wait()
 }
 
 // ////////////////////////////////////////////////////////////
 // server
 
+// Start run the default instance and block until it is stopped.
 func Start() {
 
-	serverStatus = StatusServerStarting
-
 	logInit()
 
 	monitor()
 
-	createAgentPool()
-
-	go mainProc()
+	stopWatch := watchConf()
 
-	server.Start()
+	if sys := conf.GetSYS(); sys.AdminAddr != "" {
+		if err := StartAdmin(sys.AdminAddr, sys.AdminToken); err != nil {
+			log.Errorf("admin listener: %v", err)
+		}
+	}
 
-	log.Infof("Nemo %v starting up.", conf.GetSYS().Version)
-	log.Infof("Listen Address: %v", server.GetAddr())
+	defaultInstance.Start()
 
 	// close
 	closeSig()
 
-	removeAgentPool()
+	_ = StopAdmin(context.Background())
+	stopWatch()
 
 	logClose()
 
 }
 
 func Stop() {
-	exitProcChan <- 0
+	defaultInstance.Stop()
 }
 
-func destroy() {
-
-	if onDestroyCallback != nil {
-		onDestroyCallback()
-	}
-
-	server.Stop()
+// Shutdown drain the default instance gracefully, see Instance.Shutdown.
+func Shutdown(ctx context.Context) error {
+	return defaultInstance.Shutdown(ctx)
 }
 
 func GetStatus() int {
-	return serverStatus
+	return defaultInstance.GetStatus()
 }
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/lircstar/nemo/sys/metrics"
+)
+
+var (
+	metricMessages = metrics.NewCounter("nemo_messages_total",
+		"Messages routed by message id.", "msg_id")
+	metricRouteErrors = metrics.NewCounter("nemo_route_errors_total",
+		"Messages failed to route by message id.", "msg_id")
+	metricHandlerSeconds = metrics.NewHistogram("nemo_handler_seconds",
+		"Time taken by the handler of a message.", nil, "msg_id")
+	metricEventQueue = metrics.NewGauge("nemo_event_queue_length",
+		"Events waiting for the main loop of a RoutineSafe instance.", "addr")
+	metricTimeouts = metrics.NewCounter("nemo_timeouts_total",
+		"Agents closed for their peer being silent.", "addr")
+	metricLimited = metrics.NewCounter("nemo_rate_limited_total",
+		"Messages over the rate limits of their agent by action.", "action")
+)
+
+func msgIdLabel(id uint16) string {
+	return strconv.Itoa(int(id))
+}
+
+// metricAddr is the label of the instance.
+func (inst *Instance) metricAddr() string {
+	if inst.server == nil {
+		return ""
+	}
+	return inst.server.GetAddr()
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// -------------------------------------------------------------------------------------
+// registry keeps the connected server agents by connection id, and the named groups
+// (rooms, channels) they joined. Agents connected by clients are not kept.
+
+type registry struct {
+	nextId atomic.Uint64
+
+	mu     sync.RWMutex
+	agents map[uint64]*Agent
+	groups map[string]map[uint64]*Agent
+}
+
+func (r *registry) add(a *Agent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.agents == nil {
+		r.agents = make(map[uint64]*Agent)
+	}
+	r.agents[a.id] = a
+}
+
+func (r *registry) remove(a *Agent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.agents[a.id] == a {
+		delete(r.agents, a.id)
+	}
+	for name := range a.groups {
+		r.leave(name, a)
+	}
+}
+
+func (r *registry) leave(name string, a *Agent) {
+	group := r.groups[name]
+	if group[a.id] != a {
+		return
+	}
+	delete(group, a.id)
+	delete(a.groups, name)
+	if len(group) == 0 {
+		delete(r.groups, name)
+	}
+}
+
+// snapshot the agents of the group name, or all the agents if all is true, so
+// messages are not written under lock.
+func (r *registry) snapshot(name string, all bool) []*Agent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	group := r.groups[name]
+	if all {
+		group = r.agents
+	}
+	agents := make([]*Agent, 0, len(group))
+	for _, a := range group {
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+// register run when a server agent connects.
+func (a *Agent) register() {
+	if a.active {
+		return
+	}
+	a.inst.registry.add(a)
+}
+
+//-------------------------------------------------------------------------------------
+// lookup.
+
+// GetAgent find the connected agent by its connection id.
+func (inst *Instance) GetAgent(id uint64) network.Agent {
+	inst.registry.mu.RLock()
+	defer inst.registry.mu.RUnlock()
+	if a, ok := inst.registry.agents[id]; ok {
+		return a.outer
+	}
+	return nil
+}
+
+// AgentCount get the number of connected agents.
+func (inst *Instance) AgentCount() int {
+	inst.registry.mu.RLock()
+	defer inst.registry.mu.RUnlock()
+	return len(inst.registry.agents)
+}
+
+// RangeAgents call f for each connected agent until it returns false.
+func (inst *Instance) RangeAgents(f func(agent network.Agent) bool) {
+	for _, a := range inst.registry.snapshot("", true) {
+		if !f(a.outer) {
+			return
+		}
+	}
+}
+
+// Broadcast send msg to the connected agents which filter accepts, all if filter is
+// nil. msg is marshaled once. It returns the number of agents sent to.
+func (inst *Instance) Broadcast(msg any, filter func(agent network.Agent) bool) int {
+	agents := inst.registry.snapshot("", true)
+	if filter != nil {
+		n := 0
+		for _, a := range agents {
+			if filter(a.outer) {
+				agents[n] = a
+				n++
+			}
+		}
+		agents = agents[:n]
+	}
+	return inst.multicast(agents, msg)
+}
+
+//-------------------------------------------------------------------------------------
+// group.
+
+// Join add agent to the group name, the group is created on first join. Agents leave
+// their groups when closed.
+func (inst *Instance) Join(name string, agent network.Agent) {
+	a := asAgent(agent)
+	if a == nil {
+		return
+	}
+	r := &inst.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.groups == nil {
+		r.groups = make(map[string]map[uint64]*Agent)
+	}
+	group := r.groups[name]
+	if group == nil {
+		group = make(map[uint64]*Agent)
+		r.groups[name] = group
+	}
+	group[a.id] = a
+	if a.groups == nil {
+		a.groups = make(map[string]struct{})
+	}
+	a.groups[name] = struct{}{}
+}
+
+// Leave remove agent from the group name.
+func (inst *Instance) Leave(name string, agent network.Agent) {
+	a := asAgent(agent)
+	if a == nil {
+		return
+	}
+	inst.registry.mu.Lock()
+	defer inst.registry.mu.Unlock()
+	inst.registry.leave(name, a)
+}
+
+// GroupSize get the number of agents in the group name.
+func (inst *Instance) GroupSize(name string) int {
+	inst.registry.mu.RLock()
+	defer inst.registry.mu.RUnlock()
+	return len(inst.registry.groups[name])
+}
+
+// Multicast send msg to the agents of the group name, msg is marshaled once. It
+// returns the number of agents sent to.
+func (inst *Instance) Multicast(name string, msg any) int {
+	return inst.multicast(inst.registry.snapshot(name, false), msg)
+}
+
+// multicast marshal msg once and write the frame to every agent, on the channel and
+// in the priority class of its id. The outbound interceptors still run for each agent,
+// a message they replace is marshaled again.
+func (inst *Instance) multicast(agents []*Agent, msg any) int {
+	if len(agents) == 0 || inst.processor == nil {
+		return 0
+	}
+	data, err := inst.processor.Marshal(msg)
+	if err != nil {
+		log.With("msg", reflect.TypeOf(msg)).Errorf("marshal message error: %v", err)
+		return 0
+	}
+	msgId := inst.msgIdOf(msg)
+
+	n := 0
+	for _, a := range agents {
+		err := inst.outbound.invoke(a, msgId, msg, func(agent network.Agent, id uint16, m any) error {
+			if reflect.TypeOf(m).Comparable() && m == msg {
+				return a.write(id, nil, data...)
+			}
+			data, err := inst.processor.Marshal(m)
+			if err != nil {
+				return err
+			}
+			return a.write(id, nil, data...)
+		})
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// asAgent get the Agent of the agents created by the instance.
+func asAgent(agent network.Agent) *Agent {
+	switch a := agent.(type) {
+	case *Agent:
+		return a
+	case *UdpAgent:
+		return &a.Agent
+	}
+	log.With("agent", reflect.TypeOf(agent)).Error("agent not created by nemo")
+	return nil
+}
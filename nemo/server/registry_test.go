@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+)
+
+func TestBroadcastMulticast(t *testing.T) {
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", nil)
+	addr := s.inst.GetAddr()
+	clients := make([]*testClient, 3)
+	for i := range clients {
+		clients[i] = dialTestClient(t, addr, network.TYPE_CLIENT_TCP)
+	}
+	joined := make(map[uint64]bool)
+	for _, c := range clients[:2] {
+		joined[uint64(c.call(t, &testJoin{Group: "room"}).N)] = true
+	}
+	if n := s.inst.GroupSize("room"); n != 2 {
+		t.Fatalf("group of %d agents", n)
+	}
+
+	recv := func(c *testClient) string {
+		select {
+		case note := <-c.notes:
+			return note.Text
+		case <-time.After(3 * time.Second):
+			t.Fatal("note not received")
+			return ""
+		}
+	}
+
+	if n := s.inst.Broadcast(&testNote{Text: "all"}, nil); n != 3 {
+		t.Fatalf("broadcast to %d agents", n)
+	}
+	for _, c := range clients {
+		if text := recv(c); text != "all" {
+			t.Fatalf("broadcast got %q", text)
+		}
+	}
+
+	if n := s.inst.Multicast("room", &testNote{Text: "room"}); n != 2 {
+		t.Fatalf("multicast to %d agents", n)
+	}
+	for _, c := range clients[:2] {
+		if text := recv(c); text != "room" {
+			t.Fatalf("multicast got %q", text)
+		}
+	}
+
+	// the filter keeps the agents out of the room.
+	n := s.inst.Broadcast(&testNote{Text: "out"}, func(agent network.Agent) bool {
+		return !joined[agent.ConnectionId()]
+	})
+	if n != 1 {
+		t.Fatalf("filtered broadcast to %d agents", n)
+	}
+	if text := recv(clients[2]); text != "out" {
+		t.Fatalf("filtered broadcast got %q", text)
+	}
+	select {
+	case note := <-clients[0].notes:
+		t.Fatalf("filtered out agent got %q", note.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
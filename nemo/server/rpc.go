@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+)
+
+// -------------------------------------------------------------------------------------
+// Rpc frames put a header before the data of the processor, other frames are left as
+// they are.
+// -------------------------------------------------------
+// | MSG_ID_RPC(2) | flag(1) | seq(4) | processor message |
+// -------------------------------------------------------
+
+const (
+	rpcFlagRequest  = 1
+	rpcFlagResponse = 2
+	// the heartbeat, see heartbeat.go.
+	rpcFlagPing = 3
+	rpcFlagPong = 4
+
+	rpcHeaderLen = 7
+)
+
+// CallTimeout is used by Agent.Call when ctx has no deadline.
+var CallTimeout = 10 * time.Second
+
+var ErrAgentClosed = errors.New("agent closed")
+
+type rpcResult struct {
+	msg any
+	err error
+}
+
+// rpcTable keeps the calls waiting for response.
+type rpcTable struct {
+	mu      sync.Mutex
+	seq     uint32
+	pending map[uint32]chan rpcResult
+}
+
+func (t *rpcTable) add() (uint32, chan rpcResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seq++
+	if t.seq == 0 {
+		t.seq = 1
+	}
+	if t.pending == nil {
+		t.pending = make(map[uint32]chan rpcResult)
+	}
+	ch := make(chan rpcResult, 1)
+	t.pending[t.seq] = ch
+	return t.seq, ch
+}
+
+func (t *rpcTable) remove(seq uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, seq)
+}
+
+// done deliver the response of seq, it returns false if nobody waits for it.
+func (t *rpcTable) done(seq uint32, msg any) bool {
+	t.mu.Lock()
+	ch, ok := t.pending[seq]
+	delete(t.pending, seq)
+	t.mu.Unlock()
+
+	if ok {
+		ch <- rpcResult{msg: msg}
+	}
+	return ok
+}
+
+// close fail all waiting calls.
+func (t *rpcTable) close() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for _, ch := range pending {
+		ch <- rpcResult{err: ErrAgentClosed}
+	}
+}
+
+func putRpcHeader(flag byte, seq uint32) []byte {
+	header := make([]byte, rpcHeaderLen)
+	binary.BigEndian.PutUint16(header, network.MSG_ID_RPC)
+	header[2] = flag
+	if LittleEndian {
+		binary.LittleEndian.PutUint32(header[3:], seq)
+	} else {
+		binary.BigEndian.PutUint32(header[3:], seq)
+	}
+	return header
+}
+
+// parseRpcHeader return the flag, seq and the processor message of an rpc frame, flag
+// is 0 for other frames.
+func parseRpcHeader(data []byte) (byte, uint32, []byte) {
+	if len(data) < rpcHeaderLen || binary.BigEndian.Uint16(data) != network.MSG_ID_RPC {
+		return 0, 0, data
+	}
+	var seq uint32
+	if LittleEndian {
+		seq = binary.LittleEndian.Uint32(data[3:])
+	} else {
+		seq = binary.BigEndian.Uint32(data[3:])
+	}
+	return data[2], seq, data[rpcHeaderLen:]
+}
+
+// Call send req and wait for the response, the remote handler answers it by Reply.
+// CallTimeout is used if ctx has no deadline.
+func (a *Agent) Call(ctx context.Context, req any) (any, error) {
+	if a.conn == nil || a.conn.IsClosed() {
+		return nil, ErrAgentClosed
+	}
+	processor := a.inst.processor
+	if processor == nil {
+		return nil, errors.New("no processor")
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CallTimeout)
+		defer cancel()
+	}
+
+	seq, ch := a.rpc.add()
+	defer a.rpc.remove(seq)
+
+	if err := a.send(req, putRpcHeader(rpcFlagRequest, seq), nil); err != nil {
+		return nil, err
+	}
+
+	select {
+	case ret := <-ch:
+		return ret.msg, ret.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reply answer the rpc request being routed with resp. It sends resp as a normal
+// message if the message routed is not a request.
+func (a *Agent) Reply(resp any) bool {
+	var seq uint32
+	if ev := a.routing; ev != nil {
+		seq = ev.seq
+	}
+	return a.replyTo(seq, resp)
+}
+
+// replyTo answer the rpc request seq with resp, or send resp as a normal message if
+// seq is 0.
+func (a *Agent) replyTo(seq uint32, resp any) bool {
+	if seq == 0 {
+		return a.SendMessage(resp)
+	}
+
+	return a.send(resp, putRpcHeader(rpcFlagResponse, seq), nil) == nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+)
+
+func TestCallReply(t *testing.T) {
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", nil)
+	c := dialTestClient(t, s.inst.GetAddr(), network.TYPE_CLIENT_TCP)
+
+	// the calls at once get their own response.
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			resp, err := c.agent.Call(context.Background(), &testReq{N: n})
+			if err != nil || resp.(*testResp).N != n {
+				t.Errorf("call %d: %v %v", n, resp, err)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	// a note is not answered.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.agent.Call(ctx, &testNote{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("call of no reply: %v", err)
+	}
+}
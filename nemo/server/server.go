@@ -1,6 +1,10 @@
 package server
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/lircstar/nemo/nemo/conf"
 	"github.com/lircstar/nemo/nemo/network"
 	"github.com/lircstar/nemo/nemo/network/json"
@@ -13,10 +17,22 @@ import (
 // Tcp server.
 
 type TcpServerWrapper struct {
-	server *network.TCPServer
+	// Config of the server, conf.GetTCP() is used if it is nil.
+	Config *conf.TCP
+
+	inst      *Instance
+	server    *network.TCPServer
+	reloading reloading
+}
+
+func (tcp *TcpServerWrapper) setInstance(inst *Instance) {
+	tcp.inst = inst
 }
 
 func (tcp *TcpServerWrapper) GetAddr() string {
+	if tcp.server == nil {
+		return ""
+	}
 	return tcp.server.Addr
 }
 
@@ -26,48 +42,88 @@ func (tcp *TcpServerWrapper) GetType() uint {
 
 func (tcp *TcpServerWrapper) Start() {
 
-	config := conf.GetTCP()
+	config := tcp.Config
+	if config == nil {
+		config = conf.GetTCP()
+		tcp.reloading.start(conf.SectionTCP, tcp.reload)
+	}
 	if len(config.Addr) == 0 {
 		log.Error("ip adrress of server cannot be zero.")
 		return
 	}
 
+	tcp.inst.routineSafe = config.RoutineSafe
+	tcp.inst.timeOut.Store(int64(config.TimeOut / time.Second))
+	tcp.inst.pingInterval.Store(int64(config.PingInterval))
+	tcp.inst.setLimits(&config.Limit)
+
 	tcp.server = new(network.TCPServer)
 	tcp.server.Addr = config.Addr
 	tcp.server.MaxConnNum = config.MaxConnNum
 	tcp.server.MinMsgLen = config.MinMsgLen
 	tcp.server.MaxMsgLen = config.MaxMsgLen
-	tcp.server.PendingWriteNum = 100
-	tcp.server.NewAgent = newAgent
+	tcp.server.PendingWriteNum = config.PendingWriteNum
+	tcp.server.NewAgent = tcp.inst.newAgent
 	tcp.server.LenMsgLen = config.LenMsgLen
 	tcp.server.LittleEndian = LittleEndian
+	tcp.server.CertFile = config.CertFile
+	tcp.server.KeyFile = config.KeyFile
+	tcp.server.ClientCAFile = config.CAFile
+	tcp.server.Compression = config.Compression
+	tcp.server.CompressThreshold = config.CompressThreshold
+	tcp.server.Secure = secureConfig(config.Secure, config.SecureKey, config.SecurePeerKey)
+	tcp.server.FlushOnTick = config.FlushOnTick
+	tcp.server.FlushTicker = tcp.inst.flushTicker
+	tcp.server.Backpressure = backpressure(config)
+	tcp.server.IPLimiter = tcp.inst.ipLimiter
 
-	if processor == nil {
-		processor = protobuf.NewProcessor()
+	if tcp.inst.processor == nil {
+		tcp.inst.processor = protobuf.NewProcessor()
 	}
 
 	if tcp.server != nil {
 		tcp.server.Start()
 	}
+}
 
-	if onInitCallback != nil {
-		onInitCallback()
-		serverStatus = StatusServerStarted
-	}
-
+// reload apply the live settings of conf.GetTCP().
+func (tcp *TcpServerWrapper) reload() {
+	config := conf.GetTCP()
+	tcp.inst.timeOut.Store(int64(config.TimeOut / time.Second))
+	tcp.inst.pingInterval.Store(int64(config.PingInterval))
+	tcp.inst.setLimits(&config.Limit)
+	tcp.server.SetMaxConnNum(config.MaxConnNum)
 }
 
 func (tcp *TcpServerWrapper) Stop() {
+	tcp.reloading.stop()
 	if tcp.server != nil {
 		tcp.server.Close()
 	}
 }
 
+func (tcp *TcpServerWrapper) Shutdown(ctx context.Context) error {
+	tcp.reloading.stop()
+	if tcp.server != nil {
+		return tcp.server.Shutdown(ctx)
+	}
+	return nil
+}
+
 // -------------------------------------------------------------------------------------
 // Websocket server.
 
 type WsServerWrapper struct {
-	server *network.WSServer
+	// Config of the server, conf.GetWSS() is used if it is nil.
+	Config *conf.WSS
+
+	inst      *Instance
+	server    *network.WSServer
+	reloading reloading
+}
+
+func (ws *WsServerWrapper) setInstance(inst *Instance) {
+	ws.inst = inst
 }
 
 func (ws *WsServerWrapper) GetType() uint {
@@ -75,16 +131,28 @@ func (ws *WsServerWrapper) GetType() uint {
 }
 
 func (ws *WsServerWrapper) GetAddr() string {
+	if ws.server == nil {
+		return ""
+	}
 	return ws.server.Addr
 }
 
 func (ws *WsServerWrapper) Start() {
-	config := conf.GetWSS()
+	config := ws.Config
+	if config == nil {
+		config = conf.GetWSS()
+		ws.reloading.start(conf.SectionWSS, ws.reload)
+	}
 	if len(config.Addr) == 0 {
 		log.Error("adrress of server cannot be zero.")
 		return
 	}
 
+	ws.inst.routineSafe = config.RoutineSafe
+	ws.inst.timeOut.Store(int64(config.TimeOut / time.Second))
+	ws.inst.pingInterval.Store(int64(config.PingInterval))
+	ws.inst.setLimits(&config.Limit)
+
 	ws.server = new(network.WSServer)
 	ws.server.Addr = config.Addr
 	ws.server.MaxConnNum = config.MaxConnNum
@@ -93,32 +161,59 @@ func (ws *WsServerWrapper) Start() {
 	ws.server.HTTPTimeout = config.HTTPTimeout
 	ws.server.CertFile = config.CertFile
 	ws.server.KeyFile = config.KeyFile
+	ws.server.Compression = config.Compression
+	ws.server.CompressThreshold = config.CompressThreshold
 	ws.server.LittleEndian = LittleEndian
-	ws.server.NewAgent = newAgent
+	ws.server.NewAgent = ws.inst.newAgent
+	ws.server.IPLimiter = ws.inst.ipLimiter
 
-	processor = json.NewProcessor()
+	if ws.inst.processor == nil {
+		ws.inst.processor = json.NewProcessor()
+	}
 
 	if ws.server != nil {
 		ws.server.Start()
 	}
+}
 
-	if onInitCallback != nil {
-		onInitCallback()
-		serverStatus = StatusServerStarted
-	}
+// reload apply the live settings of conf.GetWSS().
+func (ws *WsServerWrapper) reload() {
+	config := conf.GetWSS()
+	ws.inst.timeOut.Store(int64(config.TimeOut / time.Second))
+	ws.inst.pingInterval.Store(int64(config.PingInterval))
+	ws.inst.setLimits(&config.Limit)
+	ws.server.SetMaxConnNum(config.MaxConnNum)
 }
 
 func (ws *WsServerWrapper) Stop() {
+	ws.reloading.stop()
 	if ws.server != nil {
 		ws.server.Close()
 	}
 }
 
+func (ws *WsServerWrapper) Shutdown(ctx context.Context) error {
+	ws.reloading.stop()
+	if ws.server != nil {
+		return ws.server.Shutdown(ctx)
+	}
+	return nil
+}
+
 // -------------------------------------------------------------------------------------
 // Udp server
 
 type UdpServerWrapper struct {
-	server *network.UDPServer
+	// Config of the server, conf.GetUDP() is used if it is nil.
+	Config *conf.UDP
+
+	inst      *Instance
+	server    *network.UDPServer
+	reloading reloading
+}
+
+func (udp *UdpServerWrapper) setInstance(inst *Instance) {
+	udp.inst = inst
 }
 
 func (udp *UdpServerWrapper) GetType() uint {
@@ -126,6 +221,9 @@ func (udp *UdpServerWrapper) GetType() uint {
 }
 
 func (udp *UdpServerWrapper) GetAddr() string {
+	if udp.server == nil {
+		return ""
+	}
 	return udp.server.Addr
 }
 
@@ -134,20 +232,112 @@ func (udp *UdpServerWrapper) GetPool() *pool.ObjectPool {
 }
 
 func (udp *UdpServerWrapper) Start() {
-	config := conf.GetUDP()
-	createUdpAgentPool()
+	config := udp.Config
+	if config == nil {
+		config = conf.GetUDP()
+		udp.reloading.start(conf.SectionUDP, udp.reload)
+	}
+
+	udp.inst.routineSafe = config.RoutineSafe
+	udp.inst.timeOut.Store(int64(config.TimeOut / time.Second))
+	udp.inst.pingInterval.Store(int64(config.PingInterval))
+	udp.inst.setLimits(&config.Limit)
+
+	if udp.inst.processor == nil {
+		udp.inst.processor = protobuf.NewProcessor()
+	}
+
 	udp.server = new(network.UDPServer)
 	udp.server.MaxConnNum = config.MaxConnNum
 	udp.server.MinMsgLen = config.MinMsgLen
 	udp.server.MaxMsgLen = config.MaxMsgLen
 	udp.server.LittleEndian = LittleEndian
-	udp.server.NewAgent = newUdpAgent
+	udp.server.Secure = secureConfig(config.Secure, config.SecureKey, config.SecurePeerKey)
+	udp.server.Reliable = reliableConfig(config)
+	udp.server.Handshake = config.Handshake
+	udp.server.NewAgent = udp.inst.newUdpAgent
+	udp.server.IPLimiter = udp.inst.ipLimiter
 	udp.server.Start(config.Addr)
 }
 
+// reload apply the live settings of conf.GetUDP().
+func (udp *UdpServerWrapper) reload() {
+	config := conf.GetUDP()
+	udp.inst.timeOut.Store(int64(config.TimeOut / time.Second))
+	udp.inst.pingInterval.Store(int64(config.PingInterval))
+	udp.inst.setLimits(&config.Limit)
+	udp.server.SetMaxConnNum(config.MaxConnNum)
+}
+
 func (udp *UdpServerWrapper) Stop() {
+	udp.reloading.stop()
 	if udp.server != nil {
 		udp.server.Close()
 	}
-	removeUdpAgentPool()
+}
+
+func (udp *UdpServerWrapper) Shutdown(ctx context.Context) error {
+	udp.reloading.stop()
+	if udp.server != nil {
+		return udp.server.Shutdown(ctx)
+	}
+	return nil
+}
+
+// reloading is the subscription of a wrapper to the changes of its config section.
+type reloading struct {
+	mu     sync.Mutex
+	cancel func()
+}
+
+func (r *reloading) start(section string, f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.cancel = conf.OnChange(section, f)
+}
+
+// stop the subscription, it may be called again.
+func (r *reloading) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+// backpressure get the backpressure of a tcp config.
+func backpressure(config *conf.TCP) network.Backpressure {
+	policy, err := network.ParseBackpressurePolicy(config.Backpressure)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return network.Backpressure{
+		Policy:          policy,
+		BlockTimeout:    config.BlockTimeout,
+		MaxPendingBytes: config.MaxPendingBytes,
+	}
+}
+
+// reliableConfig get the reliable layer of a udp config, nil if it is off.
+func reliableConfig(config *conf.UDP) *network.ARQConfig {
+	if !config.Reliable {
+		return nil
+	}
+	return &network.ARQConfig{MTU: config.MTU, Window: config.Window, NoCongestion: config.NoCongestion}
+}
+
+// secureConfig get the encrypted session of the config keys, nil if it is off.
+func secureConfig(secure bool, key, peerKey string) *network.SecureConfig {
+	if !secure {
+		return nil
+	}
+	config, err := network.NewSecureConfig(key, peerKey)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return config
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+	"github.com/lircstar/nemo/sys/log"
+)
+
+// -------------------------------------------------------------------------------------
+// Session lifecycle of server agents. When auth is required an agent starts
+// unauthenticated and only the whitelisted messages are routed, until Authenticate is
+// called. Agents which don't authenticate in time are closed.
+
+const (
+	sessionUnauthenticated int32 = iota
+	sessionAuthenticated
+)
+
+type sessionConfig struct {
+	required  bool
+	timeout   time.Duration
+	whitelist map[uint16]bool
+
+	mu         sync.Mutex
+	identities map[any]*Agent
+}
+
+// session is the state kept on each agent.
+type session struct {
+	state    atomic.Int32
+	identity any
+	timer    *time.Timer
+}
+
+// RequireAuth make agents of the instance start unauthenticated. Only the messages in
+// whitelist (registered messages or ids) are routed until Authenticate is called, the
+// agent is closed if it doesn't authenticate in timeout, 0 for no timeout.
+// It must be called before the instance starts.
+func (inst *Instance) RequireAuth(timeout time.Duration, whitelist ...any) {
+	inst.sessions.required = true
+	inst.sessions.timeout = timeout
+	inst.sessions.whitelist = make(map[uint16]bool)
+	for _, msg := range whitelist {
+		inst.sessions.whitelist[inst.interceptId(msg)] = true
+	}
+}
+
+// GetAgentByIdentity find the agent authenticated as identity.
+func (inst *Instance) GetAgentByIdentity(identity any) network.Agent {
+	s := &inst.sessions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.identities[identity]; ok {
+		return a.outer
+	}
+	return nil
+}
+
+// authorized tell if the message of ev can be routed.
+func (inst *Instance) authorized(ev *Event) bool {
+	if !inst.sessions.required || inst.sessions.whitelist[ev.msgId] {
+		return true
+	}
+	return ev.agent.IsActive() || ev.agent.IsAuthenticated()
+}
+
+//-------------------------------------------------------------------------------------
+// Agent.
+
+// Authenticate mark the agent as logged in as identity. The agent already logged in as
+// identity is kicked.
+func (a *Agent) Authenticate(identity any) {
+	s := &a.inst.sessions
+	if identity == nil {
+		log.Fatalf("identity required")
+	}
+	s.mu.Lock()
+	if a.session.identity != nil && s.identities[a.session.identity] == a {
+		delete(s.identities, a.session.identity)
+	}
+	old := s.identities[identity]
+	if s.identities == nil {
+		s.identities = make(map[any]*Agent)
+	}
+	s.identities[identity] = a
+	a.session.identity = identity
+	a.session.state.Store(sessionAuthenticated)
+	if a.session.timer != nil {
+		a.session.timer.Stop()
+		a.session.timer = nil
+	}
+	s.mu.Unlock()
+
+	if old != nil && old != a {
+		old.logger().With("identity", identity).Info("kicked by duplicate login")
+		old.Close()
+	}
+}
+
+func (a *Agent) IsAuthenticated() bool {
+	return a.session.state.Load() == sessionAuthenticated
+}
+
+// Identity given to Authenticate, nil if the agent is not authenticated.
+func (a *Agent) Identity() any {
+	s := &a.inst.sessions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return a.session.identity
+}
+
+// startSession run when the agent connects.
+func (a *Agent) startSession() {
+	s := &a.inst.sessions
+	if !s.required || a.active {
+		a.session.state.Store(sessionAuthenticated)
+		return
+	}
+	a.session.state.Store(sessionUnauthenticated)
+	if s.timeout > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var timer *time.Timer
+		timer = time.AfterFunc(s.timeout, func() {
+			s.mu.Lock()
+			// the agent may be authenticated or reused by another connection.
+			expired := a.session.timer == timer
+			s.mu.Unlock()
+			if expired && !a.IsAuthenticated() {
+				a.logger().Info("auth timeout")
+				a.Close()
+			}
+		})
+		a.session.timer = timer
+	}
+}
+
+// endSession run when the agent is closed.
+func (a *Agent) endSession() {
+	s := &a.inst.sessions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.session.timer != nil {
+		a.session.timer.Stop()
+		a.session.timer = nil
+	}
+	if a.session.identity != nil && s.identities[a.session.identity] == a {
+		delete(s.identities, a.session.identity)
+	}
+	a.session.identity = nil
+	a.session.state.Store(sessionUnauthenticated)
+}
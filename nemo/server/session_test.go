@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lircstar/nemo/nemo/network"
+)
+
+func TestAuth(t *testing.T) {
+	s := startTestServer(t, &TcpServerWrapper{Config: testTCPConfig()}, "tcp", func(inst *Instance) {
+		inst.RequireAuth(300*time.Millisecond, &testLogin{})
+	})
+	addr := s.inst.GetAddr()
+
+	// the messages before the login are dropped.
+	first := dialTestClient(t, addr, network.TYPE_CLIENT_TCP)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := first.agent.Call(ctx, &testReq{N: 1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("call before auth: %v", err)
+	}
+	first.call(t, &testLogin{Name: "alice"})
+	if resp := first.call(t, &testReq{N: 2}); resp.N != 2 {
+		t.Fatalf("call after auth: %+v", resp)
+	}
+
+	// the same login kicks the first client.
+	second := dialTestClient(t, addr, network.TYPE_CLIENT_TCP)
+	second.call(t, &testLogin{Name: "alice"})
+	first.waitClosed(t)
+	if a := s.inst.GetAgentByIdentity("alice"); a == nil || !a.IsAuthenticated() {
+		t.Fatal("second login not kept")
+	}
+
+	// no login in time.
+	third := dialTestClient(t, addr, network.TYPE_CLIENT_TCP)
+	third.waitClosed(t)
+	if resp := second.call(t, &testReq{N: 3}); resp.N != 3 {
+		t.Fatalf("call of the second client: %+v", resp)
+	}
+}
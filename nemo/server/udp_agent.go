@@ -1,8 +1,6 @@
 package server
 
 import (
-	"github.com/lircstar/nemo/nemo/conf"
-	"github.com/lircstar/nemo/sys/log"
 	"time"
 )
 
@@ -15,27 +13,11 @@ type UdpAgent struct {
 
 // Run goroutine safe
 func (a *UdpAgent) Run(data []byte) {
-	if processor != nil {
-		msg, err := processor.Unmarshal(data)
-		if err != nil {
-			log.Warnf("unmarshal message error: %v", err)
-			return
-		}
-		// main loop
-		if conf.GetUDP().RoutineSafe {
-			eventChan <- &Event{a, msg, a.userData}
-		} else {
-			err = processor.Route(a, msg, a.userData)
-		}
-
-		if err != nil {
-			log.Warnf("route message error: %v", err)
-			return
-		}
+	if err := a.handle(a, data); err != nil {
+		return
 	}
 
-	a.idleTime = time.Now().Unix()
-
+	a.idleTime.Store(time.Now().Unix())
 }
 
 //func (a *UdpAgent) IsLive() bool {
@@ -48,9 +30,12 @@ func (a *UdpAgent) Run(data []byte) {
 //}
 
 func (a *UdpAgent) OnClose() {
-	if onCloseCallback != nil {
-		onCloseCallback(a)
+	if a.inst.onCloseCallback != nil {
+		a.inst.onCloseCallback(a)
 	}
+	a.rpc.close()
+	a.endSession()
+	a.inst.registry.remove(&a.Agent)
 	// free agent from pool.
-	delUdpAgent(a)
+	a.inst.delAgent(a)
 }
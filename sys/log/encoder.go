@@ -0,0 +1,141 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Encoder turns a record into bytes appended to buf.
+type Encoder interface {
+	Encode(buf []byte, rec *Record) []byte
+}
+
+// TextEncoder writes the same line as the logger does without sink, fields are
+// appended as key=value.
+//
+//	2009/01/23 01:23:23 d.go:23: [INFO]  message key=value
+type TextEncoder struct{}
+
+func (enc *TextEncoder) Encode(buf []byte, rec *Record) []byte {
+	formatHeader(rec.Flag, rec.Time, &buf, rec.File, rec.Line)
+	buf = append(buf, levelString[rec.Level]...)
+	buf = append(buf, ' ', ' ')
+	buf = append(buf, rec.Text...)
+	for _, f := range rec.Fields {
+		buf = append(buf, ' ')
+		buf = appendLogfmtField(buf, f.Key, f.Value)
+	}
+	return append(buf, '\n')
+}
+
+// LogfmtEncoder writes records as logfmt.
+//
+//	time=2009-01-23T01:23:23.123+08:00 level=info msg=message caller=d.go:23 key=value
+type LogfmtEncoder struct{}
+
+func (enc *LogfmtEncoder) Encode(buf []byte, rec *Record) []byte {
+	buf = append(buf, "time="...)
+	buf = rec.Time.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, " level="...)
+	buf = append(buf, rec.Level.String()...)
+	buf = append(buf, ' ')
+	buf = appendLogfmtField(buf, "msg", rec.Text)
+	if rec.File != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmtField(buf, "caller", caller(rec))
+	}
+	for _, f := range rec.Fields {
+		buf = append(buf, ' ')
+		buf = appendLogfmtField(buf, f.Key, f.Value)
+	}
+	return append(buf, '\n')
+}
+
+// JSONEncoder writes records as one json object per line.
+//
+//	{"time":"2009-01-23T01:23:23.123+08:00","level":"info","msg":"message","key":"value"}
+type JSONEncoder struct{}
+
+func (enc *JSONEncoder) Encode(buf []byte, rec *Record) []byte {
+	buf = append(buf, `{"time":"`...)
+	buf = rec.Time.AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, `","level":"`...)
+	buf = append(buf, rec.Level.String()...)
+	buf = append(buf, `","msg":`...)
+	buf = appendJSONValue(buf, rec.Text)
+	if rec.File != "" {
+		buf = append(buf, `,"caller":`...)
+		buf = appendJSONValue(buf, caller(rec))
+	}
+	for _, f := range rec.Fields {
+		buf = append(buf, ',')
+		buf = appendJSONValue(buf, f.Key)
+		buf = append(buf, ':')
+		buf = appendJSONValue(buf, f.Value)
+	}
+	return append(buf, '}', '\n')
+}
+
+func caller(rec *Record) string {
+	file := rec.File
+	if rec.Flag&Lshortfile != 0 {
+		for i := len(file) - 1; i > 0; i-- {
+			if file[i] == '/' {
+				file = file[i+1:]
+				break
+			}
+		}
+	}
+	return file + ":" + strconv.Itoa(rec.Line)
+}
+
+func appendLogfmtField(buf []byte, key string, value any) []byte {
+	buf = appendLogfmtString(buf, key)
+	buf = append(buf, '=')
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	return appendLogfmtString(buf, s)
+}
+
+func appendLogfmtString(buf []byte, s string) []byte {
+	if needQuote(s) {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+func needQuote(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			return true
+		}
+	}
+	return false
+}
+
+func appendJSONValue(buf []byte, value any) []byte {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = fmt.Sprint(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return append(buf, data...)
+}
@@ -0,0 +1,109 @@
+package log
+
+import (
+	"fmt"
+	"time"
+)
+
+// Field is a key value pair attached to a log record.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// Record is one log event handed to the sinks.
+type Record struct {
+	Time   time.Time
+	Level  Level
+	Color  Color
+	Flag   int // flags of the logger, used by TextEncoder for the header.
+	File   string
+	Line   int
+	Text   string
+	Fields []Field
+}
+
+// Field return the value of the first field named key.
+func (rec *Record) Field(key string) (any, bool) {
+	for _, f := range rec.Fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// makeFields turn "key1, value1, key2, value2 ..." into fields. A key which is not a
+// string is printed by fmt, a key without value is kept as "!BADKEY".
+func makeFields(fields []Field, kv []any) []Field {
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 >= len(kv) {
+			fields = append(fields, Field{Key: "!BADKEY", Value: kv[i]})
+			break
+		}
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		fields = append(fields, Field{Key: key, Value: kv[i+1]})
+	}
+	return fields
+}
+
+// Entry is a logger carrying fields, each log through it has the fields attached.
+type Entry struct {
+	logger *Logger
+	fields []Field
+}
+
+// With return an entry carrying the key value pairs as fields.
+func (log *Logger) With(kv ...any) *Entry {
+	return &Entry{logger: log, fields: makeFields(nil, kv)}
+}
+
+// With return a new entry carrying the fields of e and the key value pairs.
+func (e *Entry) With(kv ...any) *Entry {
+	fields := make([]Field, len(e.fields), len(e.fields)+len(kv)/2)
+	copy(fields, e.fields)
+	return &Entry{logger: e.logger, fields: makeFields(fields, kv)}
+}
+
+func (e *Entry) Debugf(format string, v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Debug), Level_Debug, format, v, e.fields)
+}
+
+func (e *Entry) Debug(v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Debug), Level_Debug, "", v, e.fields)
+}
+
+func (e *Entry) Infof(format string, v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Info), Level_Info, format, v, e.fields)
+}
+
+func (e *Entry) Info(v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Info), Level_Info, "", v, e.fields)
+}
+
+func (e *Entry) Warnf(format string, v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Warn), Level_Warn, format, v, e.fields)
+}
+
+func (e *Entry) Warn(v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Warn), Level_Warn, "", v, e.fields)
+}
+
+func (e *Entry) Errorf(format string, v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Error), Level_Error, format, v, e.fields)
+}
+
+func (e *Entry) Error(v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Error), Level_Error, "", v, e.fields)
+}
+
+func (e *Entry) Fatalf(format string, v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Fatal), Level_Fatal, format, v, e.fields)
+}
+
+func (e *Entry) Fatal(v ...any) {
+	e.logger.output(2, ColorFromLevel(Level_Fatal), Level_Fatal, "", v, e.fields)
+}
@@ -1,5 +1,7 @@
 package log
 
+import "fmt"
+
 type Level int
 
 const (
@@ -17,3 +19,28 @@ var levelString = [...]string{
 	"[ERROR]",
 	"[FATAL]",
 }
+
+var levelName = [...]string{
+	"debug",
+	"info",
+	"warn",
+	"error",
+	"fatal",
+}
+
+func (l Level) String() string {
+	if l < Level_Debug || l > Level_Fatal {
+		return "unknown"
+	}
+	return levelName[l]
+}
+
+// ParseLevel get the level of a name such as "info".
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelName {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return Level_Debug, fmt.Errorf("unknown log level %q", name)
+}
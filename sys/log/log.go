@@ -16,10 +16,10 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lircstar/nemo/sys/util"
@@ -48,13 +48,15 @@ type Logger struct {
 	mu          sync.Mutex // ensures atomic writes; protects the following fields
 	flag        int        // properties
 	buf         []byte     // for accumulating text to write
-	level       Level
+	level       atomic.Int32
 	panicLevel  Level
 	enableColor bool
 	name        string
 	colorFile   *ColorFile
 
-	fileOutput *os.File
+	fileOutput *rotateFile
+	rotate     RotateOption
+	sinks      []Sink
 }
 
 // New creates a new Logger.   The out variable sets the
@@ -63,7 +65,8 @@ type Logger struct {
 // The flag argument defines the logging properties.
 
 func New(name string, colorenable bool) *Logger {
-	l := &Logger{flag: LstdFlags, level: Level_Debug, name: name, panicLevel: Level_Fatal}
+	l := &Logger{flag: LstdFlags, name: name, panicLevel: Level_Fatal}
+	l.level.Store(int32(Level_Debug))
 	if colorenable {
 		l.defaultColorFile()
 	}
@@ -91,11 +94,15 @@ func itoa(buf *[]byte, i int, wid int) {
 }
 
 func (log *Logger) formatHeader(t time.Time, buf *[]byte, file string, line int) {
+	formatHeader(log.flag, t, buf, file, line)
+}
+
+func formatHeader(flag int, t time.Time, buf *[]byte, file string, line int) {
 
 	*buf = append(*buf, ' ')
 
-	if log.flag&(Ldate|Ltime|Lmicroseconds) != 0 {
-		if log.flag&Ldate != 0 {
+	if flag&(Ldate|Ltime|Lmicroseconds) != 0 {
+		if flag&Ldate != 0 {
 			year, month, day := t.Date()
 			itoa(buf, year, 4)
 			*buf = append(*buf, '/')
@@ -104,14 +111,14 @@ func (log *Logger) formatHeader(t time.Time, buf *[]byte, file string, line int)
 			itoa(buf, day, 2)
 			*buf = append(*buf, ' ')
 		}
-		if log.flag&(Ltime|Lmicroseconds) != 0 {
+		if flag&(Ltime|Lmicroseconds) != 0 {
 			hour, min, sec := t.Clock()
 			itoa(buf, hour, 2)
 			*buf = append(*buf, ':')
 			itoa(buf, min, 2)
 			*buf = append(*buf, ':')
 			itoa(buf, sec, 2)
-			if log.flag&Lmicroseconds != 0 {
+			if flag&Lmicroseconds != 0 {
 				*buf = append(*buf, '.')
 				itoa(buf, t.Nanosecond()/1e3, 6)
 			}
@@ -119,8 +126,8 @@ func (log *Logger) formatHeader(t time.Time, buf *[]byte, file string, line int)
 		}
 	}
 
-	if log.flag&(Lshortfile|Llongfile) != 0 {
-		if log.flag&Lshortfile != 0 {
+	if flag&(Lshortfile|Llongfile) != 0 {
+		if flag&Lshortfile != 0 {
 			short := file
 			for i := len(file) - 1; i > 0; i-- {
 				if file[i] == '/' {
@@ -188,11 +195,22 @@ func (log *Logger) Output(calldepth int, prefix string, text string, c Color, ou
 }
 
 func (log *Logger) Log(c Color, level Level, format string, v ...any) {
+	log.output(2, c, level, format, v, nil)
+}
 
-	if level < log.level {
+// output writes a log with fields to the sinks, or to stdout / the log file when there
+// is no sink. skip is the count of frames between output and the user's code.
+func (log *Logger) output(skip int, c Color, level Level, format string, v []any, fields []Field) {
+
+	if level < log.Level() {
 		return
 	}
 
+	// the sinks may be changed meanwhile.
+	log.mu.Lock()
+	sinks := log.sinks
+	log.mu.Unlock()
+
 	prefix := fmt.Sprintf("%s", levelString[level])
 
 	var text string
@@ -203,9 +221,8 @@ func (log *Logger) Log(c Color, level Level, format string, v ...any) {
 		text = fmt.Sprintf(format, v...)
 	}
 
-	var out io.Writer
-
-	if log.enableColor {
+	// sinks decide by themselves whether to use color.
+	if log.enableColor || len(sinks) > 0 {
 
 		if log.colorFile != nil && c == NoColor {
 			c = log.colorFile.ColorFromText(text)
@@ -218,13 +235,49 @@ func (log *Logger) Log(c Color, level Level, format string, v ...any) {
 		c = NoColor
 	}
 
-	if log.fileOutput == nil {
-		out = os.Stdout
+	if len(sinks) > 0 {
+		rec := &Record{
+			Time:   time.Now(),
+			Level:  level,
+			Color:  c,
+			Flag:   log.flag,
+			Text:   strings.TrimSuffix(text, "\n"),
+			Fields: fields,
+		}
+		if log.flag&(Lshortfile|Llongfile) != 0 {
+			var ok bool
+			_, rec.File, rec.Line, ok = runtime.Caller(skip)
+			if !ok {
+				rec.File = "???"
+			}
+		}
+
+		log.mu.Lock()
+		for _, sink := range sinks {
+			_ = sink.Write(rec)
+		}
+		log.mu.Unlock()
 	} else {
-		out = log.fileOutput
-	}
+		var out io.Writer
+
+		if log.fileOutput == nil {
+			out = os.Stdout
+		} else {
+			out = log.fileOutput
+		}
 
-	_ = log.Output(3, prefix, text, c, out)
+		line := text
+		if len(fields) > 0 {
+			buf := []byte(strings.TrimSuffix(text, "\n"))
+			for _, f := range fields {
+				buf = append(buf, ' ')
+				buf = appendLogfmtField(buf, f.Key, f.Value)
+			}
+			line = string(buf)
+		}
+
+		_ = log.Output(skip+1, prefix, line, c, out)
+	}
 
 	if int(level) >= int(log.panicLevel) {
 		panic(text)
@@ -233,76 +286,74 @@ func (log *Logger) Log(c Color, level Level, format string, v ...any) {
 }
 
 func (log *Logger) Debugf(format string, v ...any) {
-	log.Log(ColorFromLevel(Level_Debug), Level_Debug, format, v...)
+	log.output(2, ColorFromLevel(Level_Debug), Level_Debug, format, v, nil)
 }
 
 func (log *Logger) Debug(v ...any) {
-	log.Log(ColorFromLevel(Level_Debug), Level_Debug, "", v...)
+	log.output(2, ColorFromLevel(Level_Debug), Level_Debug, "", v, nil)
 }
 
 func (log *Logger) Infof(format string, v ...any) {
-	log.Log(ColorFromLevel(Level_Info), Level_Info, format, v...)
+	log.output(2, ColorFromLevel(Level_Info), Level_Info, format, v, nil)
 }
 
 func (log *Logger) Info(v ...any) {
-	log.Log(ColorFromLevel(Level_Info), Level_Info, "", v...)
+	log.output(2, ColorFromLevel(Level_Info), Level_Info, "", v, nil)
 }
 
 func (log *Logger) Warnf(format string, v ...any) {
-	log.Log(ColorFromLevel(Level_Warn), Level_Warn, format, v...)
+	log.output(2, ColorFromLevel(Level_Warn), Level_Warn, format, v, nil)
 }
 
 func (log *Logger) Warn(v ...any) {
-	log.Log(ColorFromLevel(Level_Warn), Level_Warn, "", v...)
+	log.output(2, ColorFromLevel(Level_Warn), Level_Warn, "", v, nil)
 }
 
 func (log *Logger) Errorf(format string, v ...any) {
-	log.Log(ColorFromLevel(Level_Error), Level_Error, format, v...)
+	log.output(2, ColorFromLevel(Level_Error), Level_Error, format, v, nil)
 }
 
 func (log *Logger) Error(v ...any) {
-	log.Log(ColorFromLevel(Level_Error), Level_Error, "", v...)
+	log.output(2, ColorFromLevel(Level_Error), Level_Error, "", v, nil)
 }
 
 func (log *Logger) Fatalf(format string, v ...any) {
-
-	log.Log(ColorFromLevel(Level_Fatal), Level_Fatal, format, v...)
+	log.output(2, ColorFromLevel(Level_Fatal), Level_Fatal, format, v, nil)
 }
 
 func (log *Logger) Fatal(v ...any) {
-	log.Log(ColorFromLevel(Level_Fatal), Level_Fatal, "", v...)
+	log.output(2, ColorFromLevel(Level_Fatal), Level_Fatal, "", v, nil)
 }
 
 func (log *Logger) Recover() {
 	if r := recover(); r != nil {
 		buf := make([]byte, 4096)
 		l := runtime.Stack(buf, false)
-		log.Error("%v: %s", r, buf[:l])
+		log.Errorf("%v: %s", r, buf[:l])
 	}
 }
 
+// LogFile make the logger write to a file in filepath instead of stdout, the file is
+// rotated by the option set by SetRotate.
 func (log *Logger) LogFile(filepath string) bool {
-	now := time.Now()
-	filename := fmt.Sprintf("%s[%d%02d%02d%02d%02d%02d].log",
-		log.name,
-		now.Year(),
-		now.Month(),
-		now.Day(),
-		now.Hour(),
-		now.Minute(),
-		now.Second())
-
-	filename = path.Join(filepath, filename)
-	mode := os.O_RDWR | os.O_CREATE | os.O_APPEND
-	file, err := os.OpenFile(filename, mode, 0666)
+	file, err := openRotateFile(filepath, log.name, log.rotate)
 	if err != nil {
 		return false
 	}
+	if log.fileOutput != nil {
+		_ = log.fileOutput.Close()
+	}
 	log.enableColor = false
 	log.fileOutput = file
 
 	return true
 }
+
+// SetRotate set how the log file is rotated, it takes effect on the next LogFile.
+func (log *Logger) SetRotate(opt RotateOption) {
+	log.rotate = opt
+}
+
 func str2loglevel(level string) Level {
 
 	switch level {
@@ -326,11 +377,11 @@ func (log *Logger) SetLevelByString(level string) {
 }
 
 func (log *Logger) SetLevel(lv Level) {
-	log.level = lv
+	log.level.Store(int32(lv))
 }
 
 func (log *Logger) Level() Level {
-	return log.level
+	return Level(log.level.Load())
 }
 
 func (log *Logger) SetPanicLevelByString(level string) {
@@ -373,7 +424,7 @@ func (log *Logger) SetColorFile(file *ColorFile) {
 }
 
 func (log *Logger) IsDebugEnabled() bool {
-	return log.level == Level_Debug
+	return log.Level() == Level_Debug
 }
 
 func (log *Logger) defaultColorFile() {
@@ -384,12 +435,34 @@ func (log *Logger) defaultColorFile() {
 	}
 }
 
+// AddSink make the logger write records to sink, stdout and the log file are not used
+// any more once there is a sink.
+func (log *Logger) AddSink(sink Sink) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.sinks = append(log.sinks, sink)
+}
+
+// SetSinks replace all sinks of the logger, the old ones are not closed.
+func (log *Logger) SetSinks(sinks ...Sink) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.sinks = sinks
+}
+
 func (log *Logger) Close() {
 	if log.fileOutput != nil {
 		log.fileOutput.Close()
 	}
 
 	log.fileOutput = nil
+
+	log.mu.Lock()
+	for _, sink := range log.sinks {
+		_ = sink.Close()
+	}
+	log.sinks = nil
+	log.mu.Unlock()
 }
 
 // global log object.
@@ -406,6 +479,11 @@ func SetLevel(lv string) {
 	gLogger.SetLevelByString(lv)
 }
 
+// GetLevel get the level name of the global logger.
+func GetLevel() string {
+	return gLogger.Level().String()
+}
+
 func SetFlags(flag string) {
 	gLogger.SetFlagsByString(flag)
 }
@@ -414,54 +492,71 @@ func LogFile() {
 	gLogger.LogFile(util.GetProcessPath())
 }
 
+func SetRotate(opt RotateOption) {
+	gLogger.SetRotate(opt)
+}
+
 func Close() {
 	gLogger.Close()
 }
 
+func AddSink(sink Sink) {
+	gLogger.AddSink(sink)
+}
+
+func SetSinks(sinks ...Sink) {
+	gLogger.SetSinks(sinks...)
+}
+
+// With return an entry of the global logger carrying the key value pairs as fields.
+func With(kv ...any) *Entry {
+	return gLogger.With(kv...)
+}
+
 func Debugf(format string, v ...any) {
-	gLogger.Log(ColorFromLevel(Level_Debug), Level_Debug, format, v...)
+	gLogger.output(2, ColorFromLevel(Level_Debug), Level_Debug, format, v, nil)
 }
 
 func Debug(v ...any) {
-	gLogger.Log(ColorFromLevel(Level_Debug), Level_Debug, "", v...)
+	gLogger.output(2, ColorFromLevel(Level_Debug), Level_Debug, "", v, nil)
 }
 
 func Infof(format string, v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Info), Level_Info, format, v...)
+	gLogger.output(2, ColorFromLevel(Level_Info), Level_Info, format, v, nil)
 }
 
 func Info(v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Info), Level_Info, "", v...)
+	gLogger.output(2, ColorFromLevel(Level_Info), Level_Info, "", v, nil)
 }
 
 func Warnf(format string, v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Warn), Level_Warn, format, v...)
+	gLogger.output(2, ColorFromLevel(Level_Warn), Level_Warn, format, v, nil)
 }
 
 func Warn(v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Warn), Level_Warn, "", v...)
+	gLogger.output(2, ColorFromLevel(Level_Warn), Level_Warn, "", v, nil)
 }
 
 func Errorf(format string, v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Error), Level_Error, format, v...)
+	gLogger.output(2, ColorFromLevel(Level_Error), Level_Error, format, v, nil)
 }
 
 func Error(v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Error), Level_Error, "", v...)
+	gLogger.output(2, ColorFromLevel(Level_Error), Level_Error, "", v, nil)
 }
 
 func Fatalf(format string, v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Fatal), Level_Fatal, format, v...)
+	gLogger.output(2, ColorFromLevel(Level_Fatal), Level_Fatal, format, v, nil)
 }
 
 func Fatal(v ...interface{}) {
-	gLogger.Log(ColorFromLevel(Level_Fatal), Level_Fatal, "", v...)
+	gLogger.output(2, ColorFromLevel(Level_Fatal), Level_Fatal, "", v, nil)
 }
 
 func Recover() {
 	if r := recover(); r != nil {
 		buf := make([]byte, 4096)
 		l := runtime.Stack(buf, false)
-		gLogger.Error("%v: %s", r, buf[:l])
+		gLogger.Errorf("%v: %s", r, buf[:l])
 	}
 }
@@ -1,8 +1,13 @@
 package log
 
 import (
+	"errors"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLevel(t *testing.T) {
@@ -32,3 +37,144 @@ func TestSystemLog(t *testing.T) {
 	log.Println("hello2")
 	log.Println("hello3")
 }
+
+func TestWithFields(t *testing.T) {
+	logex := New("test3", false)
+	ring := NewRingSink(2)
+	logex.AddSink(ring)
+
+	logex.With("agent", 1).Debug("skip")
+	logex.With("agent", 7, "msg", "Login").Infof("recv %s", "ok")
+	logex.Warn("no field")
+
+	records := ring.Records()
+	if len(records) != 2 {
+		t.Fatalf("records %d", len(records))
+	}
+	if records[0].Text != "recv ok" || records[0].Level != Level_Info {
+		t.Fatalf("record %+v", records[0])
+	}
+	if v, ok := records[0].Field("agent"); !ok || v != 7 {
+		t.Fatalf("field agent %v", v)
+	}
+	if v, ok := records[0].Field("msg"); !ok || v != "Login" {
+		t.Fatalf("field msg %v", v)
+	}
+	if len(records[1].Fields) != 0 {
+		t.Fatalf("fields %v", records[1].Fields)
+	}
+}
+
+func TestSinksChanged(t *testing.T) {
+	logex := New("test4", false)
+	ring := NewRingSink(16)
+	logex.AddSink(ring)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			logex.AddSink(NewRingSink(1))
+			logex.SetSinks(ring)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			logex.Info("while the sinks change")
+		}
+	}()
+	wg.Wait()
+	if len(ring.Records()) == 0 {
+		t.Fatal("no record written")
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	rec := &Record{
+		Time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:  Level_Warn,
+		Text:   "hello world",
+		Fields: []Field{{"agent", 3}, {"remote", "1.2.3.4:5"}, {"err", errors.New("bad thing")}},
+	}
+
+	data := string(new(LogfmtEncoder).Encode(nil, rec))
+	want := `time=2024-01-02T03:04:05Z level=warn msg="hello world" agent=3 remote=1.2.3.4:5 err="bad thing"` + "\n"
+	if data != want {
+		t.Fatalf("logfmt %q", data)
+	}
+
+	data = string(new(JSONEncoder).Encode(nil, rec))
+	want = `{"time":"2024-01-02T03:04:05Z","level":"warn","msg":"hello world","agent":3,"remote":"1.2.3.4:5","err":"bad thing"}` + "\n"
+	if data != want {
+		t.Fatalf("json %q", data)
+	}
+}
+
+func TestRotateFile(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewRotateFileSink(dir, "rotate", RotateOption{MaxSize: 100, MaxBackups: 2, Compress: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logex := New("rotate", false)
+	logex.AddSink(sink)
+	for i := 0; i < 20; i++ {
+		logex.Infof("line %d of the rotated log file", i)
+	}
+
+	// old files are compressed and removed in background.
+	var names []string
+	for i := 0; i < 100; i++ {
+		entries, _ := os.ReadDir(dir)
+		names = names[:0]
+		gz := 0
+		for _, e := range entries {
+			names = append(names, e.Name())
+			if strings.HasSuffix(e.Name(), ".log.gz") {
+				gz++
+			}
+		}
+		if len(names) == 3 && gz == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(names) != 3 {
+		t.Fatalf("files %v", names)
+	}
+
+	data, err := os.ReadFile(sink.FileName())
+	if err != nil || !strings.Contains(string(data), "line 19") {
+		t.Fatalf("current file %q %v", data, err)
+	}
+	logex.Close()
+}
+
+func TestRotateClose(t *testing.T) {
+	f, err := openRotateFile(t.TempDir(), "close", RotateOption{MaxSize: 10, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write([]byte("rotate the file\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the mill goroutine is done once Close returns.
+	select {
+	case <-f.millDone:
+	default:
+		t.Fatal("mill goroutine still running")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Fatal("write after close")
+	}
+}
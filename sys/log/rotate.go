@@ -0,0 +1,267 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RotateNone   = ""
+	RotateDaily  = "daily"
+	RotateHourly = "hourly"
+)
+
+// RotateOption controls when a log file is rotated and how many old files are kept.
+type RotateOption struct {
+	MaxSize    int64         // bytes of one file, 0 means no limit.
+	Rotate     string        // RotateDaily, RotateHourly or RotateNone.
+	MaxBackups int           // count of old files kept, 0 keeps all.
+	MaxAge     time.Duration // old files older than it are removed, 0 keeps all.
+	Compress   bool          // gzip old files in background.
+}
+
+// rotateFile writes to name[YYYYMMDDhhmmss].log in dir and opens a new file when the
+// size or time limit of opt is reached. Old files are compressed and removed in the
+// background.
+type rotateFile struct {
+	dir  string
+	name string
+	opt  RotateOption
+
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	nextRotate time.Time
+
+	millCh   chan struct{}
+	millDone chan struct{} // closed when the mill goroutine ends.
+	millOnce sync.Once
+}
+
+func openRotateFile(dir string, name string, opt RotateOption) (*rotateFile, error) {
+	f := &rotateFile{dir: dir, name: name, opt: opt}
+	if err := f.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotateFile) Name() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return ""
+	}
+	return f.file.Name()
+}
+
+func (f *rotateFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	now := time.Now()
+	if (!f.nextRotate.IsZero() && !now.Before(f.nextRotate)) ||
+		(f.opt.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opt.MaxSize) {
+		if err := f.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close the file and wait for the mill goroutine to finish its run.
+func (f *rotateFile) Close() error {
+	f.mu.Lock()
+	if f.file == nil {
+		f.mu.Unlock()
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	f.mu.Unlock()
+
+	// no rotation comes once the file is closed, so the goroutine is not started
+	// anymore, and millRun takes f.mu.
+	f.millOnce.Do(func() {})
+	if f.millCh != nil {
+		close(f.millCh)
+		<-f.millDone
+	}
+	return err
+}
+
+// rotate close the current file and open a new one, must be called with f locked.
+func (f *rotateFile) rotate(now time.Time) error {
+	filename := logFileName(f.dir, f.name, now)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			break
+		}
+		filename = strings.TrimSuffix(logFileName(f.dir, f.name, now), ".log") + fmt.Sprintf("_%d.log", i)
+	}
+
+	mode := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	file, err := os.OpenFile(filename, mode, 0666)
+	if err != nil {
+		return err
+	}
+
+	old := f.file
+	f.file = file
+	f.size = 0
+
+	switch f.opt.Rotate {
+	case RotateDaily:
+		y, m, d := now.Date()
+		f.nextRotate = time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+	case RotateHourly:
+		f.nextRotate = now.Truncate(time.Hour).Add(time.Hour)
+	default:
+		f.nextRotate = time.Time{}
+	}
+
+	if old != nil {
+		_ = old.Close()
+		f.mill()
+	}
+	return nil
+}
+
+// mill wake up the background goroutine to compress and remove old files.
+func (f *rotateFile) mill() {
+	if !f.opt.Compress && f.opt.MaxBackups <= 0 && f.opt.MaxAge <= 0 {
+		return
+	}
+	f.millOnce.Do(func() {
+		f.millCh = make(chan struct{}, 1)
+		f.millDone = make(chan struct{})
+		go func() {
+			defer close(f.millDone)
+			for range f.millCh {
+				f.millRun()
+			}
+		}()
+	})
+	select {
+	case f.millCh <- struct{}{}:
+	default:
+	}
+}
+
+func (f *rotateFile) millRun() {
+	dir := f.dir
+	if dir == "" {
+		dir = "."
+	}
+
+	// list with f locked, so the file written now is not taken as a backup.
+	f.mu.Lock()
+	current := ""
+	if f.file != nil {
+		current = path.Base(f.file.Name())
+	}
+	entries, err := os.ReadDir(dir)
+	f.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		name    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || name == current || !strings.HasPrefix(name, f.name+"[") {
+			continue
+		}
+		if !strings.HasSuffix(name, ".log") && !strings.HasSuffix(name, ".log.gz") {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			backups = append(backups, backup{path.Join(dir, name), info.ModTime()})
+		}
+	}
+
+	// the newest first.
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].modTime.Equal(backups[j].modTime) {
+			return backups[i].modTime.After(backups[j].modTime)
+		}
+		return backups[i].name > backups[j].name
+	})
+
+	for i, b := range backups {
+		if (f.opt.MaxBackups > 0 && i >= f.opt.MaxBackups) ||
+			(f.opt.MaxAge > 0 && time.Since(b.modTime) > f.opt.MaxAge) {
+			_ = os.Remove(b.name)
+			continue
+		}
+		if f.opt.Compress && strings.HasSuffix(b.name, ".log") {
+			if err := compressFile(b.name); err != nil {
+				Errorf("compress log file %s error: %v", b.name, err)
+			}
+		}
+	}
+}
+
+// compressFile gzip src into src.gz and remove src.
+func compressFile(src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(src+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(src + ".gz")
+		return err
+	}
+
+	// keep the time of the log, old files are ordered by it.
+	if info, err := in.Stat(); err == nil {
+		_ = os.Chtimes(src+".gz", info.ModTime(), info.ModTime())
+	}
+	_ = in.Close()
+	return os.Remove(src)
+}
+
+func logFileName(dir string, name string, now time.Time) string {
+	filename := fmt.Sprintf("%s[%d%02d%02d%02d%02d%02d].log",
+		name,
+		now.Year(),
+		now.Month(),
+		now.Day(),
+		now.Hour(),
+		now.Minute(),
+		now.Second())
+
+	return path.Join(dir, filename)
+}
@@ -0,0 +1,167 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Sink is where the records of a logger go. Write is called with the logger locked.
+type Sink interface {
+	Write(rec *Record) error
+	Close() error
+}
+
+//-------------------------------------------------------------------------------------
+// ConsoleSink
+
+// ConsoleSink writes records to stdout, colored by the level and the color file of the
+// logger if Color is set.
+type ConsoleSink struct {
+	Out     io.Writer
+	Encoder Encoder
+	Color   bool
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewConsoleSink create a sink to stdout, the text encoder is used if enc is nil.
+func NewConsoleSink(enc Encoder, color bool) *ConsoleSink {
+	if enc == nil {
+		enc = new(TextEncoder)
+	}
+	return &ConsoleSink{Out: os.Stdout, Encoder: enc, Color: color}
+}
+
+func (sink *ConsoleSink) Write(rec *Record) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	colorLog := sink.Color && rec.Color != NoColor
+
+	sink.buf = sink.buf[:0]
+	if colorLog {
+		sink.buf = append(sink.buf, logColorPrefix[rec.Color]...)
+	}
+	sink.buf = sink.Encoder.Encode(sink.buf, rec)
+	if colorLog {
+		sink.buf = append(sink.buf[:len(sink.buf)-1], logColorSuffix...)
+		sink.buf = append(sink.buf, '\n')
+	}
+
+	_, err := sink.Out.Write(sink.buf)
+	return err
+}
+
+func (sink *ConsoleSink) Close() error {
+	return nil
+}
+
+//-------------------------------------------------------------------------------------
+// FileSink
+
+// FileSink writes records to files in a directory, files are named and rotated like
+// Logger.LogFile does.
+type FileSink struct {
+	file    *rotateFile
+	encoder Encoder
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewFileSink create a file sink which opens a new file when the current one reaches
+// maxSize bytes, maxSize <= 0 means never. The text encoder is used if enc is nil.
+func NewFileSink(dir string, name string, maxSize int64, enc Encoder) (*FileSink, error) {
+	return NewRotateFileSink(dir, name, RotateOption{MaxSize: maxSize}, enc)
+}
+
+// NewRotateFileSink create a file sink rotated by opt. The text encoder is used if enc
+// is nil.
+func NewRotateFileSink(dir string, name string, opt RotateOption, enc Encoder) (*FileSink, error) {
+	if enc == nil {
+		enc = new(TextEncoder)
+	}
+	file, err := openRotateFile(dir, name, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file, encoder: enc}, nil
+}
+
+// FileName return the name of the file written now.
+func (sink *FileSink) FileName() string {
+	return sink.file.Name()
+}
+
+func (sink *FileSink) Write(rec *Record) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	sink.buf = sink.encoder.Encode(sink.buf[:0], rec)
+	_, err := sink.file.Write(sink.buf)
+	return err
+}
+
+func (sink *FileSink) Close() error {
+	return sink.file.Close()
+}
+
+//-------------------------------------------------------------------------------------
+// RingSink
+
+// RingSink keeps the last records in memory, it is meant for tests.
+type RingSink struct {
+	mu      sync.Mutex
+	records []Record
+	next    int
+	full    bool
+}
+
+func NewRingSink(size int) *RingSink {
+	if size <= 0 {
+		size = 128
+	}
+	return &RingSink{records: make([]Record, size)}
+}
+
+func (sink *RingSink) Write(rec *Record) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	r := *rec
+	r.Fields = append([]Field(nil), rec.Fields...)
+	sink.records[sink.next] = r
+	sink.next++
+	if sink.next == len(sink.records) {
+		sink.next = 0
+		sink.full = true
+	}
+	return nil
+}
+
+// Records return the kept records, the oldest first.
+func (sink *RingSink) Records() []Record {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if !sink.full {
+		return append([]Record(nil), sink.records[:sink.next]...)
+	}
+	ret := make([]Record, 0, len(sink.records))
+	ret = append(ret, sink.records[sink.next:]...)
+	return append(ret, sink.records[:sink.next]...)
+}
+
+func (sink *RingSink) Reset() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	sink.next = 0
+	sink.full = false
+}
+
+func (sink *RingSink) Close() error {
+	return nil
+}
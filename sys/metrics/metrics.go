@@ -0,0 +1,393 @@
+// Package metrics is a small metrics library writing the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefBuckets are the histogram buckets in seconds used when none are given.
+var DefBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry nemo registers its metrics in.
+var Default = NewRegistry()
+
+// -------------------------------------------------------------------------------------
+// Registry
+
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	describe() *desc
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register m, the metric already registered with the same name is returned instead so
+// packages can define their metrics in init without caring about the order.
+func (r *Registry) register(m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := m.describe()
+	if old, ok := r.metrics[d.name]; ok {
+		if old.describe().typ != d.typ {
+			panic(fmt.Sprintf("metric %s registered as %s", d.name, old.describe().typ))
+		}
+		return old
+	}
+	r.metrics[d.name] = m
+	return m
+}
+
+// WriteText write all metrics in the Prometheus text format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		d := m.describe()
+		fmt.Fprintf(bw, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", d.name, d.typ)
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serve the metrics of r.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// -------------------------------------------------------------------------------------
+// desc and series shared by the metrics.
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) describe() *desc {
+	return d
+}
+
+// key of the label values, it checks the count of them.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs format {a="1",b="2"}, extra is appended, such as le of histogram.
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i])
+		b.WriteString(`="`)
+		b.WriteString(extra[i+1])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) add(n float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+n)) {
+			return
+		}
+	}
+}
+
+func (v *value) set(n float64) {
+	v.bits.Store(math.Float64bits(n))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+type series[T any] struct {
+	mu     sync.RWMutex
+	values map[string]*T
+	labels map[string][]string
+}
+
+func (s *series[T]) get(d *desc, values []string, create func() *T) *T {
+	key := d.key(values)
+	s.mu.RLock()
+	v, ok := s.values[key]
+	s.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok = s.values[key]; ok {
+		return v
+	}
+	if s.values == nil {
+		s.values = make(map[string]*T)
+		s.labels = make(map[string][]string)
+	}
+	v = create()
+	s.values[key] = v
+	s.labels[key] = append([]string(nil), values...)
+	return v
+}
+
+func (s *series[T]) delete(d *desc, values []string) {
+	key := d.key(values)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	delete(s.labels, key)
+}
+
+// each call f in the order of the label values.
+func (s *series[T]) each(f func(values []string, v *T)) {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*T, len(keys))
+	labels := make([][]string, len(keys))
+	for i, key := range keys {
+		values[i] = s.values[key]
+		labels[i] = s.labels[key]
+	}
+	s.mu.RUnlock()
+
+	for i := range keys {
+		f(labels[i], values[i])
+	}
+}
+
+// -------------------------------------------------------------------------------------
+// Counter only goes up.
+
+type Counter struct {
+	desc
+	series series[value]
+}
+
+// NewCounter register a counter in the default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, typeCounter, labels}}
+	return r.register(c).(*Counter)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add n to the counter, n must not be negative.
+func (c *Counter) Add(n float64, labelValues ...string) {
+	if n < 0 {
+		return
+	}
+	c.series.get(&c.desc, labelValues, newValue).add(n)
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.series.get(&c.desc, labelValues, newValue).get()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.series.each(func(values []string, v *value) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(values), formatFloat(v.get()))
+	})
+}
+
+// -------------------------------------------------------------------------------------
+// Gauge goes up and down.
+
+type Gauge struct {
+	desc
+	series series[value]
+}
+
+// NewGauge register a gauge in the default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, typeGauge, labels}}
+	return r.register(g).(*Gauge)
+}
+
+func (g *Gauge) Set(n float64, labelValues ...string) {
+	g.series.get(&g.desc, labelValues, newValue).set(n)
+}
+
+func (g *Gauge) Add(n float64, labelValues ...string) {
+	g.series.get(&g.desc, labelValues, newValue).add(n)
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.series.get(&g.desc, labelValues, newValue).get()
+}
+
+// Delete the series of the label values.
+func (g *Gauge) Delete(labelValues ...string) {
+	g.series.delete(&g.desc, labelValues)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.series.each(func(values []string, v *value) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(values), formatFloat(v.get()))
+	})
+}
+
+// -------------------------------------------------------------------------------------
+// Histogram counts observations in buckets.
+
+type Histogram struct {
+	desc
+	buckets []float64
+	series  series[histogramValue]
+}
+
+type histogramValue struct {
+	counts []atomic.Uint64 // count of each bucket, the last one is +Inf.
+	sum    value
+}
+
+// NewHistogram register a histogram in the default registry, DefBuckets are used if
+// buckets is nil.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{desc: desc{name, help, typeHistogram, labels}, buckets: buckets}
+	return r.register(h).(*Histogram)
+}
+
+func (h *Histogram) Observe(n float64, labelValues ...string) {
+	v := h.series.get(&h.desc, labelValues, func() *histogramValue {
+		return &histogramValue{counts: make([]atomic.Uint64, len(h.buckets)+1)}
+	})
+	i := sort.SearchFloat64s(h.buckets, n)
+	v.counts[i].Add(1)
+	v.sum.add(n)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.series.each(func(values []string, v *histogramValue) {
+		var count uint64
+		for i, upper := range h.buckets {
+			count += v.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", formatFloat(upper)), count)
+		}
+		count += v.counts[len(h.buckets)].Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(values), formatFloat(v.sum.get()))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(values), count)
+	})
+}
+
+// -------------------------------------------------------------------------------------
+// utility.
+
+func newValue() *value {
+	return new(value)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
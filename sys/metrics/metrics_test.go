@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCounterGauge(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test counter.", "kind")
+	g := r.NewGauge("test_gauge", "Test gauge.")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc("a")
+				g.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Add(2, "b")
+	c.Add(-1, "b")
+	g.Dec()
+
+	if v := c.Value("a"); v != 1000 {
+		t.Fatalf("counter a = %v", v)
+	}
+	if v := c.Value("b"); v != 2 {
+		t.Fatalf("counter b = %v", v)
+	}
+	if v := g.Value(); v != 999 {
+		t.Fatalf("gauge = %v", v)
+	}
+
+	// the same name gives the same metric.
+	if r.NewCounter("test_total", "", "kind") != c {
+		t.Fatal("counter registered twice")
+	}
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge 999
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a"} 1000
+test_total{kind="b"} 2
+`
+	if b.String() != want {
+		t.Fatalf("text:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("test_seconds", "Test histogram.", []float64{1, 0.1}, "id")
+	h.Observe(0.05, "1")
+	h.Observe(0.1, "1")
+	h.Observe(0.5, "1")
+	h.Observe(5, "1")
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{id="1",le="0.1"} 2
+test_seconds_bucket{id="1",le="1"} 3
+test_seconds_bucket{id="1",le="+Inf"} 4
+test_seconds_sum{id="1"} 5.65
+test_seconds_count{id="1"} 4
+`
+	if rec.Body.String() != want {
+		t.Fatalf("text:\n%s\nwant:\n%s", rec.Body.String(), want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type %v", ct)
+	}
+}
+
+func TestLabelEscape(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("test_escape", "Help with \\ and\nnewline.", "name")
+	g.Set(1, `a"b\c`)
+
+	var b strings.Builder
+	_ = r.WriteText(&b)
+	if !strings.Contains(b.String(), `test_escape{name="a\"b\\c"} 1`) {
+		t.Fatalf("label not escaped:\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), `# HELP test_escape Help with \\ and\nnewline.`) {
+		t.Fatalf("help not escaped:\n%s", b.String())
+	}
+}
@@ -55,7 +55,8 @@ func (pool *SyncPool) Alloc(size int) []byte {
 func (pool *SyncPool) Free(mem []byte) {
 	if size := cap(mem); size <= pool.maxSize {
 		for i := 0; i < len(pool.classesSize); i++ {
-			if pool.classesSize[i] >= size {
+			// a smaller chunk would be sliced past its capacity by Alloc.
+			if pool.classesSize[i] == size {
 				pool.classes[i].Put(&mem)
 				return
 			}
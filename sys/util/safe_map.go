@@ -35,6 +35,8 @@ func (sm *SafeMap) Delete(key any) {
 }
 
 func (sm *SafeMap) Len() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
 	return len(sm.m)
 }
 